@@ -26,16 +26,38 @@ func main() {
 	// for dump we want to default to non-verbose output, as it is a bit too verbose
 	flag.BoolVar(&config.Verbose, "verbose", false, "specifies whether verbose output is requested, default false")
 	flag.BoolVar(&config.DumpRoles, "dump-roles", true, "specifies whether to use pg_dumpall to dump roles to a file, default true")
+	flag.StringVar(&config.DumpRolesMethod, "dump-roles-method", util.RolesPgDumpall, "how to dump roles: pg_dumpall dumps all roles of the cluster, native dumps only the roles the database refers to from the catalog, which works without superuser privileges")
+	flag.BoolVar(&config.DumpRolePasswords, "dump-role-passwords", false, "dump the password hashes of the dumped roles into a file only the user running ts-dump can read, needs superuser privileges")
+	flag.StringVar(&config.RolePasswordsKeyFile, "role-passwords-key-file", "", "encrypt the dumped role passwords with a key derived from the content of this file")
 	flag.BoolVar(&config.DumpTablespaces, "dump-tablespaces", true, "specifies whether to use pg_dumpall to dump tablespaces to a file, default true")
 	flag.BoolVar(&config.DumpPauseJobs, "dump-pause-jobs", true, "pause background jobs that could disrupt a parallel dump process by performing DDL during the dump,  defaults to true, only effective on parallel dumps")
 	flag.IntVar(&config.DumpJobFinishTimeout, "dump-job-finish-timeout", 600, "number of seconds to wait for possibly DDL performing jobs to finish before timing out, default 600 (10 minutes), set to -1 to not wait on jobs")
 	flag.BoolVar(&config.DumpPauseUDAs, "dump-pause-UDAs", true, "pause user defined actions (only for Timescale 2.0+) when pausing jobs, default true")
+	flag.BoolVar(&config.DumpAnalyzeStale, "analyze-stale", false, "with --jobs, analyze the tables whose size in pg_class is outdated before dumping, so pg_dump starts the largest tables first")
+	flag.BoolVar(&config.DumpFingerprints, "dump-fingerprints", false, "record the row count and a hash of the rows of every table and chunk in the dump, for ts-restore --verify-fingerprints, which reads all of the data once more")
+	flag.BoolVar(&config.DumpCaggRows, "dump-cagg-rows", false, "record how many rows the materialization of every continuous aggregate holds, shown next to the counts after ts-restore --refresh-caggs, which reads the materializations once more")
+	flag.StringVar(&config.DumpIncrementalFrom, "incremental-from", "", "the directory of a previous dump, only the data of chunks that changed since that dump is dumped and ts-restore takes the rest from it, default is a full dump")
+	flag.StringVar(&config.DumpSince, "since", "", "only dump chunks containing data at or after this time (RFC 3339, ie 2020-10-04T00:00:00Z), catalog entries for other chunks are removed on restore")
+	flag.StringVar(&config.DumpUntil, "until", "", "only dump chunks containing data before this time (RFC 3339, ie 2020-10-11T00:00:00Z), catalog entries for other chunks are removed on restore")
+	var prune bool
+	flag.BoolVar(&prune, "prune-repository", false, "instead of dumping, remove the objects of --repository that no dump stored in it uses anymore, once those dumps have been deleted")
+	flag.Var((*util.StringList)(&config.Hypertables), "hypertable", "only dump this hypertable (schema.name), along with its continuous aggregates, can be given multiple times, the dump can be restored into a database with other hypertables")
 	flag.Parse()
 	config.PGDumpFlags = flag.Args()
 	config, err := util.CleanConfig(config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if prune {
+		if config.Repository == "" {
+			log.Fatal("--prune-repository needs the --repository to prune")
+		}
+		err = dump.PruneRepository(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	err = dump.DoDump(config)
 	if err != nil {
 		log.Fatal(err)
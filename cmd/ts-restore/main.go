@@ -26,12 +26,54 @@ func main() {
 	// for restore we want to default to verbose output, it gives good information about how the restore is proceeding
 	flag.BoolVar(&config.Verbose, "verbose", true, "specifies whether verbose output is requested, default true")
 	flag.BoolVar(&config.DoUpdate, "do-update", true, "set to false to leave TimescaleDB at the dumped version, defaults to true, which upgrades to default installed")
+	var finishURI string
+	flag.StringVar(&finishURI, "finish", "", "take the database at this URI out of restoring mode, where a failed restore may have left it, and restart its background jobs")
+	var enableJobsURI string
+	flag.StringVar(&enableJobsURI, "enable-jobs", "", "schedule the background jobs disabled by restoring into the database at this URI with --jobs-disabled again")
+	flag.BoolVar(&config.RestoreJobsDisabled, "jobs-disabled", false, "leave the restored background jobs (policies, continuous aggregate refreshes and user defined actions) disabled, until enabled with --enable-jobs")
+	flag.StringVar(&config.RestoreJobRules, "job-rules", "", "JSON file with rules changing the restored background jobs, such as disabling retention policies or shifting schedules, applied before they start")
+	flag.BoolVar(&config.RestoreAnalyze, "analyze", false, "analyze the restored tables and chunks, up to --jobs at a time, so that queries are planned with statistics")
+	flag.StringVar(&config.RestoreAnalyzeSince, "analyze-since", "", "only analyze chunks containing data at or after this time (RFC 3339, ie 2020-10-04T00:00:00Z), along with all regular tables")
+	flag.BoolVar(&config.RestoreOrderBySize, "order-by-size", false, "start building the largest indexes and constraints first, by the sizes recorded in the dump")
+	flag.BoolVar(&config.RestoreRecentFirst, "recent-first", false, "restore the data of the newest chunks first, going back in time, after the regular tables")
+	flag.IntVar(&config.RestoreRecentDays, "recent-days", 0, "restore the chunks with data from this many days before the dump ahead of the older ones, announcing when they are done, implies --recent-first")
+	flag.StringVar(&config.RestoreRecentHook, "recent-hook", "", "command to run once the data of the chunks of --recent-days is restored, with TS_RESTORE_RECENT_SINCE set to the start of the recent data")
+	flag.BoolVar(&config.RestoreCheckCatalog, "check-catalog", false, "check the consistency of the TimescaleDB catalog once the restore is done and report the problems found")
+	flag.StringVar(&config.RestoreVerify, "verify-fingerprints", "", "compare the restored data to the fingerprints recorded by ts-dump --dump-fingerprints and report mismatches (warn) or fail the restore on them (fail)")
+	flag.StringVar(&config.RestoreRefreshCaggs, "refresh-caggs", "", "refresh continuous aggregates once the restore is done, over all of their data (full) or the window of their refresh policy (policy), and report their row counts")
+	flag.BoolVar(&config.RestoreCreateDB, "create-db", false, "create the database named in the URI, with the encoding, locale, owner, tablespace and settings of the dumped database")
+	flag.BoolVar(&config.RestoreGlobals, "restore-globals", false, "create the roles and tablespaces in roles.sql and tablespaces.sql of the dump that don't exist yet before restoring")
+	flag.Var(&config.TablespaceMap, "tablespace-map", "restore objects in tablespace old into tablespace new instead, given as old=new, or old= for the default tablespace, can be given multiple times")
+	flag.Var(&config.RoleMap, "role-map", "restore the ownership and privileges of role src to role dst instead, given as src=dst, can be given multiple times")
+	flag.StringVar(&config.RolePasswordsKeyFile, "role-passwords-key-file", "", "the key file the role passwords were encrypted with by ts-dump, for --restore-globals")
+	flag.BoolVar(&config.RestoreSettings, "restore-settings", false, "apply the settings of the dumped database (ALTER DATABASE ... SET) and of roles in it (ALTER ROLE ... IN DATABASE ... SET) once the restore is done")
+	flag.BoolVar(&config.RestoreForce, "force", false, "restore into a database that is not empty")
+	flag.BoolVar(&config.RestoreClean, "clean", false, "drop the objects in the dump that already exist in the database before restoring")
+	flag.BoolVar(&config.RestoreResume, "resume", false, "resume a restore that failed, skipping what it restored already")
+	flag.StringVar(&config.RestoreStateFile, "state-file", "", "file to record the progress of the restore in, for --resume, defaults to restore_state_<database>.json in the dump directory")
+	flag.Var((*util.StringList)(&config.Hypertables), "hypertable", "restore only this hypertable (as schema.name) into the existing database, can be given multiple times")
 	flag.Parse()
 	config.PGRestoreFlags = flag.Args()
 	config, err := util.CleanConfig(config)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if finishURI != "" {
+		config.DbURI = finishURI
+		err = restore.FinishRestore(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if enableJobsURI != "" {
+		config.DbURI = enableJobsURI
+		err = restore.EnableJobs(config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	err = restore.DoRestore(config)
 	if err != nil {
 		log.Fatal(err)
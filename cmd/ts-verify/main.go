@@ -0,0 +1,25 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/timescale/timescaledb-backup/pkg/util"
+	"github.com/timescale/timescaledb-backup/pkg/verify"
+)
+
+func main() {
+	config := &util.Config{}
+	flag.StringVar(&config.VerifySourceURI, "source", "", "the PostgreSQL URI of the database that was dumped, in postgresql://[user[:password]@][netloc][:port][,...][/dbname][?param1=value1&...] format")
+	flag.StringVar(&config.VerifyTargetURI, "target", "", "the PostgreSQL URI of the database it was restored to, in the same format")
+	flag.IntVar(&config.Jobs, "jobs", 4, "the number of tables and chunks to compare at a time, defaults to 4")
+	flag.BoolVar(&config.Verbose, "verbose", false, "specifies whether verbose output is requested, default false")
+	flag.Parse()
+	err := verify.DoVerify(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,70 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package dump
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+const databaseInfoSQL = `SELECT d.datname, pg_encoding_to_char(d.encoding), d.datcollate, d.datctype, pg_get_userbyid(d.datdba), t.spcname
+	FROM pg_database d INNER JOIN pg_tablespace t ON t.oid = d.dattablespace
+	WHERE d.datname = current_database()`
+
+// settings of the database that apply to all roles
+const databaseSettingsSQL = `SELECT unnest(s.setconfig) FROM pg_db_role_setting s
+	INNER JOIN pg_database d ON d.oid = s.setdatabase
+	WHERE d.datname = current_database() AND s.setrole = 0`
+
+// settings of roles in the database
+const roleSettingsSQL = `SELECT r.rolname, s.setconfig FROM pg_db_role_setting s
+	INNER JOIN pg_database d ON d.oid = s.setdatabase
+	INNER JOIN pg_roles r ON r.oid = s.setrole
+	WHERE d.datname = current_database()
+	ORDER BY r.rolname`
+
+//getDatabaseInfo records the properties and settings of the database being
+//dumped, so that ts-restore --create-db can create it alike, pg_dump only
+//dumps them with --create
+func getDatabaseInfo(conn *pgx.Conn) (*util.DatabaseInfo, error) {
+	ctx := context.Background()
+	info := &util.DatabaseInfo{}
+	err := conn.QueryRow(ctx, databaseInfoSQL).Scan(&info.Name, &info.Encoding, &info.Collate, &info.Ctype, &info.Owner, &info.Tablespace)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.Query(ctx, databaseSettingsSQL)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var setting string
+		if err = rows.Scan(&setting); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		info.Settings = append(info.Settings, setting)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = conn.Query(ctx, roleSettingsSQL)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		s := util.RoleSetting{}
+		if err = rows.Scan(&s.Role, &s.Settings); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		info.RoleSettings = append(info.RoleSettings, s)
+	}
+	rows.Close()
+	return info, rows.Err()
+}
@@ -15,11 +15,19 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/store"
 	"github.com/timescale/timescaledb-backup/pkg/util"
 )
 
 // DoDump takes a config and performs a database dump
 func DoDump(cf *util.Config) error {
+	err := checkSelectiveConfig(cf)
+	if err != nil {
+		return err
+	}
+	if cf.DumpFingerprints && (len(cf.Hypertables) > 0 || cf.DumpSince != "" || cf.DumpUntil != "") {
+		return errors.New("fingerprints can only be recorded in dumps of whole databases")
+	}
 	// start moving jobs, we can do other things while waiting for them to stop potentially
 	var wg sync.WaitGroup
 	cleanup := make(chan bool)
@@ -56,23 +64,119 @@ func DoDump(cf *util.Config) error {
 	}
 	defer file.Close()
 
-	tsInfo, err := getTimescaleInfo(cf.DbURI)
-	encoder := json.NewEncoder(file)
-	err = encoder.Encode(&tsInfo)
+	//Parallel dumps start the largest tables first, going by pg_class, see
+	//sizes.go. Without --analyze-stale the tables are only counted, as a hint,
+	//which mustn't fail the dump.
+	if cf.Jobs > 0 {
+		err = analyzeStaleTables(cf)
+		if err != nil && cf.DumpAnalyzeStale {
+			return err
+		}
+		if err != nil {
+			fmt.Printf("%sWARNING: failed to count the tables with outdated sizes in pg_class: %s\n", time.Now().Format("2006/01/02 15:04:05 "), err)
+		}
+	}
+
+	//Everything is dumped from a single snapshot, see snapshot.go
+	snap, err := exportSnapshot(cf.DbURI)
 	if err != nil {
-		return fmt.Errorf("Error writing Timescale info %w", err)
+		return err
+	}
+	defer snap.close()
+	if cf.Verbose {
+		fmt.Printf("%sDumping snapshot %s at LSN %s\n", time.Now().Format("2006/01/02 15:04:05 "), snap.info.ID, snap.info.LSN)
+	}
+
+	tsInfo, err := getTimescaleInfo(snap.conn)
+	if err != nil {
+		return err
+	}
+	tsInfo.Snapshot = &snap.info
+	tsInfo.Database, err = getDatabaseInfo(snap.conn)
+	if err != nil {
+		return fmt.Errorf("Error getting database info: %w", err)
+	}
+	tsInfo.Chunks, err = getChunkInfo(snap.conn)
+	if err != nil {
+		return err
+	}
+	tsInfo.Hypertables, err = getHypertableInfo(snap.conn)
+	if err != nil {
+		return err
+	}
+	tsInfo.IndexSizes, err = getIndexSizes(snap.conn)
+	if err != nil {
+		return err
+	}
+	var chunkFlags []string
+	if len(cf.Hypertables) > 0 {
+		tsInfo.Hypertables, err = selectHypertables(snap.conn, tsInfo.Hypertables, cf.Hypertables)
+		if err != nil {
+			return fmt.Errorf("Error selecting hypertables: %w", err)
+		}
+		// the chunks themselves are not dumped, their data is dumped through the hypertable
+		tsInfo.Selective = true
+		tsInfo.Chunks = nil
+		chunkFlags = selectiveDumpFlags(tsInfo.Hypertables)
+	}
+	if cf.DumpSince != "" || cf.DumpUntil != "" {
+		chunkFlags, err = planTimeRange(cf, snap.conn, &tsInfo)
+		if err != nil {
+			return fmt.Errorf("Error planning time range dump: %w", err)
+		}
+	}
+	//Incremental dumps find unchanged chunks by their fingerprints, see incremental.go
+	if cf.DumpFingerprints || cf.DumpIncrementalFrom != "" {
+		fingerprints, err := dumpFingerprints(cf, snap, !cf.DumpFingerprints)
+		if err != nil {
+			return fmt.Errorf("Error taking fingerprints: %w", err)
+		}
+		if cf.DumpFingerprints {
+			tsInfo.Fingerprints = fingerprints
+		}
+		err = setChunkFingerprints(tsInfo.Chunks, fingerprints)
+		if err != nil {
+			return err
+		}
+	}
+	if cf.DumpIncrementalFrom != "" {
+		incrementalFlags, err := planIncremental(cf, &tsInfo)
+		if err != nil {
+			return fmt.Errorf("Error planning incremental dump: %w", err)
+		}
+		chunkFlags = append(chunkFlags, incrementalFlags...)
+	}
+	//Counts of a time range dump wouldn't match what it restores
+	if cf.DumpCaggRows && tsInfo.TimeRange == nil {
+		err = countContinuousAggRows(cf, snap.conn, tsInfo.Hypertables)
+		if err != nil {
+			return err
+		}
 	}
 
 	//We need to use pg_dumpall to dump roles and tablespaces, these may be necessary to
-	//do a restore later, so best to have them around.
+	//do a restore later, so best to have them around. Roles can also be dumped
+	//from the catalog where pg_dumpall isn't allowed to, see globals.go
 	if cf.DumpRoles {
 		if cf.Verbose {
 			fmt.Println(time.Now().Format("2006/01/02 15:04:05 ") + "Dumping roles")
 		}
-		err = runDumpAll(cf, "roles")
+		var roleNames []string
+		if cf.DumpRolesMethod == util.RolesNative {
+			roleNames, err = dumpRolesNative(cf, snap.conn)
+		} else {
+			err = runDumpAll(cf, "roles")
+		}
 		if err != nil {
 			return fmt.Errorf("Error dumping roles %w", err)
 		}
+		tsInfo.RolesMethod = cf.DumpRolesMethod
+		if cf.DumpRolePasswords {
+			tsInfo.RolePasswordsFile, err = dumpRolePasswords(cf, snap.conn, roleNames)
+			if err != nil {
+				return fmt.Errorf("Error dumping role passwords %w", err)
+			}
+		}
 	}
 	if cf.DumpTablespaces {
 		if cf.Verbose {
@@ -83,10 +187,18 @@ func DoDump(cf *util.Config) error {
 			return fmt.Errorf("Error dumping tablespaces %w", err)
 		}
 	}
+	if (cf.DumpRoles && cf.DumpRolesMethod != util.RolesNative) || cf.DumpTablespaces {
+		err = snap.checkGlobals(cf.DbURI)
+		if err != nil {
+			return err
+		}
+	}
 	dump := exec.Command(dumpPath)
 	dump.Args = append(dump.Args, cf.PGDumpFlags...)
+	dump.Args = append(dump.Args, chunkFlags...)
 	dump.Args = append(dump.Args,
 		fmt.Sprintf("--dbname=%s", cf.DbURI),
+		fmt.Sprintf("--snapshot=%s", snap.info.ID),
 		"--format=directory",
 		fmt.Sprintf("--file=%s", cf.PgDumpDir))
 	if cf.Verbose {
@@ -100,6 +212,36 @@ func DoDump(cf *util.Config) error {
 	if err != nil {
 		return fmt.Errorf("pg_dump run failed with: %w", err)
 	}
+
+	if tsInfo.Selective {
+		err = dumpHypertableData(cf, snap.info.ID, tsInfo.Hypertables)
+		if err != nil {
+			return err
+		}
+	}
+
+	if cf.Repository != "" {
+		err = storeDumpFiles(cf, &tsInfo)
+		if err != nil {
+			return fmt.Errorf("Error storing dump in repository: %w", err)
+		}
+	}
+	// The info is written last, as it also records what happened during the dump
+	encoder := json.NewEncoder(file)
+	err = encoder.Encode(&tsInfo)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		return fmt.Errorf("Error writing Timescale info %w", err)
+	}
+	//Stored data files are only removed once the info records where they went
+	if len(tsInfo.StoredFiles) > 0 {
+		err = store.RemoveStoredFiles(cf.PgDumpDir, tsInfo.StoredFiles)
+		if err != nil {
+			return fmt.Errorf("Error removing data files stored in repository: %w", err)
+		}
+	}
 	return err
 }
 
@@ -141,23 +283,17 @@ func runDumpAll(cf *util.Config, dumpType string) error {
 		fmt.Sprintf("--dbname=%s", cf.DbURI),
 		fmt.Sprintf("--database=%s", config.Config.Database), // tells pg_dumpall to actually connect to that database to do things
 		fmt.Sprintf("--file=%s", dumpPath),
-		"--no-role-passwords", //dump roles without passwords, will have to have folks reset passwords for now, potentially add flag in future, but doesn't work on cloud etc as it needs access to pg_authid
+		"--no-role-passwords", //passwords are dumped separately with --dump-role-passwords, see passwords.go, as they need access to pg_authid, which doesn't work on cloud etc
 		dumpType)
 	dumpAll.Stdout = os.Stdout
 	dumpAll.Stderr = os.Stderr
 	return dumpAll.Run()
 }
 
-func getTimescaleInfo(dbURI string) (util.TsInfo, error) {
+func getTimescaleInfo(conn *pgx.Conn) (util.TsInfo, error) {
 	info := util.TsInfo{}
 
-	conn, err := util.GetDBConn(context.Background(), dbURI)
-	if err != nil {
-		return info, err
-	}
-	defer conn.Close(context.Background())
-
-	err = conn.QueryRow(context.Background(), "SELECT e.extversion,  n.nspname FROM pg_extension e INNER JOIN pg_namespace n ON e.extnamespace = n.oid WHERE e.extname='timescaledb'").Scan(&info.TsVersion, &info.TsSchema)
+	err := conn.QueryRow(context.Background(), "SELECT e.extversion,  n.nspname FROM pg_extension e INNER JOIN pg_namespace n ON e.extnamespace = n.oid WHERE e.extname='timescaledb'").Scan(&info.TsVersion, &info.TsSchema)
 	if err != nil {
 		if err == pgx.ErrNoRows {
 			return info, errors.New("TimescaleDB extension not found, make sure it is installed in the database being dumped")
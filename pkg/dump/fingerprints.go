@@ -0,0 +1,65 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package dump
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+	"github.com/timescale/timescaledb-backup/pkg/verify"
+)
+
+// With --dump-fingerprints, the dump records the fingerprint of every regular
+// table and chunk, the same ts-verify compares databases by, so that a restore
+// can be checked against the data that was dumped when the database it was
+// dumped from is gone. They are taken in the dump's snapshot, up to cf.Jobs at
+// a time, which reads all of the data once more. The fingerprints of chunks
+// are also what incremental dumps find unchanged chunks by, see incremental.go.
+
+//dumpFingerprints takes the fingerprints of the tables and chunks in the
+//snapshot, or only of the chunks, see above
+func dumpFingerprints(cf *util.Config, snap *snapshot, chunksOnly bool) ([]util.DataFingerprint, error) {
+	listed, err := verify.ListTables(snap.conn)
+	if err != nil {
+		return nil, err
+	}
+	var tables []verify.Table
+	for _, t := range listed {
+		if !chunksOnly || t.Hypertable != "" {
+			tables = append(tables, t)
+		}
+	}
+	names := make([]string, 0, len(tables))
+	for _, t := range tables {
+		names = append(names, t.Name)
+	}
+	if cf.Verbose {
+		fmt.Printf("%sTaking fingerprints of %d tables and chunks\n", time.Now().Format("2006/01/02 15:04:05 "), len(names))
+	}
+	fingerprints, err := verify.Fingerprints(names, cf.Jobs, cf.Verbose, func() (*pgx.Conn, error) {
+		conn, err := verify.Connect(context.Background(), cf.DbURI)
+		if err != nil {
+			return nil, err
+		}
+		// the transaction lasts as long as the connection
+		_, err = importSnapshot(conn, snap.info.ID)
+		if err != nil {
+			conn.Close(context.Background())
+			return nil, err
+		}
+		return conn, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	recorded := make([]util.DataFingerprint, 0, len(tables))
+	for _, t := range tables {
+		f := fingerprints[t.Name]
+		recorded = append(recorded, util.DataFingerprint{Table: t.Name, Hypertable: t.Hypertable, Slices: t.Slices, Rows: f.Rows, Hash: f.Hash})
+	}
+	return recorded, nil
+}
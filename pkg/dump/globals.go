@@ -0,0 +1,173 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package dump
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// pg_dumpall --roles-only dumps every role of the cluster and needs to read
+// pg_authid, which hosted PostgreSQL rarely allows. The native method dumps
+// only the roles the dumped database refers to, from catalogs anyone can read:
+// pg_shdepend records the roles owning objects in the database, named in their
+// ACLs and policies, and in default privileges, to which are added the owner
+// of the database, the roles with settings in it, the owners of TimescaleDB's
+// jobs and all the roles those are members of. It runs in the dump's snapshot.
+// Like pg_dumpall, it leaves out predefined roles and passwords.
+
+// the roles the current database refers to, see above
+const referencedRolesSQL = `WITH RECURSIVE referenced(oid) AS (
+	SELECT d.refobjid FROM pg_shdepend d
+		WHERE d.refclassid = 'pg_authid'::regclass AND d.dbid = (SELECT oid FROM pg_database WHERE datname = current_database())
+	UNION SELECT datdba FROM pg_database WHERE datname = current_database()
+	UNION SELECT s.setrole FROM pg_db_role_setting s
+		WHERE s.setrole <> 0 AND s.setdatabase = (SELECT oid FROM pg_database WHERE datname = current_database())
+	UNION SELECT r.oid FROM pg_roles r WHERE r.rolname = ANY($1::text[])
+), roles(oid) AS (
+	SELECT oid FROM referenced
+	UNION SELECT m.roleid FROM pg_auth_members m INNER JOIN roles ON roles.oid = m.member
+)
+SELECT r.rolname, r.rolsuper, r.rolinherit, r.rolcreaterole, r.rolcreatedb, r.rolcanlogin, r.rolreplication, r.rolbypassrls,
+	r.rolconnlimit, r.rolvaliduntil::text, shobj_description(r.oid, 'pg_authid'),
+	coalesce((SELECT s.setconfig FROM pg_db_role_setting s WHERE s.setrole = r.oid AND s.setdatabase = 0), '{}')
+	FROM pg_roles r WHERE r.oid IN (SELECT oid FROM roles) AND r.rolname !~ '^pg_'
+	ORDER BY r.rolname`
+
+// memberships of the roles dumped, in roles that are dumped or predefined
+const roleMembershipsSQL = `SELECT g.rolname, m.rolname, a.admin_option
+	FROM pg_auth_members a
+	INNER JOIN pg_roles g ON g.oid = a.roleid
+	INNER JOIN pg_roles m ON m.oid = a.member
+	WHERE m.rolname = ANY($1::text[]) AND (g.rolname = ANY($1::text[]) OR g.rolname ~ '^pg_')
+	ORDER BY 1, 2`
+
+// job owners are names or regroles in TimescaleDB's catalog, which are not
+// recorded in pg_shdepend
+const jobOwnersSQL = `SELECT CASE WHEN EXISTS (SELECT 1 FROM pg_attribute
+	WHERE attrelid = to_regclass('_timescaledb_config.bgw_job') AND attname = 'owner' AND NOT attisdropped)
+	THEN 'SELECT DISTINCT owner::text FROM _timescaledb_config.bgw_job' END`
+
+type dumpedRole struct {
+	name                                                                string
+	super, inherit, createRole, createDB, login, replication, bypassRLS bool
+	connLimit                                                           int32
+	validUntil                                                          *string
+	comment                                                             *string
+	settings                                                            []string
+}
+
+//dumpRolesNative writes the roles the database refers to into roles.sql in
+//the dump directory, in the format pg_dumpall writes it in, see above, and
+//returns their names
+func dumpRolesNative(cf *util.Config, conn *pgx.Conn) ([]string, error) {
+	ctx := context.Background()
+	var jobOwners []string
+	var ownersSQL *string
+	err := conn.QueryRow(ctx, jobOwnersSQL).Scan(&ownersSQL)
+	if err != nil {
+		return nil, err
+	}
+	if ownersSQL != nil {
+		err = conn.QueryRow(ctx, fmt.Sprintf("SELECT coalesce(array_agg(o), '{}') FROM (%s) j(o)", *ownersSQL)).Scan(&jobOwners)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rows, err := conn.Query(ctx, referencedRolesSQL, jobOwners)
+	if err != nil {
+		return nil, err
+	}
+	var roles []dumpedRole
+	var names []string
+	for rows.Next() {
+		r := dumpedRole{}
+		err = rows.Scan(&r.name, &r.super, &r.inherit, &r.createRole, &r.createDB, &r.login, &r.replication, &r.bypassRLS,
+			&r.connLimit, &r.validUntil, &r.comment, &r.settings)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		roles = append(roles, r)
+		names = append(names, r.name)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var script strings.Builder
+	fmt.Fprintf(&script, "--\n-- Roles referenced by the dumped database, dumped by ts-dump at %s\n--\n\n", time.Now().Format(time.RFC3339))
+	script.WriteString("SET default_transaction_read_only = off;\n\nSET client_encoding = 'UTF8';\nSET standard_conforming_strings = on;\n\n")
+	script.WriteString("--\n-- Roles\n--\n\n")
+	for _, r := range roles {
+		name := pgx.Identifier{r.name}.Sanitize()
+		fmt.Fprintf(&script, "CREATE ROLE %s;\n", name)
+		fmt.Fprintf(&script, "ALTER ROLE %s WITH %s %s %s %s %s %s %s", name,
+			attribute(r.super, "SUPERUSER"), attribute(r.inherit, "INHERIT"), attribute(r.createRole, "CREATEROLE"), attribute(r.createDB, "CREATEDB"),
+			attribute(r.login, "LOGIN"), attribute(r.replication, "REPLICATION"), attribute(r.bypassRLS, "BYPASSRLS"))
+		if r.connLimit != -1 {
+			fmt.Fprintf(&script, " CONNECTION LIMIT %d", r.connLimit)
+		}
+		if r.validUntil != nil {
+			fmt.Fprintf(&script, " VALID UNTIL %s", util.QuoteLiteral(*r.validUntil))
+		}
+		script.WriteString(";\n")
+		if r.comment != nil {
+			fmt.Fprintf(&script, "COMMENT ON ROLE %s IS %s;\n", name, util.QuoteLiteral(*r.comment))
+		}
+		for _, setting := range r.settings {
+			clause, err := util.SetClause(setting)
+			if err != nil {
+				return nil, fmt.Errorf("role %s: %w", r.name, err)
+			}
+			fmt.Fprintf(&script, "ALTER ROLE %s SET %s;\n", name, clause)
+		}
+	}
+
+	// GRANTED BY is left out, a user that is not a superuser can only grant
+	// memberships as themselves
+	script.WriteString("\n--\n-- Role memberships\n--\n\n")
+	rows, err = conn.Query(ctx, roleMembershipsSQL, names)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var group, member string
+		var admin bool
+		if err = rows.Scan(&group, &member, &admin); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&script, "GRANT %s TO %s", pgx.Identifier{group}.Sanitize(), pgx.Identifier{member}.Sanitize())
+		if admin {
+			script.WriteString(" WITH ADMIN OPTION")
+		}
+		script.WriteString(";\n")
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	script.WriteString("\n--\n-- Roles dump complete\n--\n\n")
+
+	if cf.Verbose {
+		fmt.Printf("%sDumped %d roles\n", time.Now().Format("2006/01/02 15:04:05 "), len(roles))
+	}
+	return names, ioutil.WriteFile(filepath.Join(cf.DumpDir, "roles.sql"), []byte(script.String()), 0644)
+}
+
+func attribute(set bool, name string) string {
+	if set {
+		return name
+	}
+	return "NO" + name
+}
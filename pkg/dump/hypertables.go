@@ -0,0 +1,375 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package dump
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// Every dump records enough about each hypertable to recreate it without the
+// TimescaleDB catalog: its dimensions, tablespaces, compression settings, which
+// chunks were compressed and its continuous aggregates. This is what makes
+// selective dumps possible. pg_dump with --table on a hypertable only gets the
+// parent table, the chunks and the catalog rows describing them can't be loaded
+// into a database that has hypertables of its own, as their ids would clash.
+// So a selective dump instead dumps the parent tables' definitions with pg_dump
+// and the hypertables' data through the parent with COPY, and the restore
+// creates the hypertables anew and lets TimescaleDB create the chunks.
+
+// user hypertables, leaving out the internal ones used for compression and
+// continuous aggregates. Columns were added and replaced across versions, so the
+// optional ones are read through to_jsonb.
+const hypertablesSQL = `SELECT h.id, h.schema_name, h.table_name, (to_jsonb(h)->>'compressed_hypertable_id') IS NOT NULL
+	FROM _timescaledb_catalog.hypertable h
+	WHERE NOT coalesce((to_jsonb(h)->>'compressed')::bool, false)
+	AND coalesce((to_jsonb(h)->>'compression_state')::int, 0) <> 2
+	AND h.id NOT IN (SELECT mat_hypertable_id FROM _timescaledb_catalog.continuous_agg)
+	ORDER BY h.id`
+
+const dimensionsSQL = `SELECT d.column_name, d.interval_length IS NOT NULL, coalesce(d.interval_length, 0), coalesce(d.num_slices, 0)::int,
+	CASE WHEN d.partitioning_func IS NULL THEN '' ELSE format('%I.%I', d.partitioning_func_schema, d.partitioning_func) END
+	FROM _timescaledb_catalog.dimension d
+	WHERE d.hypertable_id = $1
+	ORDER BY d.id`
+
+const hypertableTablespacesSQL = `SELECT tablespace_name FROM _timescaledb_catalog.tablespace WHERE hypertable_id = $1 ORDER BY id`
+
+const compressionSettingsSQL = `SELECT
+	coalesce(string_agg(format('%I', attname), ', ' ORDER BY segmentby_column_index) FILTER (WHERE segmentby_column_index IS NOT NULL), ''),
+	coalesce(string_agg(format('%I', attname) || CASE WHEN orderby_asc THEN '' ELSE ' DESC' END || CASE WHEN orderby_nullsfirst THEN ' NULLS FIRST' ELSE ' NULLS LAST' END, ', ' ORDER BY orderby_column_index) FILTER (WHERE orderby_column_index IS NOT NULL), '')
+	FROM _timescaledb_catalog.hypertable_compression WHERE hypertable_id = $1`
+
+const compressedRangesSQL = `SELECT DISTINCT ds.range_start, ds.range_end
+	FROM _timescaledb_catalog.chunk c
+	INNER JOIN _timescaledb_catalog.chunk_constraint cc ON cc.chunk_id = c.id
+	INNER JOIN _timescaledb_catalog.dimension_slice ds ON ds.id = cc.dimension_slice_id
+	WHERE c.hypertable_id = $1 AND c.compressed_chunk_id IS NOT NULL
+	AND ds.dimension_id = (SELECT id FROM _timescaledb_catalog.dimension WHERE hypertable_id = $1 AND interval_length IS NOT NULL ORDER BY id LIMIT 1)
+	ORDER BY ds.range_start`
+
+const foreignKeysSQL = `SELECT c.conname
+	FROM pg_constraint c
+	INNER JOIN _timescaledb_catalog.hypertable h ON c.conrelid = format('%I.%I', h.schema_name, h.table_name)::regclass
+	WHERE h.id = $1 AND c.contype = 'f'
+	ORDER BY c.conname`
+
+// the direct view holds the query the continuous aggregate was created with
+const continuousAggsSQL = `SELECT ca.user_view_schema, ca.user_view_name,
+	pg_get_viewdef(format('%I.%I', ca.direct_view_schema, ca.direct_view_name)::regclass),
+	coalesce((to_jsonb(ca)->>'materialized_only')::bool, false)
+	FROM _timescaledb_catalog.continuous_agg ca
+	WHERE ca.raw_hypertable_id = $1
+	ORDER BY ca.mat_hypertable_id`
+
+// the materialization hypertable of a continuous aggregate
+const materializationSQL = `SELECT format('%I.%I', h.schema_name, h.table_name)
+	FROM _timescaledb_catalog.continuous_agg ca
+	INNER JOIN _timescaledb_catalog.hypertable h ON h.id = ca.mat_hypertable_id
+	WHERE ca.user_view_schema = $1 AND ca.user_view_name = $2`
+
+func getHypertableInfo(conn *pgx.Conn) ([]util.HypertableInfo, error) {
+	rows, err := conn.Query(context.Background(), hypertablesSQL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get hypertables: %w", err)
+	}
+	var hypertables []util.HypertableInfo
+	for rows.Next() {
+		h := util.HypertableInfo{}
+		if err = rows.Scan(&h.ID, &h.Schema, &h.Table, &h.Compressed); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		hypertables = append(hypertables, h)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	v1, err := isTimescale1(conn)
+	if err != nil {
+		return nil, err
+	}
+	for i := range hypertables {
+		err = describeHypertable(conn, v1, &hypertables[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe hypertable %s: %w", hypertables[i].QualifiedName(), err)
+		}
+	}
+	return hypertables, nil
+}
+
+func describeHypertable(conn *pgx.Conn, v1 bool, h *util.HypertableInfo) error {
+	columns, err := getCopyColumns(conn, *h)
+	if err != nil {
+		return err
+	}
+	h.Columns = columns
+	policies, err := getPolicies(conn, v1, h.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get policies: %w", err)
+	}
+	h.Policies = policies
+
+	rows, err := conn.Query(context.Background(), dimensionsSQL, h.ID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		d := util.DimensionInfo{}
+		if err = rows.Scan(&d.ColumnName, &d.Open, &d.IntervalLength, &d.NumSlices, &d.PartitioningFunc); err != nil {
+			rows.Close()
+			return err
+		}
+		h.Dimensions = append(h.Dimensions, d)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = conn.Query(context.Background(), hypertableTablespacesSQL, h.ID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var tablespace string
+		if err = rows.Scan(&tablespace); err != nil {
+			rows.Close()
+			return err
+		}
+		h.Tablespaces = append(h.Tablespaces, tablespace)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	// recorded even when there are none, to tell them apart from older dumps
+	h.ForeignKeys = []string{}
+	rows, err = conn.Query(context.Background(), foreignKeysSQL, h.ID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		h.ForeignKeys = append(h.ForeignKeys, name)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	if h.Compressed {
+		err = conn.QueryRow(context.Background(), compressionSettingsSQL, h.ID).Scan(&h.CompressSegmentBy, &h.CompressOrderBy)
+		if err != nil {
+			return err
+		}
+		rows, err = conn.Query(context.Background(), compressedRangesSQL, h.ID)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			r := util.SliceRange{}
+			if err = rows.Scan(&r.Start, &r.End); err != nil {
+				rows.Close()
+				return err
+			}
+			h.CompressedRanges = append(h.CompressedRanges, r)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	rows, err = conn.Query(context.Background(), continuousAggsSQL, h.ID)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		ca := util.ContinuousAggInfo{}
+		if err = rows.Scan(&ca.Schema, &ca.Name, &ca.Definition, &ca.MaterializedOnly); err != nil {
+			rows.Close()
+			return err
+		}
+		h.ContinuousAggs = append(h.ContinuousAggs, ca)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for i := range h.ContinuousAggs {
+		h.ContinuousAggs[i].Policies, err = getRefreshPolicies(conn, v1, h.ContinuousAggs[i])
+		if err != nil {
+			return fmt.Errorf("failed to get the refresh policy of continuous aggregate %s: %w", h.ContinuousAggs[i].QualifiedName(), err)
+		}
+	}
+	return nil
+}
+
+//selectHypertables resolves the hypertable names given by the user, which may
+//be schema qualified or found on the search_path, to the hypertables they name
+func selectHypertables(conn *pgx.Conn, all []util.HypertableInfo, names []string) ([]util.HypertableInfo, error) {
+	var selected []util.HypertableInfo
+	seen := make(map[int64]bool)
+	for _, name := range names {
+		var schema, table string
+		err := conn.QueryRow(context.Background(), `SELECT n.nspname, c.relname FROM pg_class c
+			INNER JOIN pg_namespace n ON n.oid = c.relnamespace
+			WHERE c.oid = to_regclass($1)`, name).Scan(&schema, &table)
+		if err == pgx.ErrNoRows {
+			return nil, fmt.Errorf("table %s not found", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, h := range all {
+			if h.Schema == schema && h.Table == table {
+				found = true
+				if !seen[h.ID] {
+					selected = append(selected, h)
+					seen[h.ID] = true
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s is not a hypertable", name)
+		}
+	}
+	return selected, nil
+}
+
+//selectiveDumpFlags returns the pg_dump flags restricting the dump to the
+//parent tables of the selected hypertables
+func selectiveDumpFlags(hypertables []util.HypertableInfo) []string {
+	var flags []string
+	for _, h := range hypertables {
+		flags = append(flags, fmt.Sprintf("--table=%s", h.QualifiedName()))
+	}
+	return flags
+}
+
+//dumpHypertableData writes the data of each hypertable, read through its parent
+//table in the dump's snapshot, to a gzipped COPY file in the dump directory,
+//using up to cf.Jobs connections in parallel
+func dumpHypertableData(cf *util.Config, snapshotID string, hypertables []util.HypertableInfo) error {
+	dataDir := filepath.Join(cf.DumpDir, "hypertables")
+	err := os.Mkdir(dataDir, 0700)
+	if err != nil {
+		return err
+	}
+	jobs := cf.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	sem := make(chan bool, jobs)
+	errs := make(chan error, len(hypertables))
+	var wg sync.WaitGroup
+	for i := range hypertables {
+		hypertables[i].DataFile = filepath.Join("hypertables", fmt.Sprintf("%d.copy.gz", hypertables[i].ID))
+		wg.Add(1)
+		go func(h util.HypertableInfo) {
+			defer wg.Done()
+			sem <- true
+			defer func() { <-sem }()
+			if cf.Verbose {
+				fmt.Printf("%sDumping data of hypertable %s\n", time.Now().Format("2006/01/02 15:04:05 "), h.QualifiedName())
+			}
+			err := copyHypertableOut(cf.DbURI, snapshotID, h, filepath.Join(cf.DumpDir, h.DataFile))
+			if err != nil {
+				errs <- fmt.Errorf("failed to dump data of hypertable %s: %w", h.QualifiedName(), err)
+			}
+		}(hypertables[i])
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		return err
+	}
+	return nil
+}
+
+func copyHypertableOut(dbURI string, snapshotID string, h util.HypertableInfo, fileName string) error {
+	conn, err := util.GetDBConn(context.Background(), dbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	tx, err := importSnapshot(conn, snapshotID)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	_, err = conn.PgConn().CopyTo(context.Background(), gz, fmt.Sprintf("COPY (SELECT %s FROM %s) TO STDOUT", h.SelectList(), h.QualifiedName()))
+	if err != nil {
+		return err
+	}
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+//checkSelectiveConfig rejects combinations of options that don't make sense
+//for a selective dump
+func checkSelectiveConfig(cf *util.Config) error {
+	if len(cf.Hypertables) == 0 {
+		return nil
+	}
+	if cf.DumpIncrementalFrom != "" || cf.DumpSince != "" || cf.DumpUntil != "" {
+		return errors.New("selective hypertable dumps can't be incremental or restricted to a time range")
+	}
+	return nil
+}
+
+//countContinuousAggRows records how many rows the materializations of the
+//continuous aggregates of the hypertables hold, for ts-restore to show next
+//to the counts once it has refreshed the aggregates
+func countContinuousAggRows(cf *util.Config, conn *pgx.Conn, hypertables []util.HypertableInfo) error {
+	ctx := context.Background()
+	for i := range hypertables {
+		for j := range hypertables[i].ContinuousAggs {
+			ca := &hypertables[i].ContinuousAggs[j]
+			var materialization string
+			err := conn.QueryRow(ctx, materializationSQL, ca.Schema, ca.Name).Scan(&materialization)
+			if err != nil {
+				return fmt.Errorf("failed to find the materialization of continuous aggregate %s: %w", ca.QualifiedName(), err)
+			}
+			if cf.Verbose {
+				fmt.Printf("%sCounting rows of continuous aggregate %s\n", time.Now().Format("2006/01/02 15:04:05 "), ca.QualifiedName())
+			}
+			var rows int64
+			err = conn.QueryRow(ctx, fmt.Sprintf("SELECT count(*) FROM %s", materialization)).Scan(&rows)
+			if err != nil {
+				return fmt.Errorf("failed to count rows of continuous aggregate %s: %w", ca.QualifiedName(), err)
+			}
+			ca.MaterializedRows = &rows
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package dump
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// Most time-series data is append only, so chunks older than a few days (and
+// especially compressed ones) rarely change, but a full dump re-dumps them every
+// time. An incremental dump records a fingerprint for every chunk in the
+// TsInfo and, given a parent dump, only dumps the data of chunks whose
+// fingerprint differs from the one recorded in the parent. The schema and
+// the whole TimescaleDB catalog are always dumped, so the newest dump in a chain
+// describes the complete database, and the restore takes the data of
+// unchanged chunks from the dump in the chain that last contained it.
+
+// The fingerprint is that of pkg/verify, the number of rows and a hash of them,
+// taken in the dump's snapshot, so it describes exactly the data that is dumped.
+// Sizes and the statistics collector's counters are cheaper to get, but they are
+// not transactional, lag behind commits, can be reset and are not maintained on
+// standbys, so they can make a changed chunk look unchanged, and its changes
+// would be lost. Taking fingerprints reads all of the data once more, but only
+// the data of changed chunks is written. Compressed chunks are read
+// decompressed, so a compressed chunk (the table holding the compressed data)
+// gets the fingerprint of its chunk: it is unchanged if the chunk's data is and
+// the chunk still has the same compressed chunk. Dumps without fingerprints,
+// taken before they were recorded or without --dump-fingerprints, make every
+// chunk look changed, so the first incremental dump from them is a full one.
+const chunkInfoSQL = `SELECT c.id, c.hypertable_id, c.schema_name, c.table_name, coalesce(c.compressed_chunk_id, 0)
+	FROM _timescaledb_catalog.chunk c
+	WHERE to_regclass(format('%I.%I', c.schema_name, c.table_name)) IS NOT NULL
+	ORDER BY c.id`
+
+func getChunkInfo(conn *pgx.Conn) ([]util.ChunkInfo, error) {
+	rows, err := conn.Query(context.Background(), chunkInfoSQL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chunk information: %w", err)
+	}
+	defer rows.Close()
+	var chunks []util.ChunkInfo
+	for rows.Next() {
+		c := util.ChunkInfo{Dumped: true}
+		err = rows.Scan(&c.ID, &c.HypertableID, &c.Schema, &c.Table, &c.CompressedChunkID)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, c)
+	}
+	return chunks, rows.Err()
+}
+
+//setChunkFingerprints records the fingerprints taken by dumpFingerprints in the
+//chunks they belong to, and those of chunks in their compressed chunks
+func setChunkFingerprints(chunks []util.ChunkInfo, fingerprints []util.DataFingerprint) error {
+	byName := make(map[string]util.DataFingerprint, len(fingerprints))
+	for _, f := range fingerprints {
+		if f.Hypertable == "" {
+			continue
+		}
+		schema, table, err := util.ParseQualifiedName(f.Table)
+		if err != nil {
+			return err
+		}
+		byName[pgx.Identifier{schema, table}.Sanitize()] = f
+	}
+	byID := make(map[int64]int, len(chunks))
+	for i, c := range chunks {
+		byID[c.ID] = i
+	}
+	for i, c := range chunks {
+		f, ok := byName[c.QualifiedName()]
+		if !ok {
+			continue
+		}
+		chunks[i].Rows, chunks[i].Hash = f.Rows, f.Hash
+		if j, ok := byID[c.CompressedChunkID]; ok && c.CompressedChunkID != 0 {
+			chunks[j].Rows, chunks[j].Hash = f.Rows, f.Hash
+		}
+	}
+	return nil
+}
+
+//planIncremental compares the chunks of the current dump with those of the
+//parent dump, marks unchanged chunks as not dumped in tsInfo and returns the
+//pg_dump flags needed to leave their data out of the dump.
+func planIncremental(cf *util.Config, tsInfo *util.TsInfo) ([]string, error) {
+	parentInfo, err := util.ReadTsInfo(filepath.Join(cf.DumpIncrementalFrom, util.TsInfoFileName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read parent dump: %w", err)
+	}
+	if parentInfo.TsVersion != tsInfo.TsVersion || parentInfo.TsSchema != tsInfo.TsSchema {
+		// chunk data from the parent would be restored into a catalog of a different version
+		fmt.Printf("%sWARNING: parent dump was taken at TimescaleDB %s, now at %s, performing a full dump\n", time.Now().Format("2006/01/02 15:04:05 "), parentInfo.TsVersion, tsInfo.TsVersion)
+		return nil, nil
+	}
+	tsInfo.ParentDumpDir, err = filepath.Rel(cf.DumpDir, cf.DumpIncrementalFrom)
+	if err != nil {
+		return nil, err
+	}
+
+	parentChunks := make(map[string]util.ChunkInfo, len(parentInfo.Chunks))
+	for _, c := range parentInfo.Chunks {
+		parentChunks[c.QualifiedName()] = c
+	}
+	unchanged := make(map[int64]bool)
+	for i, c := range tsInfo.Chunks {
+		parent, ok := parentChunks[c.QualifiedName()]
+		if !ok || !parent.SameData(c) {
+			continue
+		}
+		tsInfo.Chunks[i].Dumped = false
+		unchanged[c.ID] = true
+	}
+	var flags []string
+	for _, pattern := range util.ChunkTablePatterns(tsInfo.Chunks, unchanged) {
+		flags = append(flags, fmt.Sprintf("--exclude-table-data=%s", pattern))
+	}
+	fmt.Printf("%sIncremental dump: %d of %d chunks unchanged since parent dump %s\n", time.Now().Format("2006/01/02 15:04:05 "), len(unchanged), len(tsInfo.Chunks), cf.DumpIncrementalFrom)
+	return flags, nil
+}
@@ -0,0 +1,64 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package dump
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// Role passwords are kept out of roles.sql, which pg_dumpall writes readable
+// by anyone who can read the dump. They are written, as the hashes PostgreSQL
+// stores (SCRAM verifiers or MD5 hashes), which ALTER ROLE ... PASSWORD takes
+// as they are, into a file of their own that only the user running ts-dump can
+// read, and which is encrypted if a key file is given.
+
+const rolePasswordsSQL = `SELECT rolname, rolpassword FROM pg_authid
+	WHERE rolpassword IS NOT NULL AND rolname !~ '^pg_' AND ($1::text[] IS NULL OR rolname = ANY($1::text[]))
+	ORDER BY rolname`
+
+//dumpRolePasswords writes the password hashes of the roles named, or all
+//roles if names is nil, into the dump directory and returns the file's name
+func dumpRolePasswords(cf *util.Config, conn *pgx.Conn, names []string) (string, error) {
+	rows, err := conn.Query(context.Background(), rolePasswordsSQL, names)
+	if err != nil {
+		return "", fmt.Errorf("failed to read role passwords, dumping them needs superuser privileges: %w", err)
+	}
+	defer rows.Close()
+	var script strings.Builder
+	fmt.Fprintf(&script, "--\n-- Role passwords, dumped by ts-dump at %s\n--\n\n", time.Now().Format(time.RFC3339))
+	count := 0
+	for rows.Next() {
+		var name, password string
+		if err = rows.Scan(&name, &password); err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&script, "ALTER ROLE %s WITH PASSWORD %s;\n", pgx.Identifier{name}.Sanitize(), util.QuoteLiteral(password))
+		count++
+	}
+	if err = rows.Err(); err != nil {
+		return "", err
+	}
+
+	fileName := util.RolePasswordsFileName
+	data := []byte(script.String())
+	if cf.RolePasswordsKeyFile != "" {
+		fileName += util.EncryptedSuffix
+		data, err = util.Encrypt(data, cf.RolePasswordsKeyFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to encrypt role passwords: %w", err)
+		}
+	}
+	if cf.Verbose {
+		fmt.Printf("%sDumped passwords of %d roles into %s\n", time.Now().Format("2006/01/02 15:04:05 "), count, fileName)
+	}
+	return fileName, ioutil.WriteFile(filepath.Join(cf.DumpDir, fileName), data, 0600)
+}
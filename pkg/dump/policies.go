@@ -0,0 +1,190 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package dump
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// Hypertables restored on their own (from selective dumps, or picked out of a
+// full dump) are created anew, so their policies are recorded in the dump to be
+// added again. TimescaleDB 2.x keeps every policy as a job with a JSON config,
+// 1.x has a table per kind of policy and a refresh job for every continuous
+// aggregate, configured through the options of its view. Policies are recorded
+// in the same form for both, see util.PolicyInfo, so a dump taken with one
+// version can be restored into the other.
+
+// the columns holding data, generated columns are computed by the database
+// restored to and can't be copied into. attgenerated is new in PostgreSQL 12.
+const copyColumnsSQL = `SELECT format('%I', a.attname)
+	FROM pg_attribute a
+	WHERE a.attrelid = format('%I.%I', $1::text, $2::text)::regclass
+	AND a.attnum > 0 AND NOT a.attisdropped AND coalesce(to_jsonb(a)->>'attgenerated', '') = ''
+	ORDER BY a.attnum`
+
+const timescale1SQL = `SELECT to_regclass('_timescaledb_config.bgw_policy_drop_chunks') IS NOT NULL`
+
+// policies of a hypertable or materialization hypertable in TimescaleDB 2.x
+const policiesSQL = `SELECT j.proc_name, coalesce(j.config, '{}')::text, j.schedule_interval::text
+	FROM _timescaledb_config.bgw_job j
+	WHERE j.hypertable_id = $1 AND j.proc_schema = '_timescaledb_internal'
+	AND j.proc_name IN ('policy_retention', 'policy_compression', 'policy_reorder', 'policy_refresh_continuous_aggregate')
+	ORDER BY j.id`
+
+// the materialization hypertable of a continuous aggregate, by the names of its view
+const materializationIDSQL = `SELECT mat_hypertable_id FROM _timescaledb_catalog.continuous_agg
+	WHERE user_view_schema = $1 AND user_view_name = $2`
+
+// older_than is a ts_interval in 1.x, either an interval or an integer
+const olderThan1 = `CASE WHEN (p.older_than).is_time_interval THEN to_jsonb((p.older_than).time_interval::text)
+	ELSE to_jsonb((p.older_than).integer_interval) END::text`
+
+// policies of a hypertable in TimescaleDB 1.x
+const policies1SQL = `SELECT 'retention', ` + olderThan1 + `, '', j.schedule_interval::text
+	FROM _timescaledb_config.bgw_policy_drop_chunks p
+	INNER JOIN _timescaledb_config.bgw_job j ON j.id = p.job_id
+	WHERE p.hypertable_id = $1
+	UNION ALL
+	SELECT 'compression', ` + olderThan1 + `, '', j.schedule_interval::text
+	FROM _timescaledb_config.bgw_policy_compress_chunks p
+	INNER JOIN _timescaledb_config.bgw_job j ON j.id = p.job_id
+	WHERE p.hypertable_id = $1
+	UNION ALL
+	SELECT 'reorder', '', p.hypertable_index_name::text, j.schedule_interval::text
+	FROM _timescaledb_config.bgw_policy_reorder p
+	INNER JOIN _timescaledb_config.bgw_job j ON j.id = p.job_id
+	WHERE p.hypertable_id = $1`
+
+// the refresh job of a continuous aggregate in TimescaleDB 1.x. refresh_lag is
+// in the internal time unit, microseconds for time types.
+const refreshPolicy1SQL = `SELECT j.schedule_interval::text,
+	CASE WHEN d.column_type IN ('timestamptz'::regtype, 'timestamp'::regtype, 'date'::regtype)
+	THEN to_jsonb(make_interval(secs => ca.refresh_lag / 1000000.0)::text) ELSE to_jsonb(ca.refresh_lag) END::text
+	FROM _timescaledb_catalog.continuous_agg ca
+	INNER JOIN _timescaledb_config.bgw_job j ON j.id = ca.job_id
+	INNER JOIN _timescaledb_catalog.dimension d ON d.hypertable_id = ca.raw_hypertable_id AND d.interval_length IS NOT NULL
+	WHERE ca.user_view_schema = $1 AND ca.user_view_name = $2
+	ORDER BY d.id LIMIT 1`
+
+//getCopyColumns returns the sanitized names of the columns of a hypertable its
+//data is copied through
+func getCopyColumns(conn *pgx.Conn, h util.HypertableInfo) ([]string, error) {
+	rows, err := conn.Query(context.Background(), copyColumnsSQL, h.Schema, h.Table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err = rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+//isTimescale1 returns whether the database runs TimescaleDB 1.x
+func isTimescale1(conn *pgx.Conn) (bool, error) {
+	var v1 bool
+	err := conn.QueryRow(context.Background(), timescale1SQL).Scan(&v1)
+	return v1, err
+}
+
+//getPolicies returns the retention, compression and reorder policies of a
+//hypertable, or the refresh policy of a materialization hypertable
+func getPolicies(conn *pgx.Conn, v1 bool, hypertableID int64) ([]util.PolicyInfo, error) {
+	var policies []util.PolicyInfo
+	if v1 {
+		rows, err := conn.Query(context.Background(), policies1SQL, hypertableID)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var p util.PolicyInfo
+			var after string
+			if err = rows.Scan(&p.Type, &after, &p.IndexName, &p.ScheduleInterval); err != nil {
+				return nil, err
+			}
+			if after != "" {
+				p.After = json.RawMessage(after)
+			}
+			policies = append(policies, p)
+		}
+		return policies, rows.Err()
+	}
+
+	rows, err := conn.Query(context.Background(), policiesSQL, hypertableID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var procName, config string
+		var p util.PolicyInfo
+		if err = rows.Scan(&procName, &config, &p.ScheduleInterval); err != nil {
+			return nil, err
+		}
+		var settings struct {
+			DropAfter     json.RawMessage `json:"drop_after"`
+			CompressAfter json.RawMessage `json:"compress_after"`
+			IndexName     string          `json:"index_name"`
+			StartOffset   json.RawMessage `json:"start_offset"`
+			EndOffset     json.RawMessage `json:"end_offset"`
+		}
+		if err = json.Unmarshal([]byte(config), &settings); err != nil {
+			return nil, fmt.Errorf("failed to read the config of a %s job: %w", procName, err)
+		}
+		switch procName {
+		case "policy_retention":
+			p.Type, p.After = "retention", settings.DropAfter
+		case "policy_compression":
+			p.Type, p.After = "compression", settings.CompressAfter
+		case "policy_reorder":
+			p.Type, p.IndexName = "reorder", settings.IndexName
+		case "policy_refresh_continuous_aggregate":
+			p.Type, p.StartOffset, p.EndOffset = "refresh", nullIfMissing(settings.StartOffset), nullIfMissing(settings.EndOffset)
+		}
+		policies = append(policies, p)
+	}
+	return policies, rows.Err()
+}
+
+//getRefreshPolicies returns the refresh policy of a continuous aggregate
+func getRefreshPolicies(conn *pgx.Conn, v1 bool, ca util.ContinuousAggInfo) ([]util.PolicyInfo, error) {
+	ctx := context.Background()
+	if v1 {
+		p := util.PolicyInfo{Type: "refresh", StartOffset: json.RawMessage("null")}
+		var lag string
+		err := conn.QueryRow(ctx, refreshPolicy1SQL, ca.Schema, ca.Name).Scan(&p.ScheduleInterval, &lag)
+		if err == pgx.ErrNoRows {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.EndOffset = json.RawMessage(lag)
+		return []util.PolicyInfo{p}, nil
+	}
+	var matID int64
+	err := conn.QueryRow(ctx, materializationIDSQL, ca.Schema, ca.Name).Scan(&matID)
+	if err != nil {
+		return nil, err
+	}
+	return getPolicies(conn, v1, matID)
+}
+
+func nullIfMissing(value json.RawMessage) json.RawMessage {
+	if len(value) == 0 {
+		return json.RawMessage("null")
+	}
+	return value
+}
@@ -0,0 +1,82 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package dump
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/timescale/timescaledb-backup/pkg/store"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+//storeDumpFiles moves the data files of the finished pg_dump into the
+//repository and records them in tsInfo, see the store package for details
+func storeDumpFiles(cf *util.Config, tsInfo *util.TsInfo) error {
+	repo, err := store.Open(cf.Repository)
+	if err != nil {
+		return err
+	}
+	stored, newFiles, err := repo.StoreDumpFiles(cf.PgDumpDir, dataFileTables(cf.PgDumpDir))
+	if err != nil {
+		return err
+	}
+	tsInfo.Repository = repo.Dir
+	tsInfo.StoredFiles = stored
+	fmt.Printf("%sStored %d data files in repository %s, %d of them new\n", time.Now().Format("2006/01/02 15:04:05 "), len(stored), repo.Dir, newFiles)
+	return nil
+}
+
+//dataFileTables maps the names of the data files in a directory format dump to
+//the tables they hold the data of. The files are named after the dump id of
+//their TOC entry, with an extension depending on the compression used. This is
+//only informational, so if pg_restore isn't around to list the TOC we go
+//without.
+func dataFileTables(pgDumpDir string) map[string]string {
+	tables := make(map[string]string)
+	restorePath, err := exec.LookPath("pg_restore")
+	if err != nil {
+		return tables
+	}
+	entries, err := util.ReadTOC(restorePath, pgDumpDir)
+	if err != nil {
+		return tables
+	}
+	byID := make(map[string]string)
+	for _, entry := range entries {
+		if entry.Desc == "TABLE DATA" {
+			byID[strconv.Itoa(entry.DumpID)] = entry.QualifiedName()
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(pgDumpDir, "*.dat*"))
+	if err != nil {
+		return tables
+	}
+	for _, f := range files {
+		name := filepath.Base(f)
+		if table, ok := byID[strings.SplitN(name, ".", 2)[0]]; ok {
+			tables[name] = table
+		}
+	}
+	return tables
+}
+
+//PruneRepository removes the objects of cf.Repository that none of the dumps
+//stored in it use anymore, see the store package
+func PruneRepository(cf *util.Config) error {
+	repo, err := store.Open(cf.Repository)
+	if err != nil {
+		return err
+	}
+	removed, freed, err := repo.Prune(store.PruneGracePeriod)
+	if err != nil {
+		return fmt.Errorf("failed to prune repository %s: %w", repo.Dir, err)
+	}
+	fmt.Printf("%sRemoved %d objects (%d bytes) no dump uses anymore from repository %s\n", time.Now().Format("2006/01/02 15:04:05 "), removed, freed, repo.Dir)
+	return nil
+}
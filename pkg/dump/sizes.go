@@ -0,0 +1,120 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package dump
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// Parallel pg_dump and pg_restore runs go faster when the largest items start
+// first, otherwise one huge chunk or index started last keeps a single worker
+// busy long after the others are done. pg_dump schedules tables by relpages in
+// pg_class, which is only updated by VACUUM and ANALYZE, so chunks that were
+// filled since are scheduled as if they were empty; those can be analyzed
+// before dumping. pg_restore starts data items by the sizes pg_dump recorded
+// for them, but orders indexes by TOC position only before PostgreSQL 13, and
+// by their relpages since, which is outdated for chunks that were filled after
+// their indexes were built. So the sizes of the indexes built by the restore
+// are recorded in the dump, for ts-restore to order the post-data by.
+
+// tables whose relpages is well below their actual size, in pages
+const staleRelpagesSQL = `SELECT format('%I.%I', n.nspname, c.relname)
+	FROM pg_class c
+	INNER JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE c.relkind IN ('r', 'm') AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+	AND n.nspname !~ '^pg_toast' AND n.nspname !~ '^pg_temp'
+	AND pg_relation_size(c.oid) / current_setting('block_size')::int > 2 * greatest(c.relpages, 0) + 128
+	ORDER BY pg_relation_size(c.oid) DESC`
+
+// sizes of indexes, and of the indexes of constraints, named like their TOC
+// entries, where constraints are named by their table and name
+const indexSizesSQL = `SELECT n.nspname, c.relname, pg_relation_size(c.oid)
+	FROM pg_class c
+	INNER JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE c.relkind = 'i' AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+	AND n.nspname !~ '^pg_toast' AND n.nspname !~ '^pg_temp'
+	AND NOT EXISTS (SELECT 1 FROM pg_constraint con WHERE con.conindid = c.oid AND con.contype IN ('p', 'u', 'x'))
+	UNION ALL
+	SELECT n.nspname, t.relname || ' ' || con.conname, pg_relation_size(con.conindid)
+	FROM pg_constraint con
+	INNER JOIN pg_class t ON t.oid = con.conrelid
+	INNER JOIN pg_namespace n ON n.oid = t.relnamespace
+	WHERE con.contype IN ('p', 'u', 'x') AND con.conindid <> 0
+	AND n.nspname NOT IN ('pg_catalog', 'information_schema')`
+
+//analyzeStaleTables analyzes the tables pg_dump would schedule as much smaller
+//than they are, see above. Without cf.DumpAnalyzeStale they are only counted.
+func analyzeStaleTables(cf *util.Config) error {
+	ctx := context.Background()
+	conn, err := util.GetDBConn(ctx, cf.DbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	var tables []string
+	rows, err := conn.Query(ctx, staleRelpagesSQL)
+	if err != nil {
+		return fmt.Errorf("failed to find tables with outdated sizes: %w", err)
+	}
+	for rows.Next() {
+		var table string
+		err = rows.Scan(&table)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, table)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+	if !cf.DumpAnalyzeStale {
+		fmt.Printf("%s%d tables have outdated sizes in pg_class, so pg_dump may start them late, --analyze-stale analyzes them first\n", time.Now().Format("2006/01/02 15:04:05 "), len(tables))
+		return nil
+	}
+	if cf.Verbose {
+		fmt.Printf("%sAnalyzing %d tables with outdated sizes\n", time.Now().Format("2006/01/02 15:04:05 "), len(tables))
+	}
+	for _, table := range tables {
+		_, err = conn.Exec(ctx, fmt.Sprintf("ANALYZE %s", table))
+		if err != nil {
+			return fmt.Errorf("failed to analyze %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+//getIndexSizes returns the sizes of indexes and constraint indexes in bytes, by the sanitized and schema qualified names of their TOC entries.
+//The sizes are those of the files at the time of the query, whatever snapshot
+//conn is in.
+func getIndexSizes(conn *pgx.Conn) (map[string]int64, error) {
+	ctx := context.Background()
+	rows, err := conn.Query(ctx, indexSizesSQL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get index sizes: %w", err)
+	}
+	defer rows.Close()
+	sizes := make(map[string]int64)
+	for rows.Next() {
+		var schema, name string
+		var size int64
+		err = rows.Scan(&schema, &name, &size)
+		if err != nil {
+			return nil, err
+		}
+		if size > 0 {
+			sizes[pgx.Identifier{schema, name}.Sanitize()] = size
+		}
+	}
+	return sizes, rows.Err()
+}
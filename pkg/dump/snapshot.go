@@ -0,0 +1,116 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package dump
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// Everything a dump records has to describe the same point in time, or an
+// ALTER EXTENSION UPDATE or a new chunk between two queries leaves us with a
+// dump that can't be restored. So a dump holds a read only repeatable read
+// transaction open for its whole duration and exports its snapshot: all
+// metadata queries run in that transaction, pg_dump is passed the snapshot
+// with --snapshot and the connections dumping hypertable data import it.
+//
+// Sizes are the exception: pg_table_size and pg_relation_size read the files
+// of relations as they are, not as of a snapshot, so the index sizes a dump
+// records are taken around the time of the snapshot and only used to order
+// restore work. Nothing else in the dump comes from outside of the snapshot,
+// statistics views included.
+//
+// pg_dumpall can't be given a snapshot. Instead the roles and tablespaces are
+// fingerprinted in the snapshot and again once pg_dumpall is done, if they
+// changed in the meantime the dump fails rather than pretend to be consistent.
+
+const exportSnapshotSQL = `SELECT pg_export_snapshot(),
+	coalesce((CASE WHEN pg_is_in_recovery() THEN pg_last_wal_replay_lsn() ELSE pg_current_wal_lsn() END)::text, ''),
+	now()`
+
+// the parts of roles, role memberships and tablespaces pg_dumpall dumps
+const globalsFingerprintSQL = `SELECT md5(
+	coalesce((SELECT string_agg(r::text, ',' ORDER BY r.rolname) FROM (SELECT rolname, rolsuper, rolinherit, rolcreaterole, rolcreatedb,
+		rolcanlogin, rolreplication, rolconnlimit, rolvaliduntil, rolbypassrls, rolconfig FROM pg_roles) r), '') || '|' ||
+	coalesce((SELECT string_agg(m::text, ',' ORDER BY m::text) FROM (SELECT roleid::regrole::text, member::regrole::text,
+		grantor::regrole::text, admin_option FROM pg_auth_members) m), '') || '|' ||
+	coalesce((SELECT string_agg(t::text, ',' ORDER BY t.spcname) FROM (SELECT spcname, pg_get_userbyid(spcowner),
+		pg_tablespace_location(oid), spcoptions, spcacl FROM pg_tablespace) t), ''))`
+
+//snapshot is the transaction coordinating a dump, see above
+type snapshot struct {
+	conn    *pgx.Conn
+	tx      pgx.Tx
+	info    util.SnapshotInfo
+	globals string
+}
+
+//exportSnapshot starts the coordinating transaction of a dump and exports its
+//snapshot, the caller must close it once the dump is done
+func exportSnapshot(dbURI string) (*snapshot, error) {
+	ctx := context.Background()
+	conn, err := util.GetDBConn(ctx, dbURI)
+	if err != nil {
+		return nil, err
+	}
+	s := &snapshot{conn: conn}
+	s.tx, err = conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		conn.Close(ctx)
+		return nil, err
+	}
+	err = s.tx.QueryRow(ctx, exportSnapshotSQL).Scan(&s.info.ID, &s.info.LSN, &s.info.Time)
+	if err == nil {
+		err = s.tx.QueryRow(ctx, globalsFingerprintSQL).Scan(&s.globals)
+	}
+	if err != nil {
+		s.close()
+		return nil, fmt.Errorf("failed to export snapshot: %w", err)
+	}
+	return s, nil
+}
+
+func (s *snapshot) close() {
+	s.tx.Rollback(context.Background())
+	s.conn.Close(context.Background())
+}
+
+//checkGlobals makes sure the roles and tablespaces dumped by pg_dumpall, which
+//runs outside of the snapshot, are the same as those in the snapshot
+func (s *snapshot) checkGlobals(dbURI string) error {
+	conn, err := util.GetDBConn(context.Background(), dbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	var globals string
+	err = conn.QueryRow(context.Background(), globalsFingerprintSQL).Scan(&globals)
+	if err != nil {
+		return err
+	}
+	if globals != s.globals {
+		return errors.New("roles or tablespaces changed while they were being dumped, the dump would not be consistent, please retry")
+	}
+	return nil
+}
+
+//importSnapshot starts a transaction on conn that sees the same snapshot as
+//the coordinating transaction
+func importSnapshot(conn *pgx.Conn, snapshotID string) (pgx.Tx, error) {
+	tx, err := conn.BeginTx(context.Background(), pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(context.Background(), fmt.Sprintf("SET TRANSACTION SNAPSHOT '%s'", strings.ReplaceAll(snapshotID, "'", "''")))
+	if err != nil {
+		tx.Rollback(context.Background())
+		return nil, fmt.Errorf("failed to import snapshot %s: %w", snapshotID, err)
+	}
+	return tx, nil
+}
@@ -0,0 +1,117 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package dump
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// A dump restricted to a time range leaves the tables of chunks whose time
+// dimension slice lies entirely outside the range out of the pg_dump, along with
+// the compressed chunks belonging to them. The catalog is still dumped in full
+// (pg_dump can't filter rows), so the ids of the excluded chunks are recorded
+// and the restore removes their catalog rows before anything can trip over
+// the missing tables. Only hypertables partitioned by a timestamp, timestamptz or
+// date can be filtered this way, hypertables with integer time are dumped whole.
+
+// outOfRangeChunksSQL finds chunks (and their compressed chunks) whose time
+// dimension slice does not overlap [$1, $2) in TimescaleDB's internal time
+// representation
+const outOfRangeChunksSQL = `WITH out_of_range AS (
+		SELECT DISTINCT c.id, c.schema_name, c.table_name, c.compressed_chunk_id
+		FROM _timescaledb_catalog.chunk c
+		INNER JOIN _timescaledb_catalog.chunk_constraint cc ON cc.chunk_id = c.id
+		INNER JOIN _timescaledb_catalog.dimension_slice ds ON ds.id = cc.dimension_slice_id
+		INNER JOIN _timescaledb_catalog.dimension d ON d.id = ds.dimension_id
+		WHERE d.interval_length IS NOT NULL
+		AND d.column_type IN ('timestamptz'::regtype, 'timestamp'::regtype, 'date'::regtype)
+		AND (ds.range_end <= $1 OR ds.range_start >= $2))
+	SELECT id, schema_name, table_name FROM out_of_range
+	UNION
+	SELECT c.id, c.schema_name, c.table_name FROM _timescaledb_catalog.chunk c
+	INNER JOIN out_of_range o ON c.id = o.compressed_chunk_id
+	ORDER BY id`
+
+const integerTimeHypertablesSQL = `SELECT format('%I.%I', h.schema_name, h.table_name)
+	FROM _timescaledb_catalog.hypertable h
+	INNER JOIN _timescaledb_catalog.dimension d ON d.hypertable_id = h.id
+	WHERE d.interval_length IS NOT NULL
+	AND d.column_type NOT IN ('timestamptz'::regtype, 'timestamp'::regtype, 'date'::regtype)`
+
+//planTimeRange finds the chunks outside of the time range given in the config,
+//records them in tsInfo and returns the pg_dump flags to leave their tables out
+func planTimeRange(cf *util.Config, conn *pgx.Conn, tsInfo *util.TsInfo) ([]string, error) {
+	timeRange := &util.TimeRange{}
+	var since, until int64 = math.MinInt64, math.MaxInt64
+	var err error
+	if cf.DumpSince != "" {
+		timeRange.Since, err = util.ParseTime(cf.DumpSince)
+		if err != nil {
+			return nil, err
+		}
+		since = util.ToInternalTime(timeRange.Since)
+	}
+	if cf.DumpUntil != "" {
+		timeRange.Until, err = util.ParseTime(cf.DumpUntil)
+		if err != nil {
+			return nil, err
+		}
+		until = util.ToInternalTime(timeRange.Until)
+	}
+
+	rows, err := conn.Query(context.Background(), integerTimeHypertablesSQL)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		fmt.Printf("%sWARNING: hypertable %s does not use a timestamp for time, it will be dumped completely\n", time.Now().Format("2006/01/02 15:04:05 "), name)
+	}
+	rows.Close()
+
+	rows, err = conn.Query(context.Background(), outOfRangeChunksSQL, since, until)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find chunks outside of time range: %w", err)
+	}
+	defer rows.Close()
+	excluded := make(map[int64]bool)
+	for rows.Next() {
+		c := util.ChunkInfo{}
+		if err = rows.Scan(&c.ID, &c.Schema, &c.Table); err != nil {
+			return nil, err
+		}
+		timeRange.ExcludedChunkIDs = append(timeRange.ExcludedChunkIDs, c.ID)
+		excluded[c.ID] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	//one option per chunk could exceed the limits of the command line
+	var flags []string
+	for _, pattern := range util.ChunkTablePatterns(tsInfo.Chunks, excluded) {
+		flags = append(flags, fmt.Sprintf("--exclude-table=%s", pattern))
+	}
+
+	// the chunks left out are not part of this dump, so they have no place in its chunk list
+	var chunks []util.ChunkInfo
+	for _, c := range tsInfo.Chunks {
+		if !excluded[c.ID] {
+			chunks = append(chunks, c)
+		}
+	}
+	tsInfo.Chunks = chunks
+	tsInfo.TimeRange = timeRange
+	fmt.Printf("%sTime range dump: leaving out %d chunks\n", time.Now().Format("2006/01/02 15:04:05 "), len(timeRange.ExcludedChunkIDs))
+	return flags, nil
+}
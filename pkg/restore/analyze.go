@@ -0,0 +1,113 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// pg_restore doesn't restore planner statistics, so until autovacuum gets to
+// them the first queries on restored hypertables are planned blind. The
+// restored tables and chunks are analyzed right after the restore instead, up
+// to cf.Jobs at a time, largest first so that the last ones to finish are
+// small. Analyzing can be limited to the chunks with recent data, which are
+// usually the ones queried; regular tables are always analyzed and hypertables
+// themselves never are then, as that samples all of their chunks.
+
+// tables to analyze, largest first, leaving out chunks (and their compressed
+// chunks) whose time dimension slice ends before $1, and hypertables, if $1
+// isn't NULL
+const analyzeTablesSQL = `WITH old_chunks AS (
+		SELECT c.schema_name, c.table_name, c.compressed_chunk_id
+		FROM _timescaledb_catalog.chunk c
+		INNER JOIN _timescaledb_catalog.chunk_constraint cc ON cc.chunk_id = c.id
+		INNER JOIN _timescaledb_catalog.dimension_slice ds ON ds.id = cc.dimension_slice_id
+		INNER JOIN _timescaledb_catalog.dimension d ON d.id = ds.dimension_id
+		WHERE $1::bigint IS NOT NULL AND d.interval_length IS NOT NULL
+		AND d.column_type IN ('timestamptz'::regtype, 'timestamp'::regtype, 'date'::regtype)
+		AND ds.range_end <= $1
+	), skipped AS (
+		SELECT schema_name, table_name FROM old_chunks
+		UNION SELECT z.schema_name, z.table_name FROM _timescaledb_catalog.chunk z INNER JOIN old_chunks o ON z.id = o.compressed_chunk_id
+		UNION SELECT schema_name, table_name FROM _timescaledb_catalog.hypertable WHERE $1::bigint IS NOT NULL
+	)
+	SELECT coalesce(array_agg(format('%I.%I', n.nspname, c.relname) ORDER BY pg_relation_size(c.oid) DESC), '{}')
+	FROM pg_class c
+	INNER JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE c.relkind IN ('r', 'm') AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+	AND n.nspname !~ '^pg_toast' AND n.nspname !~ '^pg_temp'
+	AND NOT EXISTS (SELECT 1 FROM skipped s WHERE s.schema_name = n.nspname AND s.table_name = c.relname)`
+
+//analyzeTables analyzes the tables and chunks of the database, see above.
+//Tables that fail to be analyzed are reported in summary.
+func analyzeTables(cf *util.Config, summary *restoreSummary) error {
+	var since *int64
+	if cf.RestoreAnalyzeSince != "" {
+		t, err := util.ParseTime(cf.RestoreAnalyzeSince)
+		if err != nil {
+			return err
+		}
+		internal := util.ToInternalTime(t)
+		since = &internal
+	}
+	ctx := context.Background()
+	conn, err := util.GetDBConn(ctx, cf.DbURI)
+	if err != nil {
+		return err
+	}
+	var tables []string
+	err = conn.QueryRow(ctx, analyzeTablesSQL, since).Scan(&tables)
+	conn.Close(ctx)
+	if err != nil {
+		return err
+	}
+	if cf.Verbose {
+		fmt.Printf("%sAnalyzing %d tables and chunks\n", time.Now().Format("2006/01/02 15:04:05 "), len(tables))
+	}
+
+	jobs := cf.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	todo := make(chan string)
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for i := 0; i < jobs && i < len(tables); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := util.GetDBConn(ctx, cf.DbURI)
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				for range todo {
+				}
+				return
+			}
+			defer conn.Close(ctx)
+			for table := range todo {
+				_, err = conn.Exec(ctx, "ANALYZE "+table)
+				if err != nil {
+					summary.warn("failed to analyze %s: %s", table, err)
+				}
+			}
+		}()
+	}
+	for _, table := range tables {
+		todo <- table
+	}
+	close(todo)
+	wg.Wait()
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
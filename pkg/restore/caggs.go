@@ -0,0 +1,131 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// Continuous aggregates are restored with their materializations, but the
+// invalidation logs and watermarks they are refreshed by may not match them,
+// in particular when TimescaleDB is updated right after restoring. With
+// --refresh-caggs they are refreshed once the restore is done, either over all
+// of their data or over the window their refresh policy is configured with,
+// and the rows of their materializations are counted. The counts ts-dump
+// --dump-cagg-rows recorded are shown next to them, for information: the
+// materializations were as up to date as the refresh policies had left them
+// when dumped, and a refresh may cover a different window, so the counts
+// needn't match after a lossless restore.
+
+// the materialization hypertable of a continuous aggregate
+const materializationSQL = `SELECT format('%I.%I', h.schema_name, h.table_name)
+	FROM _timescaledb_catalog.continuous_agg ca
+	INNER JOIN _timescaledb_catalog.hypertable h ON h.id = ca.mat_hypertable_id
+	WHERE ca.user_view_schema = $1 AND ca.user_view_name = $2`
+
+// the refresh policy of a continuous aggregate, TimescaleDB 2 only
+const refreshPolicySQL = `SELECT j.id FROM _timescaledb_config.bgw_job j
+	INNER JOIN _timescaledb_catalog.continuous_agg ca ON ca.mat_hypertable_id = j.hypertable_id
+	WHERE j.proc_name = 'policy_refresh_continuous_aggregate' AND ca.user_view_schema = $1 AND ca.user_view_name = $2
+	ORDER BY j.id LIMIT 1`
+
+//refreshContinuousAggs refreshes the continuous aggregates of the dump, up to
+//cf.Jobs at a time, see above. Aggregates that fail to refresh are reported in
+//summary, as are the row counts of the others.
+func refreshContinuousAggs(cf *util.Config, tsInfo util.TsInfo, summary *restoreSummary) error {
+	var caggs []util.ContinuousAggInfo
+	for _, h := range tsInfo.Hypertables {
+		caggs = append(caggs, h.ContinuousAggs...)
+	}
+	if len(caggs) == 0 {
+		return nil
+	}
+	tsSchema, tsMajorVersion, err := getTargetTimescale(cf.DbURI)
+	if err != nil {
+		return err
+	}
+	jobs := cf.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	sem := make(chan bool, jobs)
+	var mu sync.Mutex
+	refreshed := 0
+	var wg sync.WaitGroup
+	for _, ca := range caggs {
+		wg.Add(1)
+		go func(ca util.ContinuousAggInfo) {
+			defer wg.Done()
+			sem <- true
+			defer func() { <-sem }()
+			if cf.Verbose {
+				fmt.Printf("%sRefreshing continuous aggregate %s\n", time.Now().Format("2006/01/02 15:04:05 "), ca.QualifiedName())
+			}
+			rows, err := refreshContinuousAgg(cf, tsSchema, tsMajorVersion, ca)
+			if err != nil {
+				summary.warn("failed to refresh continuous aggregate %s: %s", ca.QualifiedName(), err)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			refreshed++
+			if ca.MaterializedRows != nil {
+				summary.note("continuous aggregate %s has %d rows after refreshing (%d when dumped)", ca.QualifiedName(), rows, *ca.MaterializedRows)
+			} else {
+				summary.note("continuous aggregate %s has %d rows after refreshing", ca.QualifiedName(), rows)
+			}
+		}(ca)
+	}
+	wg.Wait()
+	summary.note("refreshed %d of %d continuous aggregates", refreshed, len(caggs))
+	return nil
+}
+
+//refreshContinuousAgg refreshes a continuous aggregate over the window asked
+//for and returns how many rows its materialization holds afterwards
+func refreshContinuousAgg(cf *util.Config, tsSchema string, tsMajorVersion int, ca util.ContinuousAggInfo) (int64, error) {
+	ctx := context.Background()
+	conn, err := util.GetDBConn(ctx, cf.DbURI)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close(ctx)
+	// refreshes can't run in a transaction, so the statements are sent
+	// without arguments, which uses the simple protocol
+	var refresh string
+	if tsMajorVersion == 1 {
+		// refreshes are limited by the aggregate's refresh lag and maximum
+		// interval per job, its configured window, either way
+		refresh = fmt.Sprintf("REFRESH MATERIALIZED VIEW %s", ca.QualifiedName())
+	} else {
+		refresh = fmt.Sprintf("CALL %s.refresh_continuous_aggregate(%s, NULL, NULL)", tsSchema, util.QuoteLiteral(ca.QualifiedName()))
+		if cf.RestoreRefreshCaggs == util.RefreshPolicy {
+			var job int64
+			err = conn.QueryRow(ctx, refreshPolicySQL, ca.Schema, ca.Name).Scan(&job)
+			if err == nil {
+				refresh = fmt.Sprintf("CALL %s.run_job(%d)", tsSchema, job)
+			} else if err != pgx.ErrNoRows {
+				return 0, err
+			}
+		}
+	}
+	_, err = conn.Exec(ctx, refresh)
+	if err != nil {
+		return 0, err
+	}
+	var materialization string
+	err = conn.QueryRow(ctx, materializationSQL, ca.Schema, ca.Name).Scan(&materialization)
+	if err != nil {
+		return 0, err
+	}
+	var rows int64
+	err = conn.QueryRow(ctx, fmt.Sprintf("SELECT count(*) FROM %s", materialization)).Scan(&rows)
+	return rows, err
+}
@@ -0,0 +1,173 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// The TimescaleDB catalog is restored as plain data, and nothing checks that it
+// matches the tables restored alongside it until TimescaleDB trips over it,
+// typically when inserting into a new chunk fails. So once the restore is done
+// the catalog is checked for the ways it has been seen to go wrong: chunks and
+// hypertables without their tables, chunks without a dimension slice, or the
+// constraint enforcing it, for each dimension, compressed chunks without their
+// compressed chunk, and catalog sequences behind the ids already used, which
+// makes TimescaleDB reuse them. Columns were added across versions, so the
+// optional ones are read through to_jsonb.
+
+// each query returns a description of every problem it finds
+var catalogChecks = []string{
+	`SELECT format('hypertable %I.%I has no table', h.schema_name, h.table_name)
+		FROM _timescaledb_catalog.hypertable h
+		WHERE to_regclass(format('%I.%I', h.schema_name, h.table_name)) IS NULL`,
+	`SELECT format('chunk %s of hypertable %I.%I has no table %I.%I', c.id, h.schema_name, h.table_name, c.schema_name, c.table_name)
+		FROM _timescaledb_catalog.chunk c
+		INNER JOIN _timescaledb_catalog.hypertable h ON h.id = c.hypertable_id
+		WHERE NOT coalesce((to_jsonb(c)->>'dropped')::bool, false)
+		AND to_regclass(format('%I.%I', c.schema_name, c.table_name)) IS NULL`,
+	`SELECT format('chunk %I.%I refers to dimension slice %s, which does not exist', c.schema_name, c.table_name, cc.dimension_slice_id)
+		FROM _timescaledb_catalog.chunk_constraint cc
+		INNER JOIN _timescaledb_catalog.chunk c ON c.id = cc.chunk_id
+		WHERE cc.dimension_slice_id IS NOT NULL
+		AND NOT EXISTS (SELECT 1 FROM _timescaledb_catalog.dimension_slice s WHERE s.id = cc.dimension_slice_id)`,
+	`SELECT format('chunk %I.%I has no dimension slice for dimension %I', c.schema_name, c.table_name, d.column_name)
+		FROM _timescaledb_catalog.chunk c
+		INNER JOIN _timescaledb_catalog.dimension d ON d.hypertable_id = c.hypertable_id
+		WHERE NOT coalesce((to_jsonb(c)->>'dropped')::bool, false)
+		AND NOT EXISTS (SELECT 1 FROM _timescaledb_catalog.chunk_constraint cc
+			INNER JOIN _timescaledb_catalog.dimension_slice s ON s.id = cc.dimension_slice_id
+			WHERE cc.chunk_id = c.id AND s.dimension_id = d.id)`,
+	`SELECT format('chunk %I.%I is missing constraint %I on its dimension slice %s', c.schema_name, c.table_name, cc.constraint_name, cc.dimension_slice_id)
+		FROM _timescaledb_catalog.chunk_constraint cc
+		INNER JOIN _timescaledb_catalog.chunk c ON c.id = cc.chunk_id
+		WHERE cc.dimension_slice_id IS NOT NULL
+		AND to_regclass(format('%I.%I', c.schema_name, c.table_name)) IS NOT NULL
+		AND NOT EXISTS (SELECT 1 FROM pg_constraint pc
+			WHERE pc.conrelid = to_regclass(format('%I.%I', c.schema_name, c.table_name)) AND pc.conname = cc.constraint_name)`,
+	`SELECT format('compressed chunk %s of chunk %I.%I does not exist', to_jsonb(c)->>'compressed_chunk_id', c.schema_name, c.table_name)
+		FROM _timescaledb_catalog.chunk c
+		WHERE (to_jsonb(c)->>'compressed_chunk_id') IS NOT NULL
+		AND NOT coalesce((to_jsonb(c)->>'dropped')::bool, false)
+		AND NOT EXISTS (SELECT 1 FROM _timescaledb_catalog.chunk z
+			WHERE z.id = (to_jsonb(c)->>'compressed_chunk_id')::int
+			AND to_regclass(format('%I.%I', z.schema_name, z.table_name)) IS NOT NULL)`,
+}
+
+// the sequences of the catalog, with the columns they number
+const catalogSequencesSQL = `SELECT format('%I.%I', sn.nspname, s.relname), format('%I.%I', tn.nspname, t.relname), format('%I', a.attname)
+	FROM pg_class s
+	INNER JOIN pg_namespace sn ON sn.oid = s.relnamespace
+	INNER JOIN pg_depend d ON d.classid = 'pg_class'::regclass AND d.objid = s.oid AND d.refclassid = 'pg_class'::regclass AND d.deptype IN ('a', 'i')
+	INNER JOIN pg_class t ON t.oid = d.refobjid
+	INNER JOIN pg_namespace tn ON tn.oid = t.relnamespace
+	INNER JOIN pg_attribute a ON a.attrelid = t.oid AND a.attnum = d.refobjsubid
+	WHERE s.relkind = 'S' AND tn.nspname IN ('_timescaledb_catalog', '_timescaledb_config')
+	ORDER BY 1`
+
+// chunk constraints are named after a sequence that no column owns
+const constraintNameSequenceSQL = `SELECT CASE WHEN to_regclass('_timescaledb_catalog.chunk_constraint_name') IS NOT NULL THEN
+	'SELECT max(substring(constraint_name FROM ''^constraint_(\d+)$'')::bigint) FROM _timescaledb_catalog.chunk_constraint' END`
+
+//checkCatalog checks the TimescaleDB catalog of the database at dbURI, see
+//above, and reports the problems it finds in summary
+func checkCatalog(dbURI string, summary *restoreSummary) error {
+	problems, err := CheckCatalog(dbURI)
+	if err != nil {
+		return err
+	}
+	for _, problem := range problems {
+		summary.warn("catalog: %s", problem)
+	}
+	summary.note("checked the TimescaleDB catalog, %d problems found", len(problems))
+	return nil
+}
+
+//CheckCatalog checks the TimescaleDB catalog of the database at dbURI, see
+//above, and returns a description of every problem it finds
+func CheckCatalog(dbURI string) ([]string, error) {
+	ctx := context.Background()
+	conn, err := util.GetDBConn(ctx, dbURI)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+	var problems []string
+	for _, check := range catalogChecks {
+		var found []string
+		err = conn.QueryRow(ctx, "SELECT coalesce(array_agg(p), '{}') FROM ("+check+") c(p)").Scan(&found)
+		if err != nil {
+			return nil, err
+		}
+		problems = append(problems, found...)
+	}
+
+	type sequence struct{ name, table, column string }
+	var sequences []sequence
+	rows, err := conn.Query(ctx, catalogSequencesSQL)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		s := sequence{}
+		if err = rows.Scan(&s.name, &s.table, &s.column); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		sequences = append(sequences, s)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, s := range sequences {
+		behind, err := sequenceBehind(conn, s.name, fmt.Sprintf("SELECT max(%s) FROM %s", s.column, s.table))
+		if err != nil {
+			return nil, err
+		}
+		if behind != "" {
+			problems = append(problems, behind)
+		}
+	}
+	var maxNameSQL *string
+	err = conn.QueryRow(ctx, constraintNameSequenceSQL).Scan(&maxNameSQL)
+	if err != nil {
+		return nil, err
+	}
+	if maxNameSQL != nil {
+		behind, err := sequenceBehind(conn, "_timescaledb_catalog.chunk_constraint_name", *maxNameSQL)
+		if err != nil {
+			return nil, err
+		}
+		if behind != "" {
+			problems = append(problems, behind)
+		}
+	}
+	return problems, nil
+}
+
+//sequenceBehind describes how the sequence is behind the maximum id returned
+//by maxSQL, or returns "" if it isn't
+func sequenceBehind(conn *pgx.Conn, name string, maxSQL string) (string, error) {
+	ctx := context.Background()
+	var maxID *int64
+	err := conn.QueryRow(ctx, maxSQL).Scan(&maxID)
+	if err != nil || maxID == nil {
+		return "", err
+	}
+	var lastValue int64
+	var isCalled bool
+	err = conn.QueryRow(ctx, fmt.Sprintf("SELECT last_value, is_called FROM %s", name)).Scan(&lastValue, &isCalled)
+	if err != nil {
+		return "", err
+	}
+	if lastValue > *maxID || lastValue == *maxID && isCalled {
+		return "", nil
+	}
+	return fmt.Sprintf("sequence %s is at %d, behind id %d which is in use already, fix it with SELECT setval('%s', %d)", name, lastValue, *maxID, name, *maxID), nil
+}
@@ -0,0 +1,130 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// databases to connect to in order to create the database being restored to
+var maintenanceDatabases = []string{"postgres", "template1"}
+
+//connectMaintenance connects to a maintenance database on the server of dbURI
+func connectMaintenance(ctx context.Context, dbURI string) (*pgx.Conn, error) {
+	var err error
+	for _, name := range maintenanceDatabases {
+		var uri string
+		uri, err = util.WithDatabase(dbURI, name)
+		if err != nil {
+			return nil, err
+		}
+		var conn *pgx.Conn
+		conn, err = util.GetDBConn(ctx, uri)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("failed to connect to a maintenance database (%s): %w", strings.Join(maintenanceDatabases, ", "), err)
+}
+
+//checkDatabaseMissing makes sure the database named in cf.DbURI doesn't exist
+//yet, before anything is written to the server
+func checkDatabaseMissing(cf *util.Config) error {
+	ctx := context.Background()
+	config, err := pgx.ParseConfig(cf.DbURI)
+	if err != nil {
+		return fmt.Errorf("invalid connection string: %w", err)
+	}
+	conn, err := connectMaintenance(ctx, cf.DbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	var exists bool
+	err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", config.Config.Database).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("database %s exists already, leave out --create-db to restore into it", config.Config.Database)
+	}
+	return nil
+}
+
+//createDatabase creates the database named in cf.DbURI with the encoding,
+//locale, owner and tablespace of the dumped database
+func createDatabase(cf *util.Config, tsInfo util.TsInfo) error {
+	ctx := context.Background()
+	config, err := pgx.ParseConfig(cf.DbURI)
+	if err != nil {
+		return fmt.Errorf("invalid connection string: %w", err)
+	}
+	name := config.Config.Database
+	if name == "" {
+		return errors.New("the database URI has to name the database to create")
+	}
+	conn, err := connectMaintenance(ctx, cf.DbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	var exists bool
+	err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", name).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("database %s exists already, leave out --create-db to restore into it", name)
+	}
+
+	stmnt := fmt.Sprintf("CREATE DATABASE %s TEMPLATE template0", pgx.Identifier{name}.Sanitize())
+	db := tsInfo.Database
+	if db == nil {
+		fmt.Printf("%sWARNING: the dump does not record the properties of the dumped database, creating database %s with the server's defaults\n", time.Now().Format("2006/01/02 15:04:05 "), name)
+	} else {
+		stmnt += fmt.Sprintf(" ENCODING %s LC_COLLATE %s LC_CTYPE %s", util.QuoteLiteral(db.Encoding), util.QuoteLiteral(db.Collate), util.QuoteLiteral(db.Ctype))
+		// a missing owner or tablespace only changes where the database ends up, so it isn't fatal
+		owner := db.Owner
+		if mapped, ok := cf.RoleMap[owner]; ok {
+			owner = mapped
+		}
+		err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)", owner).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			stmnt += fmt.Sprintf(" OWNER %s", pgx.Identifier{owner}.Sanitize())
+		} else {
+			fmt.Printf("%sWARNING: role %s owning the dumped database does not exist, the database will be owned by the user restoring it\n", time.Now().Format("2006/01/02 15:04:05 "), owner)
+		}
+		tablespace := mapTablespace(cf.TablespaceMap, db.Tablespace)
+		if tablespace != "pg_default" && tablespace != "" {
+			err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_tablespace WHERE spcname = $1)", tablespace).Scan(&exists)
+			if err != nil {
+				return err
+			}
+			if exists {
+				stmnt += fmt.Sprintf(" TABLESPACE %s", pgx.Identifier{tablespace}.Sanitize())
+			} else {
+				fmt.Printf("%sWARNING: tablespace %s of the dumped database does not exist, the database will be created in the default tablespace\n", time.Now().Format("2006/01/02 15:04:05 "), tablespace)
+			}
+		}
+	}
+	if cf.Verbose {
+		fmt.Printf("%sCreating database: %s\n", time.Now().Format("2006/01/02 15:04:05 "), stmnt)
+	}
+	_, err = conn.Exec(ctx, stmnt)
+	if err != nil {
+		return fmt.Errorf("failed to create database %s: %w", name, err)
+	}
+	return nil
+}
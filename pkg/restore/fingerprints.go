@@ -0,0 +1,94 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+	"github.com/timescale/timescaledb-backup/pkg/verify"
+)
+
+// Dumps taken with --dump-fingerprints record the fingerprint of every regular
+// table and chunk, which --verify-fingerprints compares the restored data to.
+// That happens before the database is taken out of restoring mode, so that no
+// job has changed the data yet. TimescaleDB only reads compressed chunks
+// decompressed outside of restoring mode, which is left for the sessions
+// taking the fingerprints only.
+
+func describeFingerprint(f util.DataFingerprint) string {
+	if f.Hypertable == "" {
+		return "table " + f.Table
+	}
+	return fmt.Sprintf("hypertable %s chunk %s (%s)", f.Hypertable, f.Table, f.Slices)
+}
+
+//verifyFingerprints compares the fingerprints of the restored tables and
+//chunks to those recorded in the dump, see above, reports the ones that differ
+//in summary and returns how many did
+func verifyFingerprints(cf *util.Config, tsInfo util.TsInfo, summary *restoreSummary) (int, error) {
+	if len(tsInfo.Fingerprints) == 0 {
+		summary.warn("the dump has no fingerprints to verify the restore with, they are recorded by ts-dump --dump-fingerprints")
+		return 0, nil
+	}
+	ctx := context.Background()
+	conn, err := util.GetDBConn(ctx, cf.DbURI)
+	if err != nil {
+		return 0, err
+	}
+	tables, err := verify.ListTables(conn)
+	conn.Close(ctx)
+	if err != nil {
+		return 0, err
+	}
+	restored := make(map[string]string, len(tables))
+	for _, t := range tables {
+		restored[t.Key()] = t.Name
+	}
+
+	mismatches := 0
+	var names []string
+	for _, f := range tsInfo.Fingerprints {
+		name, ok := restored[verify.Table{Name: f.Table, Hypertable: f.Hypertable, Slices: f.Slices}.Key()]
+		if !ok {
+			// empty chunks may well be gone
+			if f.Rows > 0 {
+				mismatches++
+				summary.warn("fingerprint mismatch, %s is missing from the restored database, it had %d rows", describeFingerprint(f), f.Rows)
+			}
+			continue
+		}
+		names = append(names, name)
+	}
+	fingerprints, err := verify.Fingerprints(names, cf.Jobs, false, func() (*pgx.Conn, error) {
+		conn, err := verify.Connect(ctx, cf.DbURI)
+		if err != nil {
+			return nil, err
+		}
+		_, err = conn.Exec(ctx, "SET timescaledb.restoring TO off")
+		if err != nil {
+			conn.Close(ctx)
+			return nil, err
+		}
+		return conn, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, f := range tsInfo.Fingerprints {
+		name, ok := restored[verify.Table{Name: f.Table, Hypertable: f.Hypertable, Slices: f.Slices}.Key()]
+		if !ok {
+			continue
+		}
+		mismatch := verify.Compare(verify.Fingerprint{Rows: f.Rows, Hash: f.Hash}, fingerprints[name])
+		if mismatch != "" {
+			mismatches++
+			summary.warn("fingerprint mismatch, %s: %s", describeFingerprint(f), mismatch)
+		}
+	}
+	summary.note("verified the fingerprints of %d tables and chunks, %d mismatches", len(tsInfo.Fingerprints), mismatches)
+	return mismatches, nil
+}
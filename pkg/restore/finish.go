@@ -0,0 +1,90 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// timescaledb_pre_restore sets timescaledb.restoring for the database, which
+// keeps the background workers from running until timescaledb_post_restore
+// resets it. A restore that fails, or is killed, in between leaves the database
+// in that state, where it works as a plain PostgreSQL database but none of the
+// TimescaleDB jobs (compression, retention, continuous aggregates) run.
+const restoringModeSQL = `SELECT EXISTS (SELECT 1 FROM pg_db_role_setting s CROSS JOIN LATERAL unnest(s.setconfig) c
+	WHERE s.setdatabase = (SELECT oid FROM pg_database WHERE datname = current_database())
+	AND s.setrole = 0 AND c = 'timescaledb.restoring=on')`
+
+//FinishRestore takes the database at cf.DbURI out of restoring mode if an
+//earlier restore left it there, completing the post restore steps
+func FinishRestore(cf *util.Config) error {
+	tsSchema, _, err := getTargetTimescale(cf.DbURI)
+	if err != nil {
+		return err
+	}
+	restoring, err := isRestoring(cf.DbURI)
+	if err != nil {
+		return err
+	}
+	if !restoring {
+		fmt.Printf("%sThe database is not in restoring mode, nothing to do\n", time.Now().Format("2006/01/02 15:04:05 "))
+		return nil
+	}
+	if cf.RestoreJobRules != "" {
+		rules, err := util.ReadJobRules(cf.RestoreJobRules)
+		if err != nil {
+			return err
+		}
+		err = applyJobRules(cf.DbURI, rules, nil)
+		if err != nil {
+			return fmt.Errorf("failed to apply job rules: %w", err)
+		}
+	}
+	if cf.RestoreJobsDisabled {
+		err = disableJobs(cf.DbURI, nil)
+		if err != nil {
+			return fmt.Errorf("failed to disable background jobs: %w", err)
+		}
+	}
+	fmt.Printf("%sThe database is in restoring mode, running TimescaleDB post restore\n", time.Now().Format("2006/01/02 15:04:05 "))
+	err = finishRestoring(cf.DbURI, tsSchema)
+	if err != nil {
+		return fmt.Errorf("TimescaleDB post restore failed: %w", err)
+	}
+	fmt.Printf("%sThe database is out of restoring mode and background jobs have been restarted\n", time.Now().Format("2006/01/02 15:04:05 "))
+	return nil
+}
+
+func isRestoring(dbURI string) (bool, error) {
+	conn, err := util.GetDBConn(context.Background(), dbURI)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close(context.Background())
+	var restoring bool
+	err = conn.QueryRow(context.Background(), restoringModeSQL).Scan(&restoring)
+	return restoring, err
+}
+
+//finishRestoring runs the post restore function and makes sure it took the
+//database out of restoring mode
+func finishRestoring(dbURI string, tsSchema string) error {
+	err := postRestoreTimescale(dbURI, tsSchema)
+	if err != nil {
+		return err
+	}
+	restoring, err := isRestoring(dbURI)
+	if err != nil {
+		return err
+	}
+	if restoring {
+		return errors.New("the database is still in restoring mode after running the post restore function")
+	}
+	return nil
+}
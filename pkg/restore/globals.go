@@ -0,0 +1,172 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// Roles and tablespaces are global to the cluster, so when several databases
+// are restored into the same cluster all but the first restore find them there
+// already. The files are therefore applied statement by statement: creating a
+// role or tablespace that exists is skipped, and so is everything else the file
+// does to it, so that the roles of the cluster are not altered behind its
+// back. Only roles and tablespaces the restore creates are set up by the file.
+
+// the files ts-dump writes, in the order they are applied in, tablespaces
+// refer to their owners
+var globalsFiles = []string{"roles.sql", "tablespaces.sql"}
+
+var (
+	createGlobalRe    = regexp.MustCompile(`^(?i)CREATE\s+(ROLE|TABLESPACE)\s+("(?:[^"]|"")+"|[^\s;]+)`)
+	alterGlobalRe     = regexp.MustCompile(`^(?i)(?:ALTER|COMMENT\s+ON)\s+(ROLE|TABLESPACE)\s+("(?:[^"]|"")+"|[^\s;]+)`)
+	grantTablespaceRe = regexp.MustCompile(`^(?i)(?:GRANT|REVOKE)\s.*?\sON\s+(TABLESPACE)\s+("(?:[^"]|"")+"|[^\s;]+)`)
+)
+
+// SQLSTATE of creating an object that exists already
+const duplicateObject = "42710"
+
+//restoreGlobals applies the roles, role passwords and tablespaces dumped by
+//ts-dump to the cluster of dbURI
+func restoreGlobals(cf *util.Config, tsInfo util.TsInfo, dbURI string) error {
+	ctx := context.Background()
+	var conn *pgx.Conn
+	var err error
+	//The database doesn't exist yet if it is going to be created
+	if cf.RestoreCreateDB && !cf.RestoreResume {
+		conn, err = connectMaintenance(ctx, dbURI)
+	} else {
+		conn, err = util.GetDBConn(ctx, dbURI)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	existing := skippedGlobals(cf)
+	applied := 0
+	for _, name := range globalsFiles {
+		path := filepath.Join(cf.DumpDir, name)
+		script, err := ioutil.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if cf.Verbose {
+			fmt.Printf("%sApplying %s\n", time.Now().Format("2006/01/02 15:04:05 "), path)
+		}
+		err = applyGlobals(ctx, conn, string(script), existing, cf.RoleMap)
+		if err != nil {
+			return fmt.Errorf("failed to apply %s: %w", path, err)
+		}
+		applied++
+	}
+	if applied == 0 {
+		fmt.Printf("%sWARNING: the dump holds no roles or tablespaces to restore, it was taken with --dump-roles=false and --dump-tablespaces=false\n", time.Now().Format("2006/01/02 15:04:05 "))
+	}
+	if tsInfo.RolePasswordsFile == "" {
+		return nil
+	}
+	//Passwords are only set on the roles created above
+	path := filepath.Join(cf.DumpDir, tsInfo.RolePasswordsFile)
+	script, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(path, util.EncryptedSuffix) {
+		if cf.RolePasswordsKeyFile == "" {
+			fmt.Printf("%sWARNING: the role passwords in the dump are encrypted, pass --role-passwords-key-file to restore them\n", time.Now().Format("2006/01/02 15:04:05 "))
+			return nil
+		}
+		script, err = util.Decrypt(script, cf.RolePasswordsKeyFile)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", path, err)
+		}
+	}
+	if cf.Verbose {
+		fmt.Printf("%sApplying role passwords from %s\n", time.Now().Format("2006/01/02 15:04:05 "), path)
+	}
+	err = applyGlobals(ctx, conn, string(script), existing, cf.RoleMap)
+	if err != nil {
+		// the statement holds the password
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) {
+			return fmt.Errorf("failed to apply role passwords: %s", pgErr.Message)
+		}
+		return errors.New("failed to apply role passwords")
+	}
+	return nil
+}
+
+//skippedGlobals returns the roles and tablespaces of the dump that are not
+//created because they are mapped to other ones
+func skippedGlobals(cf *util.Config) map[string]bool {
+	existing := make(map[string]bool)
+	for src, dst := range cf.RoleMap {
+		existing[globalKey("ROLE", pgx.Identifier{src}.Sanitize())] = true
+		fmt.Printf("%sSkipping role %s, it is mapped to %s\n", time.Now().Format("2006/01/02 15:04:05 "), src, dst)
+	}
+	for old, to := range cf.TablespaceMap {
+		existing[globalKey("TABLESPACE", pgx.Identifier{old}.Sanitize())] = true
+		if to == "" {
+			to = "the default tablespace"
+		}
+		fmt.Printf("%sSkipping tablespace %s, it is mapped to %s\n", time.Now().Format("2006/01/02 15:04:05 "), old, to)
+	}
+	return existing
+}
+
+//applyGlobals runs the statements of a script written by pg_dumpall one by
+//one, skipping the roles and tablespaces in existing, see above, and adding
+//those that turn out to exist already. Role memberships of mapped roles are
+//granted to the roles they are mapped to.
+func applyGlobals(ctx context.Context, conn *pgx.Conn, script string, existing map[string]bool, roleMap util.Mapping) error {
+	for _, stmnt := range util.SplitStatements(script) {
+		if m := alterGlobalRe.FindStringSubmatch(stmnt); m != nil && existing[globalKey(m[1], m[2])] {
+			continue
+		}
+		if m := grantTablespaceRe.FindStringSubmatch(stmnt); m != nil && existing[globalKey(m[1], m[2])] {
+			continue
+		}
+		if m := createGlobalRe.FindStringSubmatch(stmnt); m != nil && existing[globalKey(m[1], m[2])] {
+			continue
+		}
+		stmnt = util.MapRoles(stmnt, roleMap)
+		_, err := conn.Exec(ctx, stmnt)
+		if err == nil {
+			continue
+		}
+		var pgErr *pgconn.PgError
+		m := createGlobalRe.FindStringSubmatch(stmnt)
+		if m != nil && errors.As(err, &pgErr) && pgErr.Code == duplicateObject {
+			existing[globalKey(m[1], m[2])] = true
+			fmt.Printf("%s%s %s exists already, skipping it\n", time.Now().Format("2006/01/02 15:04:05 "), strings.ToLower(m[1]), m[2])
+			continue
+		}
+		return fmt.Errorf("%w, in statement: %s", err, stmnt)
+	}
+	return nil
+}
+
+//globalKey identifies a role or tablespace as named in a statement
+func globalKey(kind string, name string) string {
+	schema, parsed, err := util.ParseQualifiedName(name)
+	if err == nil && schema == "" {
+		name = parsed
+	}
+	return fmt.Sprintf("%s %s", strings.ToUpper(kind), name)
+}
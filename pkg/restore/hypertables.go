@@ -0,0 +1,339 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// Restoring single hypertables from a full dump can't be done by restoring a
+// filtered table of contents into the database directly: the chunks and the
+// catalog rows describing them would clash with the hypertables already there,
+// and the table of contents doesn't tell which indexes belong to which table.
+// Instead, the schema, the TimescaleDB catalog and the data of just the chunks
+// of the selected hypertables are restored into a scratch database on the same
+// server. From there the parent tables' definitions are dumped, which turns the
+// problem into merging a selective dump (see selective.go), with the data
+// copied straight from the scratch database rather than from files.
+//
+// The scratch database is left in restoring mode, so its background jobs never
+// run (a retention policy could otherwise drop the very chunks we are after),
+// and only the connections reading the data out turn restoring mode off.
+
+// TOC entries that are not needed in the scratch database: foreign keys would
+// fail to validate against tables whose data is not restored, so those of the
+// selected hypertables are restored into the database directly instead
+var scratchSkippedDescs = map[string]bool{"FK CONSTRAINT": true, "MATERIALIZED VIEW DATA": true}
+
+//restoreHypertables restores the hypertables named in cf.Hypertables from the
+//dump into the database, alongside anything that is already there
+func restoreHypertables(cf *util.Config, tsInfo util.TsInfo) error {
+	hypertables, err := matchHypertables(tsInfo.Hypertables, cf.Hypertables)
+	if err != nil {
+		return err
+	}
+	if tsInfo.Selective {
+		tsInfo.Hypertables = hypertables
+		return mergeSelectiveDump(cf, tsInfo)
+	}
+	if len(tsInfo.Chunks) == 0 {
+		return errors.New("the dump does not record its chunks, restoring single hypertables requires a dump taken by a newer version of ts-dump")
+	}
+	// fail before the scratch restore if they can't be restored anyway
+	err = prepareMergeTargets(cf.DbURI, hypertables)
+	if err != nil {
+		return err
+	}
+
+	scratchURI, dropScratch, err := createScratchDatabase(cf)
+	if err != nil {
+		return err
+	}
+	defer dropScratch()
+	err = restoreIntoScratch(cf, tsInfo, hypertables, scratchURI)
+	if err != nil {
+		return fmt.Errorf("failed to restore hypertables into scratch database: %w", err)
+	}
+
+	parentDumpDir, err := ioutil.TempDir("", "ts_restore_hypertables")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(parentDumpDir)
+	mergeCf := *cf
+	mergeCf.PgDumpDir = filepath.Join(parentDumpDir, util.PgDumpDirName)
+	err = dumpParentTables(&mergeCf, scratchURI, hypertables)
+	if err != nil {
+		return fmt.Errorf("failed to dump hypertable definitions from scratch database: %w", err)
+	}
+
+	mergeInfo := tsInfo
+	mergeInfo.Hypertables = hypertables
+	return mergeHypertables(&mergeCf, mergeInfo, func(h util.HypertableInfo) error {
+		return copyHypertableBetween(scratchURI, cf.DbURI, h)
+	}, func(restorePath string) error {
+		return restoreForeignKeys(cf, restorePath, hypertables)
+	})
+}
+
+//matchHypertables finds the hypertables named by the user among those recorded
+//in the dump, names that aren't schema qualified match in any schema
+func matchHypertables(all []util.HypertableInfo, names []string) ([]util.HypertableInfo, error) {
+	if len(all) == 0 {
+		return nil, errors.New("the dump does not record its hypertables, restoring single hypertables requires a dump taken by a newer version of ts-dump")
+	}
+	var selected []util.HypertableInfo
+	seen := make(map[int64]bool)
+	for _, name := range names {
+		schema, table, err := util.ParseQualifiedName(name)
+		if err != nil {
+			return nil, err
+		}
+		var matches []util.HypertableInfo
+		for _, h := range all {
+			if h.Table == table && (schema == "" || h.Schema == schema) {
+				matches = append(matches, h)
+			}
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("hypertable %s not found in the dump", name)
+		}
+		if len(matches) > 1 {
+			return nil, fmt.Errorf("hypertable name %s is ambiguous, qualify it with its schema", name)
+		}
+		if !seen[matches[0].ID] {
+			selected = append(selected, matches[0])
+			seen[matches[0].ID] = true
+		}
+	}
+	return selected, nil
+}
+
+//createScratchDatabase creates an empty database on the server of cf.DbURI and
+//returns a connection string for it and a function that drops it again. A
+//connection to it is held until it is dropped, so scratch databases left behind
+//by restores that were killed are told apart by having none and dropped first.
+func createScratchDatabase(cf *util.Config) (string, func(), error) {
+	name := fmt.Sprintf("ts_restore_scratch_%d", os.Getpid())
+	scratchURI, err := util.WithDatabase(cf.DbURI, name)
+	if err != nil {
+		return "", func() {}, err
+	}
+	conn, err := util.GetDBConn(context.Background(), cf.DbURI)
+	if err != nil {
+		return "", func() {}, err
+	}
+	defer conn.Close(context.Background())
+	dropStaleScratchDatabases(cf, conn)
+	_, err = conn.Exec(context.Background(), fmt.Sprintf("CREATE DATABASE %s TEMPLATE template0", pgx.Identifier{name}.Sanitize()))
+	if err != nil {
+		return "", func() {}, fmt.Errorf("failed to create scratch database %s, restoring single hypertables needs the CREATEDB privilege: %w", name, err)
+	}
+	if cf.Verbose {
+		fmt.Printf("%sCreated scratch database %s\n", time.Now().Format("2006/01/02 15:04:05 "), name)
+	}
+	drop := func() {
+		conn, err := util.GetDBConn(context.Background(), cf.DbURI)
+		if err == nil {
+			defer conn.Close(context.Background())
+			_, err = conn.Exec(context.Background(), fmt.Sprintf("DROP DATABASE %s", pgx.Identifier{name}.Sanitize()))
+		}
+		if err != nil {
+			fmt.Printf("%sWARNING: failed to drop scratch database %s, drop it manually: %s\n", time.Now().Format("2006/01/02 15:04:05 "), name, err)
+		}
+	}
+	lease, err := util.GetDBConn(context.Background(), scratchURI)
+	if err != nil {
+		drop()
+		return "", func() {}, err
+	}
+	return scratchURI, func() {
+		lease.Close(context.Background())
+		drop()
+	}, nil
+}
+
+//dropStaleScratchDatabases drops the scratch databases no restore is connected
+//to. Postgres refuses to drop databases that are in use, so those of restores
+//still running are left alone.
+func dropStaleScratchDatabases(cf *util.Config, conn *pgx.Conn) {
+	rows, err := conn.Query(context.Background(), `SELECT datname FROM pg_database WHERE datname LIKE 'ts\_restore\_scratch\_%'`)
+	if err != nil {
+		return
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if rows.Scan(&name) == nil {
+			names = append(names, name)
+		}
+	}
+	rows.Close()
+	for _, name := range names {
+		_, err = conn.Exec(context.Background(), fmt.Sprintf("DROP DATABASE %s", pgx.Identifier{name}.Sanitize()))
+		if err == nil && cf.Verbose {
+			fmt.Printf("%sDropped scratch database %s left behind by an earlier restore\n", time.Now().Format("2006/01/02 15:04:05 "), name)
+		}
+	}
+}
+
+//restoreIntoScratch restores the schema and the catalog of the dump into the
+//scratch database, but only the data of the chunks of the given hypertables
+func restoreIntoScratch(cf *util.Config, tsInfo util.TsInfo, hypertables []util.HypertableInfo, scratchURI string) error {
+	tables := make(map[string]bool)
+	hypertableIDs := make(map[int64]bool)
+	for _, h := range hypertables {
+		tables[h.QualifiedName()] = true
+		hypertableIDs[h.ID] = true
+	}
+	compressedIDs := make(map[int64]bool)
+	for _, c := range tsInfo.Chunks {
+		if hypertableIDs[c.HypertableID] && c.CompressedChunkID != 0 {
+			compressedIDs[c.CompressedChunkID] = true
+		}
+	}
+	// only the selected chunks are restored from parents of incremental dumps
+	var chunks []util.ChunkInfo
+	for _, c := range tsInfo.Chunks {
+		if hypertableIDs[c.HypertableID] || compressedIDs[c.ID] {
+			tables[c.QualifiedName()] = true
+			chunks = append(chunks, c)
+		}
+	}
+	tsInfo.Chunks = chunks
+
+	scratchCf := *cf
+	scratchCf.DbURI = scratchURI
+	scratchCf.DoUpdate = false
+	err := preRestoreTimescale(scratchURI, tsInfo)
+	if err != nil {
+		return err
+	}
+	return restoreDatabase(&scratchCf, tsInfo, func(entry util.TOCEntry) bool {
+		if scratchSkippedDescs[entry.Desc] {
+			return false
+		}
+		if entry.Desc == "TABLE DATA" && entry.Schema != "_timescaledb_catalog" && entry.Schema != "_timescaledb_config" {
+			return tables[entry.QualifiedName()]
+		}
+		return true
+	}, nil, nil)
+}
+
+//dumpParentTables dumps the parent tables of the hypertables, along with their
+//indexes, grants and owned sequences, from the scratch database into
+//cf.PgDumpDir. The parent tables themselves hold no data.
+func dumpParentTables(cf *util.Config, scratchURI string, hypertables []util.HypertableInfo) error {
+	dumpPath, err := exec.LookPath("pg_dump")
+	if err != nil {
+		return errors.New("pg_dump not found, please make sure it is installed")
+	}
+	dump := exec.Command(dumpPath)
+	for _, h := range hypertables {
+		dump.Args = append(dump.Args, fmt.Sprintf("--table=%s", h.QualifiedName()))
+	}
+	dump.Args = append(dump.Args,
+		fmt.Sprintf("--dbname=%s", scratchURI),
+		"--format=directory",
+		fmt.Sprintf("--file=%s", cf.PgDumpDir))
+	return util.RunCommandAndFilterOutput(dump, os.Stdout, os.Stderr, true)
+}
+
+//copyHypertableBetween copies the data of a hypertable from the scratch
+//database into the hypertable of the same name in the database at dstURI
+func copyHypertableBetween(scratchURI string, dstURI string, h util.HypertableInfo) error {
+	ctx := context.Background()
+	conn, err := util.GetDBConn(ctx, scratchURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	// hypertables are only expanded to their chunks outside of restoring mode
+	_, err = conn.Exec(ctx, "SET timescaledb.restoring = off")
+	if err != nil {
+		return err
+	}
+	reader, writer := io.Pipe()
+	copyOut := make(chan error, 1)
+	go func() {
+		_, err := conn.PgConn().CopyTo(ctx, writer, fmt.Sprintf("COPY (SELECT %s FROM %s) TO STDOUT", h.SelectList(), h.QualifiedName()))
+		writer.CloseWithError(err)
+		copyOut <- err
+	}()
+	err = copyIntoHypertable(dstURI, h, reader)
+	reader.Close()
+	outErr := <-copyOut
+	if err != nil {
+		return err
+	}
+	return outErr
+}
+
+//restoreForeignKeys restores the foreign keys of the parent tables of the
+//hypertables from the dump, TimescaleDB adds them to the chunks
+func restoreForeignKeys(cf *util.Config, restorePath string, hypertables []util.HypertableInfo) error {
+	entries, err := util.ReadTOC(restorePath, cf.PgDumpDir)
+	if err != nil {
+		return err
+	}
+	var keys []util.TOCEntry
+	for _, entry := range entries {
+		if entry.Desc != "FK CONSTRAINT" {
+			continue
+		}
+		for _, h := range hypertables {
+			if entry.Schema == h.Schema && isForeignKeyOf(entry, h) {
+				keys = append(keys, entry)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	TOCFile, err := writeTOCFile(keys)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(TOCFile)
+	var args = []string{fmt.Sprintf("--dbname=%s", cf.DbURI), "--format=directory", fmt.Sprintf("--use-list=%s", TOCFile), "--section=post-data"}
+	args = append(args, cf.PGRestoreFlags...)
+	if cf.Verbose {
+		args = append(args, "--verbose")
+	}
+	restore := getRestoreCmd(restorePath, cf.PgDumpDir, args)
+	err = util.RunCommandAndFilterOutput(restore, os.Stdout, os.Stderr, true)
+	if err != nil {
+		return fmt.Errorf("pg_restore run failed while restoring foreign keys: %w", err)
+	}
+	return nil
+}
+
+//isForeignKeyOf tells whether the FK CONSTRAINT entry belongs to the parent
+//table of the hypertable. Constraints are named by their table and their name
+//in the TOC, which can't be told apart when names contain spaces, so the names
+//recorded in the dump are matched exactly. Older dumps don't record them, and
+//fall back to matching the table name only.
+func isForeignKeyOf(entry util.TOCEntry, h util.HypertableInfo) bool {
+	if h.ForeignKeys == nil {
+		return strings.HasPrefix(entry.Name, h.Table+" ")
+	}
+	for _, name := range h.ForeignKeys {
+		if entry.Name == h.Table+" "+name {
+			return true
+		}
+	}
+	return false
+}
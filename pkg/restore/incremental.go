@@ -0,0 +1,108 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+//chunkOrigins walks up the chain of parent dumps of an incremental dump and
+//finds, for every chunk whose data was not dumped in this dump, the dump
+//directory that does contain it. The result maps dump directories to the
+//qualified names of the chunks to restore from them, the TsInfo of each of
+//those dumps is returned as well.
+func chunkOrigins(dumpDir string, tsInfo util.TsInfo) (map[string]map[string]bool, map[string]util.TsInfo, error) {
+	pending := make(map[string]bool)
+	for _, c := range tsInfo.Chunks {
+		if !c.Dumped {
+			pending[c.QualifiedName()] = true
+		}
+	}
+	origins := make(map[string]map[string]bool)
+	infos := make(map[string]util.TsInfo)
+	dir, info := dumpDir, tsInfo
+	for len(pending) > 0 {
+		if info.ParentDumpDir == "" {
+			return nil, nil, fmt.Errorf("data for %d chunks not found in the chain of parent dumps of %s", len(pending), dumpDir)
+		}
+		parentDir := info.ParentDumpDir
+		if !filepath.IsAbs(parentDir) {
+			parentDir = filepath.Join(dir, parentDir)
+		}
+		parentInfo, err := util.ReadTsInfo(filepath.Join(parentDir, util.TsInfoFileName))
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read parent dump %s: %w", parentDir, err)
+		}
+		for _, c := range parentInfo.Chunks {
+			name := c.QualifiedName()
+			if !c.Dumped || !pending[name] {
+				continue
+			}
+			if origins[parentDir] == nil {
+				origins[parentDir] = make(map[string]bool)
+				infos[parentDir] = parentInfo
+			}
+			origins[parentDir][name] = true
+			delete(pending, name)
+		}
+		dir, info = parentDir, parentInfo
+	}
+	return origins, infos, nil
+}
+
+//restoreParentChunkData restores the data of the chunks that an incremental
+//dump took from its parents, one pg_restore run per parent dump, restricted
+//to the data of those chunks with a generated use-list.
+func restoreParentChunkData(cf *util.Config, restorePath string, tsInfo util.TsInfo, state *restoreState) error {
+	origins, infos, err := chunkOrigins(cf.DumpDir, tsInfo)
+	if err != nil {
+		return err
+	}
+	for originDir, chunks := range origins {
+		if cf.Verbose {
+			fmt.Printf("%sRestoring data of %d unchanged chunks from parent dump %s\n", time.Now().Format("2006/01/02 15:04:05 "), len(chunks), originDir)
+		}
+		pgDumpDir, cleanup, err := pgDumpDirFor(cf, originDir, infos[originDir])
+		if err != nil {
+			return err
+		}
+		err = restoreChunkDataFrom(cf, restorePath, pgDumpDir, chunks, state, phaseParentData+" "+originDir)
+		cleanup()
+		if err != nil {
+			return fmt.Errorf("failed restoring chunk data from parent dump %s: %w", originDir, err)
+		}
+	}
+	return nil
+}
+
+func restoreChunkDataFrom(cf *util.Config, restorePath string, pgDumpDir string, chunks map[string]bool, state *restoreState, phase string) error {
+	entries, err := util.ReadTOC(restorePath, pgDumpDir)
+	if err != nil {
+		return err
+	}
+	var dataEntries []util.TOCEntry
+	for _, entry := range entries {
+		if entry.Desc == "TABLE DATA" && chunks[entry.QualifiedName()] {
+			dataEntries = append(dataEntries, entry)
+		}
+	}
+	if len(dataEntries) != len(chunks) {
+		return errors.New("parent dump is missing data for some chunks")
+	}
+
+	var args = []string{fmt.Sprintf("--dbname=%s", cf.DbURI), "--format=directory", "--section=data"}
+	args = append(args, cf.PGRestoreFlags...)
+	if cf.Verbose {
+		args = append(args, "--verbose")
+	}
+	if cf.Jobs > 0 {
+		args = append(args, fmt.Sprintf("--jobs=%d", cf.Jobs))
+	}
+	return runTrackedRestore(cf, state, phase, restorePath, pgDumpDir, dataEntries, args...)
+}
@@ -0,0 +1,99 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// Job rules change the restored jobs before the database is taken out of
+// restoring mode, so the dumped policies never run, see util.JobRule.
+
+//applyJobRules applies the rules to the jobs of the database at dbURI, in a
+//single transaction, and reports what they changed in summary
+func applyJobRules(dbURI string, rules []util.JobRule, summary *restoreSummary) error {
+	if len(rules) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	conn, tsSchema, tsMajorVersion, err := jobsConn(ctx, dbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	typeSQL, configSQL, intervalSQL, shiftSQL, disableSQL, err := util.JobRuleSQL(tsMajorVersion, tsSchema)
+	if err != nil {
+		return err
+	}
+	err = util.CheckJobRules(rules, tsMajorVersion)
+	if err != nil {
+		return err
+	}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	var reports []string
+	for i, r := range rules {
+		var jobs []int64
+		err = tx.QueryRow(ctx, fmt.Sprintf(`SELECT coalesce(array_agg(id ORDER BY id), '{}') FROM _timescaledb_config.bgw_job
+			WHERE (%[1]s) = $1 OR ($1 = 'all' AND (%[1]s) IS NOT NULL)`, typeSQL), r.Type).Scan(&jobs)
+		if err != nil {
+			return err
+		}
+		for _, id := range jobs {
+			err = applyJobRule(ctx, tx, r, id, configSQL, intervalSQL, shiftSQL, disableSQL)
+			if err != nil {
+				return fmt.Errorf("job rule %d (%s) failed on job %d: %w", i+1, r, id, err)
+			}
+		}
+		reports = append(reports, fmt.Sprintf("job rule %d (%s) applied to %d jobs %v", i+1, r, len(jobs), jobs))
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	for _, report := range reports {
+		summary.note("%s", report)
+	}
+	return nil
+}
+
+func applyJobRule(ctx context.Context, tx pgx.Tx, r util.JobRule, id int64, configSQL string, intervalSQL string, shiftSQL string, disableSQL string) error {
+	if len(r.Config) > 0 {
+		config, err := json.Marshal(r.Config)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, configSQL, id, string(config))
+		if err != nil {
+			return err
+		}
+	}
+	if r.ScheduleInterval != "" {
+		_, err := tx.Exec(ctx, intervalSQL, id, r.ScheduleInterval)
+		if err != nil {
+			return err
+		}
+	}
+	if r.Shift != "" {
+		_, err := tx.Exec(ctx, shiftSQL, id, r.Shift)
+		if err != nil {
+			return err
+		}
+	}
+	if r.Disable {
+		_, err := tx.Exec(ctx, disableSQL, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,200 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// Once timescaledb_post_restore restarts the background workers, the restored
+// jobs run against the restore host's clock: retention policies drop chunks
+// that were recent when the dump was taken, and compression and refresh jobs
+// all start at once. With --jobs-disabled the jobs are unscheduled before the
+// post restore, while the workers are still stopped. TimescaleDB's functions
+// only work outside of restoring mode, which is left for the session doing so
+// only. Which jobs were unscheduled is recorded as a setting of the database,
+// so that it stays with the database, and --enable-jobs schedules those jobs
+// again, leaving alone any that were unscheduled before the restore.
+
+// the setting recording the jobs disabled by the restore, as a comma separated list of ids
+const disabledJobsSetting = "timescaledb_backup.disabled_jobs"
+
+//jobSchedulingSQL returns the statements unscheduling all scheduled policy
+//and user defined jobs, returning their ids, and scheduling the jobs with the
+//ids given again for the major version of TimescaleDB
+func jobSchedulingSQL(tsMajorVersion int, tsSchema string) (disableSQL string, enableSQL string, err error) {
+	if tsMajorVersion == 1 {
+		// jobs can't be unscheduled, but they can be put off until infinity
+		disableSQL = fmt.Sprintf(`SELECT coalesce(array_agg(j.job_id ORDER BY j.job_id), '{}') FROM
+			(SELECT (%[1]s.alter_job_schedule(b.id, next_start => 'infinity')).job_id
+			FROM _timescaledb_config.bgw_job b
+			WHERE b.job_type IN ('reorder', 'drop_chunks', 'continuous_aggregate', 'compress_chunks')
+			AND NOT EXISTS (SELECT 1 FROM _timescaledb_internal.bgw_job_stat s WHERE s.job_id = b.id AND s.next_start = 'infinity')) j`, tsSchema)
+		enableSQL = fmt.Sprintf(`SELECT count(%[1]s.alter_job_schedule(id, next_start => now())) FROM _timescaledb_config.bgw_job WHERE id = ANY($1)`, tsSchema)
+	} else if tsMajorVersion == 2 {
+		// jobs below 1000 are TimescaleDB's own, such as telemetry
+		disableSQL = fmt.Sprintf(`SELECT coalesce(array_agg(j.job_id ORDER BY j.job_id), '{}') FROM
+			(SELECT (%[1]s.alter_job(id, scheduled => false)).job_id
+			FROM _timescaledb_config.bgw_job WHERE scheduled AND id >= 1000) j`, tsSchema)
+		enableSQL = fmt.Sprintf(`SELECT count(%[1]s.alter_job(id, scheduled => true)) FROM _timescaledb_config.bgw_job WHERE id = ANY($1)`, tsSchema)
+	} else {
+		err = fmt.Errorf("unknown Timescale major version")
+	}
+	return disableSQL, enableSQL, err
+}
+
+//jobsConn connects to the database at dbURI to change jobs, outside of
+//restoring mode, see above, and returns the schema and major version of
+//TimescaleDB in it
+func jobsConn(ctx context.Context, dbURI string) (conn *pgx.Conn, tsSchema string, tsMajorVersion int, err error) {
+	tsSchema, tsMajorVersion, err = getTargetTimescale(dbURI)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	conn, err = util.GetDBConn(ctx, dbURI)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	_, err = conn.Exec(ctx, "SET timescaledb.restoring TO off")
+	if err != nil {
+		conn.Close(ctx)
+		return nil, "", 0, err
+	}
+	return conn, tsSchema, tsMajorVersion, nil
+}
+
+//disableJobs unschedules the jobs of the database at dbURI and records which
+//ones it unscheduled, see above
+func disableJobs(dbURI string, summary *restoreSummary) error {
+	ctx := context.Background()
+	conn, tsSchema, tsMajorVersion, err := jobsConn(ctx, dbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	disableSQL, _, err := jobSchedulingSQL(tsMajorVersion, tsSchema)
+	if err != nil {
+		return err
+	}
+	recorded, err := recordedDisabledJobs(conn)
+	if err != nil {
+		return err
+	}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	var disabled []int64
+	err = tx.QueryRow(ctx, disableSQL).Scan(&disabled)
+	if err != nil {
+		return err
+	}
+	var database string
+	err = tx.QueryRow(ctx, "SELECT current_database()").Scan(&database)
+	if err != nil {
+		return err
+	}
+	// a resumed restore may have disabled some already
+	jobs := make([]string, 0, len(recorded)+len(disabled))
+	for _, id := range append(recorded, disabled...) {
+		jobs = append(jobs, strconv.FormatInt(id, 10))
+	}
+	if len(jobs) > 0 {
+		_, err = tx.Exec(ctx, fmt.Sprintf("ALTER DATABASE %s SET %s = %s", pgx.Identifier{database}.Sanitize(), disabledJobsSetting, util.QuoteLiteral(strings.Join(jobs, ","))))
+		if err != nil {
+			return fmt.Errorf("failed to record the jobs disabled: %w", err)
+		}
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%sDisabled %d background jobs: %s\n", time.Now().Format("2006/01/02 15:04:05 "), len(disabled), strings.Join(jobs, ", "))
+	if len(jobs) > 0 {
+		summary.warn("background jobs %s were disabled, run ts-restore --enable-jobs=<db-URI> to enable them", strings.Join(jobs, ", "))
+	}
+	return nil
+}
+
+//recordedDisabledJobs returns the jobs recorded as disabled by a restore
+func recordedDisabledJobs(conn *pgx.Conn) ([]int64, error) {
+	var setting *string
+	err := conn.QueryRow(context.Background(), "SELECT current_setting($1, true)", disabledJobsSetting).Scan(&setting)
+	if err != nil || setting == nil || *setting == "" {
+		return nil, err
+	}
+	var jobs []int64
+	for _, field := range strings.Split(*setting, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(field), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid job id %q in %s", field, disabledJobsSetting)
+		}
+		jobs = append(jobs, id)
+	}
+	return jobs, nil
+}
+
+//EnableJobs schedules the jobs disabled by restoring into the database at
+//cf.DbURI with --jobs-disabled again
+func EnableJobs(cf *util.Config) error {
+	ctx := context.Background()
+	conn, tsSchema, tsMajorVersion, err := jobsConn(ctx, cf.DbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	_, enableSQL, err := jobSchedulingSQL(tsMajorVersion, tsSchema)
+	if err != nil {
+		return err
+	}
+	jobs, err := recordedDisabledJobs(conn)
+	if err != nil {
+		return err
+	}
+	if len(jobs) == 0 {
+		fmt.Printf("%sNo background jobs were disabled by a restore, nothing to do\n", time.Now().Format("2006/01/02 15:04:05 "))
+		return nil
+	}
+	restoring, err := isRestoring(cf.DbURI)
+	if err != nil {
+		return err
+	}
+	if restoring {
+		fmt.Printf("%sWARNING: the database is in restoring mode, the jobs won't run until it is taken out of it with ts-restore --finish=<db-URI>\n", time.Now().Format("2006/01/02 15:04:05 "))
+	}
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	// jobs dropped since are gone from the catalog
+	var enabled int
+	err = tx.QueryRow(ctx, enableSQL, jobs).Scan(&enabled)
+	if err != nil {
+		return err
+	}
+	var database string
+	err = tx.QueryRow(ctx, "SELECT current_database()").Scan(&database)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, fmt.Sprintf("ALTER DATABASE %s RESET %s", pgx.Identifier{database}.Sanitize(), disabledJobsSetting))
+	if err != nil {
+		return err
+	}
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%sEnabled %d background jobs\n", time.Now().Format("2006/01/02 15:04:05 "), enabled)
+	return nil
+}
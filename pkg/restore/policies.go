@@ -0,0 +1,148 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// Policies recorded in the dump (see the dump package) are added again with
+// the functions of the TimescaleDB version restored to, and their jobs are
+// given the recorded schedule. TimescaleDB 1.x creates a refresh job for every
+// continuous aggregate itself, so a refresh policy only sets the options of the
+// view there; 1.x has no start offset, it always refreshes everything up to the
+// refresh lag.
+
+//policyValue returns the SQL literal of an interval or integer recorded as JSON
+func policyValue(value json.RawMessage) (string, error) {
+	if len(value) == 0 || string(value) == "null" {
+		return "NULL", nil
+	}
+	var interval string
+	if json.Unmarshal(value, &interval) == nil {
+		return fmt.Sprintf("'%s'::interval", strings.ReplaceAll(interval, "'", "''")), nil
+	}
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%s is neither an interval nor an integer", value)
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+//optionValue returns an interval or integer recorded as JSON as the text a
+//continuous aggregate option takes
+func optionValue(value json.RawMessage) (string, error) {
+	var interval string
+	if json.Unmarshal(value, &interval) == nil {
+		return interval, nil
+	}
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%s is neither an interval nor an integer", value)
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+//addPolicies adds the policies of the hypertable or continuous aggregate
+//relation, see above
+func addPolicies(conn *pgx.Conn, tsSchema string, tsMajorVersion int, relation string, policies []util.PolicyInfo) error {
+	ctx := context.Background()
+	for _, p := range policies {
+		if tsMajorVersion == 1 && p.Type == "refresh" {
+			err := setRefreshOptions(conn, relation, p)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		var add string
+		args := []interface{}{relation}
+		switch p.Type {
+		case "retention", "compression":
+			after, err := policyValue(p.After)
+			if err != nil {
+				return err
+			}
+			function, argument := "add_retention_policy", "drop_after"
+			if p.Type == "compression" {
+				function, argument = "add_compression_policy", "compress_after"
+			}
+			if tsMajorVersion == 1 {
+				function, argument = "add_drop_chunks_policy", "older_than"
+				if p.Type == "compression" {
+					function = "add_compress_chunks_policy"
+				}
+			}
+			add = fmt.Sprintf("SELECT %s.%s($1::regclass, %s => %s)", tsSchema, function, argument, after)
+		case "reorder":
+			add = fmt.Sprintf("SELECT %s.add_reorder_policy($1::regclass, $2::name)", tsSchema)
+			args = append(args, p.IndexName)
+		case "refresh":
+			start, err := policyValue(p.StartOffset)
+			if err != nil {
+				return err
+			}
+			end, err := policyValue(p.EndOffset)
+			if err != nil {
+				return err
+			}
+			// the schedule is required here, it is set again below
+			add = fmt.Sprintf("SELECT %s.add_continuous_aggregate_policy($1::regclass, start_offset => %s, end_offset => %s, schedule_interval => '1 hour')", tsSchema, start, end)
+		default:
+			return fmt.Errorf("unknown policy type %s", p.Type)
+		}
+		var jobID int64
+		err := conn.QueryRow(ctx, add, args...).Scan(&jobID)
+		if err != nil {
+			return fmt.Errorf("failed to add %s policy: %w", p.Type, err)
+		}
+		if p.ScheduleInterval == "" {
+			continue
+		}
+		alter := fmt.Sprintf("SELECT %s.alter_job($1, schedule_interval => $2::interval)", tsSchema)
+		if tsMajorVersion == 1 {
+			alter = fmt.Sprintf("SELECT %s.alter_job_schedule($1, schedule_interval => $2::interval)", tsSchema)
+		}
+		_, err = conn.Exec(ctx, alter, jobID, p.ScheduleInterval)
+		if err != nil {
+			return fmt.Errorf("failed to schedule %s policy: %w", p.Type, err)
+		}
+	}
+	return nil
+}
+
+//setRefreshOptions configures the refresh job TimescaleDB 1.x created for a
+//continuous aggregate like the recorded refresh policy
+func setRefreshOptions(conn *pgx.Conn, relation string, p util.PolicyInfo) error {
+	var options []string
+	if p.ScheduleInterval != "" {
+		options = append(options, fmt.Sprintf("timescaledb.refresh_interval = '%s'", strings.ReplaceAll(p.ScheduleInterval, "'", "''")))
+	}
+	if len(p.EndOffset) > 0 && string(p.EndOffset) != "null" {
+		lag, err := optionValue(p.EndOffset)
+		if err != nil {
+			return err
+		}
+		options = append(options, fmt.Sprintf("timescaledb.refresh_lag = '%s'", strings.ReplaceAll(lag, "'", "''")))
+	}
+	if len(p.StartOffset) > 0 && string(p.StartOffset) != "null" {
+		fmt.Printf("%sWARNING: TimescaleDB 1.x has no start offset, continuous aggregate %s will be refreshed from the beginning\n", time.Now().Format("2006/01/02 15:04:05 "), relation)
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	_, err := conn.Exec(context.Background(), fmt.Sprintf("ALTER VIEW %s SET (%s)", relation, strings.Join(options, ", ")))
+	if err != nil {
+		return fmt.Errorf("failed to set refresh options: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// Applications mostly query recent data, so a restore can be made useful long
+// before it finishes by restoring the newest chunks first. Once the catalog
+// data is restored, the time dimension slices of the chunks are known, and the
+// data entries of chunks (and of their compressed chunks) are ordered by the
+// end of their slice, newest first, after the regular tables. With a number of
+// recent days, the chunks with data from those days before the dump are
+// restored in a pg_restore run of their own, ahead of the older ones, and
+// their completion is announced and handed to a hook so that applications can
+// start reading while older history keeps loading. Parallel pg_restore picks
+// the order of entries within a run itself, so only the split between runs is
+// guaranteed. Chunks of hypertables whose time dimension isn't a time type are
+// ordered after the others and never count as recent.
+
+// the end of the time dimension slice of each chunk and compressed chunk, and
+// whether the dimension is a time type
+const chunkEndsSQL = `WITH chunk_ends AS (
+		SELECT c.schema_name, c.table_name, c.compressed_chunk_id, max(ds.range_end) AS range_end,
+			bool_and(d.column_type IN ('timestamptz'::regtype, 'timestamp'::regtype, 'date'::regtype)) AS is_time
+		FROM _timescaledb_catalog.chunk c
+		INNER JOIN _timescaledb_catalog.chunk_constraint cc ON cc.chunk_id = c.id
+		INNER JOIN _timescaledb_catalog.dimension_slice ds ON ds.id = cc.dimension_slice_id
+		INNER JOIN _timescaledb_catalog.dimension d ON d.id = ds.dimension_id
+		WHERE d.interval_length IS NOT NULL
+		GROUP BY c.schema_name, c.table_name, c.compressed_chunk_id
+	)
+	SELECT schema_name, table_name, range_end, is_time FROM chunk_ends
+	UNION ALL
+	SELECT z.schema_name, z.table_name, e.range_end, e.is_time
+	FROM _timescaledb_catalog.chunk z INNER JOIN chunk_ends e ON z.id = e.compressed_chunk_id`
+
+//recentSince returns the time recent data starts at, cf.RestoreRecentDays days
+//before the dump was taken, or before now if the dump doesn't record when
+func recentSince(cf *util.Config, tsInfo util.TsInfo) time.Time {
+	ref := time.Now()
+	if tsInfo.Snapshot != nil && !tsInfo.Snapshot.Time.IsZero() {
+		ref = tsInfo.Snapshot.Time
+	}
+	return ref.AddDate(0, 0, -cf.RestoreRecentDays)
+}
+
+//orderRecentFirst orders the data entries of chunks newest first, see above
+//and util.OrderRecentFirst
+func orderRecentFirst(dbURI string, entries []util.TOCEntry, since time.Time) ([]util.TOCEntry, []util.TOCEntry, error) {
+	ctx := context.Background()
+	conn, err := util.GetDBConn(ctx, dbURI)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close(ctx)
+	rows, err := conn.Query(ctx, chunkEndsSQL)
+	if err != nil {
+		return nil, nil, err
+	}
+	ends := make(map[string]util.ChunkEnd)
+	for rows.Next() {
+		var schema, table string
+		var end util.ChunkEnd
+		err = rows.Scan(&schema, &table, &end.End, &end.IsTime)
+		if err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		ends[schema+"."+table] = end
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, nil, rows.Err()
+	}
+
+	first, rest := util.OrderRecentFirst(entries, ends, since)
+	return first, rest, nil
+}
+
+//recentDataRestored announces that the data since since is restored, and runs
+//cf.RestoreRecentHook, whose failure is reported in summary
+func recentDataRestored(cf *util.Config, since time.Time, summary *restoreSummary) {
+	summary.note("The data since %s is restored, older data is still being restored", since.Format(time.RFC3339))
+	if cf.RestoreRecentHook == "" {
+		return
+	}
+	hook := exec.Command(cf.RestoreRecentHook)
+	hook.Env = append(os.Environ(), fmt.Sprintf("TS_RESTORE_RECENT_SINCE=%s", since.Format(time.RFC3339)))
+	hook.Stdout = os.Stdout
+	hook.Stderr = os.Stderr
+	err := hook.Run()
+	if err != nil {
+		summary.warn("the recent data hook %s failed: %v", cf.RestoreRecentHook, err)
+	}
+}
+
+//checkRecentResume makes sure a resumed restore splits its data the way the
+//restore it resumes did, so no entry is restored in both data phases
+func checkRecentResume(cf *util.Config, state *restoreState) error {
+	recentBegan := state.isDone(phaseRecentData) || state.interrupted(phaseRecentData)
+	dataBegan := state.isDone(phaseData) || state.interrupted(phaseData)
+	if recentBegan && cf.RestoreRecentDays == 0 {
+		return errors.New("the restore being resumed restored recent data first, resume it with the same --recent-days")
+	}
+	if dataBegan && !recentBegan && cf.RestoreRecentDays > 0 {
+		return errors.New("the restore being resumed did not restore recent data first, resume it without --recent-days")
+	}
+	return nil
+}
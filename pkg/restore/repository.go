@@ -0,0 +1,44 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/timescale/timescaledb-backup/pkg/store"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+//pgDumpDirFor returns the pgdump directory to restore from for the dump in
+//dumpDir. For dumps stored in a repository it is put back together from the
+//repository first and cleanup removes it again, otherwise it is the dump's own
+//pgdump directory and cleanup does nothing.
+func pgDumpDirFor(cf *util.Config, dumpDir string, tsInfo util.TsInfo) (pgDumpDir string, cleanup func(), err error) {
+	pgDumpDir = filepath.Join(dumpDir, util.PgDumpDirName)
+	cleanup = func() {}
+	if len(tsInfo.StoredFiles) == 0 {
+		return pgDumpDir, cleanup, nil
+	}
+	repoDir := cf.Repository
+	if repoDir == "" {
+		repoDir = tsInfo.Repository
+	}
+	repo, err := store.Open(repoDir)
+	if err != nil {
+		return pgDumpDir, cleanup, err
+	}
+	if cf.Verbose {
+		fmt.Printf("%sMaterializing dump %s from repository %s\n", time.Now().Format("2006/01/02 15:04:05 "), dumpDir, repo.Dir)
+	}
+	dir, err := repo.Materialize(pgDumpDir, tsInfo.StoredFiles)
+	cleanup = func() { os.RemoveAll(dir) }
+	if err != nil {
+		cleanup()
+		return pgDumpDir, func() {}, fmt.Errorf("failed to materialize dump from repository %s: %w", repo.Dir, err)
+	}
+	return dir, cleanup, nil
+}
@@ -4,30 +4,241 @@
 package restore
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"os/exec"
+	"time"
 
 	"github.com/timescale/timescaledb-backup/pkg/util"
 )
 
 // DoRestore takes a config and performs a pg_restore with the proper wrappings for Timescale
-func DoRestore(cf *util.Config) error {
+func DoRestore(cf *util.Config) (err error) {
 	tsInfo, err := parseInfoFile(cf)
 	if err != nil {
 		return err
 	}
-	err = preRestoreTimescale(cf.DbURI, tsInfo)
+	//Dumps stored in a repository need their pgdump directory put back together
+	pgDumpDir, cleanup, err := pgDumpDirFor(cf, cf.DumpDir, tsInfo)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	cf.PgDumpDir = pgDumpDir
+	warnPartialDump(tsInfo)
+	//Restores of hypertables merge them into a database, which rules these out
+	wholeDatabaseOptions := []struct {
+		set    bool
+		option string
+		hint   string
+	}{
+		{cf.RestoreResume, "--resume", ""},
+		{cf.RestoreCreateDB, "--create-db", ""},
+		{len(cf.RoleMap) > 0, "--role-map", ""},
+		{cf.RestoreJobsDisabled, "--jobs-disabled", ""},
+		{cf.RestoreRefreshCaggs != "", "--refresh-caggs", ", restoring hypertables refreshes their continuous aggregates anyway"},
+		{cf.RestoreVerify != "", "--verify-fingerprints", ""},
+		{cf.RestoreJobRules != "", "--job-rules", ""},
+		{cf.RestoreRecentFirst, "--recent-first", ""},
+	}
+	if len(cf.Hypertables) > 0 || tsInfo.Selective {
+		for _, o := range wholeDatabaseOptions {
+			if o.set {
+				return fmt.Errorf("%s only works for restores of whole databases%s", o.option, o.hint)
+			}
+		}
+	}
+	if cf.RestoreRecentDays > 0 && tsInfo.ParentDumpDir != "" {
+		return errors.New("--recent-days doesn't work with incremental dumps, the data of unchanged recent chunks is restored from their parent dumps last")
+	}
+	//Mistakes in the job rules shouldn't fail the restore at the end
+	var jobRules []util.JobRule
+	if cf.RestoreJobRules != "" {
+		jobRules, err = util.ReadJobRules(cf.RestoreJobRules)
+		if err != nil {
+			return err
+		}
+	}
+	//Don't restore over something that is there already by accident, which is
+	//checked before anything is written. A resumed restore goes on where the
+	//failed one stopped of course, and a database the restore creates is empty.
+	var cleanEntries []util.TOCEntry
+	if !cf.RestoreResume && len(cf.Hypertables) == 0 && !tsInfo.Selective {
+		if cf.RestoreCreateDB {
+			err = checkDatabaseMissing(cf)
+		} else {
+			cleanEntries, err = checkTarget(cf)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	//Roles come first, they may own the database
+	if cf.RestoreGlobals {
+		err = restoreGlobals(cf, tsInfo, cf.DbURI)
+		if err != nil {
+			return err
+		}
+	}
+	//A resumed restore created the database already
+	if cf.RestoreCreateDB && !cf.RestoreResume {
+		err = createDatabase(cf, tsInfo)
+		if err != nil {
+			return err
+		}
+	}
+	//Single hypertables are picked out of the dump and merged into the database
+	if len(cf.Hypertables) > 0 {
+		return restoreHypertables(cf, tsInfo)
+	}
+	//Selective dumps are merged into the database rather than restored over it
+	if tsInfo.Selective {
+		return mergeSelectiveDump(cf, tsInfo)
+	}
+	if len(cleanEntries) > 0 {
+		err = cleanTarget(cf, cleanEntries)
+		if err != nil {
+			return err
+		}
+	}
+	//Source roles that don't exist are stood in for until the restore is done
+	err = prepareRoleMap(cf)
+	if err != nil {
+		return err
+	}
+	//Progress is recorded so that a failed restore can be resumed
+	state, err := openRestoreState(cf, tsInfo)
+	if err != nil {
+		return err
+	}
+	defer state.close()
+	summary := newRestoreSummary()
+	defer summary.print()
+	err = summary.timePhase(phasePreRestore, func() error {
+		if state.isDone(phasePreRestore) {
+			return enterRestoringMode(cf.DbURI, tsInfo.TsSchema)
+		}
+		return state.runPhase(phasePreRestore, func() error {
+			return preRestoreTimescale(cf.DbURI, tsInfo)
+		})
+	})
 	if err != nil {
 		return err
 	}
 
-	defer postRestoreTimescale(cf.DbURI, tsInfo)
+	err = restoreDatabase(cf, tsInfo, nil, state, summary)
+	//Planner statistics aren't restored
+	if err == nil && cf.RestoreAnalyze {
+		err = summary.timePhase(phaseAnalyze, func() error {
+			return state.runPhase(phaseAnalyze, func() error {
+				return analyzeTables(cf, summary)
+			})
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to analyze the restored tables: %w", err)
+		}
+	}
+	if err == nil && len(cf.RoleMap) > 0 {
+		err = summary.timePhase(phaseRoleMap, func() error {
+			return state.runPhase(phaseRoleMap, func() error {
+				return applyRoleMap(cf)
+			})
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to map roles: %w", err)
+		}
+	}
+	//Fingerprints are verified before the post restore lets jobs change the data
+	mismatches := 0
+	if err == nil && cf.RestoreVerify != "" {
+		err = summary.timePhase(phaseVerify, func() (err error) {
+			mismatches, err = verifyFingerprints(cf, tsInfo, summary)
+			return err
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to verify fingerprints: %w", err)
+		}
+	}
+	//Jobs have to be changed and disabled before the post restore starts them
+	if err == nil && len(jobRules) > 0 {
+		err = summary.timePhase(phaseJobRules, func() error {
+			return state.runPhase(phaseJobRules, func() error {
+				return applyJobRules(cf.DbURI, jobRules, summary)
+			})
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to apply job rules: %w", err)
+		}
+	}
+	if err == nil && cf.RestoreJobsDisabled {
+		err = summary.timePhase(phaseDisableJobs, func() error {
+			return state.runPhase(phaseDisableJobs, func() error {
+				return disableJobs(cf.DbURI, summary)
+			})
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to disable background jobs: %w", err)
+		}
+	}
+	if err != nil {
+		//Running the post restore now would start background jobs on a half
+		//restored database, so it is left for the resumed restore to do
+		if state != nil {
+			summary.warn("the database was left in restoring mode with background jobs stopped, resume the restore with --resume once the problem is fixed, or run ts-restore --finish=<db-URI> to use the database as it is")
+		} else {
+			summary.warn("the database was left in restoring mode with background jobs stopped, restore it again once the problem is fixed, or run ts-restore --finish=<db-URI> to use the database as it is")
+		}
+		return err
+	}
+	postErr := summary.timePhase(phasePostRestore, func() error {
+		return finishRestoring(cf.DbURI, tsInfo.TsSchema)
+	})
+	if postErr != nil {
+		summary.warn("TimescaleDB post restore failed, the database is still in restoring mode and background jobs are not running, run ts-restore --finish=<db-URI> once the problem is fixed")
+		return fmt.Errorf("TimescaleDB post restore failed: %w", postErr)
+	}
+	//A broken catalog otherwise only shows once inserts fail, it is reported
+	//but doesn't fail the restore, which is done
+	if cf.RestoreCheckCatalog {
+		checkErr := summary.timePhase(phaseCheck, func() error {
+			return checkCatalog(cf.DbURI, summary)
+		})
+		if checkErr != nil {
+			summary.warn("failed to check the TimescaleDB catalog: %s", checkErr)
+		}
+	}
+	if cf.RestoreSettings {
+		err = summary.timePhase(phaseSettings, func() error {
+			return applySettings(cf, tsInfo.Database, summary)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	//The invalidation logs may not be up to date after restoring, or updating
+	if cf.RestoreRefreshCaggs != "" {
+		err = summary.timePhase(phaseRefresh, func() error {
+			return refreshContinuousAggs(cf, tsInfo, summary)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	state.complete()
+	//The restore is done, but its data can't be relied on
+	if mismatches > 0 && cf.RestoreVerify == util.VerifyFail {
+		return fmt.Errorf("the restored data doesn't match the fingerprints of the dump in %d tables or chunks", mismatches)
+	}
+	return nil
+}
+
+//restoreDatabase restores the dump into a database prepared with
+//preRestoreTimescale. If keep is not nil, only the entries of the table of
+//contents it returns true for are restored. Progress is recorded in state,
+//and phases are timed in summary, both may be nil.
+func restoreDatabase(cf *util.Config, tsInfo util.TsInfo, keep func(util.TOCEntry) bool, state *restoreState, summary *restoreSummary) error {
 	restorePath, err := getRestoreVersion()
 	if err != nil {
 		return err
@@ -40,18 +251,17 @@ func DoRestore(cf *util.Config) error {
 	//services in which we don't have superuser access (ie Cloud and Forge).
 
 	//We have to create a table of contents, see note on makeRestoreTOC
-	TOCFile, err := ioutil.TempFile("", "ts_restore_toc")
-	if err != nil {
-		return fmt.Errorf("pg_restore run failed while creating TOC file: %w", err)
-	}
-	defer os.Remove(TOCFile.Name())
-	err = makeRestoreTOC(restorePath, cf.PgDumpDir, TOCFile)
+	entries, err := makeRestoreTOC(restorePath, cf.PgDumpDir, keep)
 	if err != nil {
 		return fmt.Errorf("pg_restore run failed while writing TOC file: %w", err)
 	}
-	err = TOCFile.Close()
+	//The largest items go first so parallel runs don't end on one of them, see util.OrderBySize
+	if cf.RestoreOrderBySize {
+		entries = util.OrderBySize(entries, tsInfo.IndexSizes)
+	}
+	plan, err := planTablespaces(cf, restorePath, cf.PgDumpDir, entries)
 	if err != nil {
-		return fmt.Errorf("pg_restore run failed while closing TOC file: %w", err)
+		return err
 	}
 	//In order to support parallel restores, we have to first do a pre-data
 	//restore, then restore only the data for the _timescaledb_catalog and
@@ -60,45 +270,112 @@ func DoRestore(cf *util.Config) error {
 	//everything else and the post-data (also in parallel, this includes
 	//building indexes and the like so it can be significantly faster that way)
 
-	var baseArgs = []string{fmt.Sprintf("--dbname=%s", cf.DbURI), "--format=directory", fmt.Sprintf("--use-list=%s", TOCFile.Name())}
+	var baseArgs = []string{fmt.Sprintf("--dbname=%s", cf.DbURI), "--format=directory"}
 
 	baseArgs = append(baseArgs, cf.PGRestoreFlags...)
+	baseArgs = append(baseArgs, tablespaceArgs(cf)...)
 	if cf.Verbose {
 		baseArgs = append(baseArgs, "--verbose")
 	}
 	// Now just the pre-data section
-	restore := getRestoreCmd(restorePath, cf.PgDumpDir, baseArgs, "--section=pre-data")
-	err = util.RunCommandAndFilterOutput(restore, os.Stdout, os.Stderr, true)
+	err = summary.timePhase(phasePreData, func() error {
+		return runTrackedRestore(cf, state, phasePreData, restorePath, cf.PgDumpDir, entries, append(baseArgs, "--section=pre-data")...)
+	})
 	if err != nil {
 		return fmt.Errorf("pg_restore run failed in pre-data section: %w", err)
 	}
+	//Tables are moved to mapped tablespaces while they are empty
+	err = plan.placeTables(cf)
+	if err != nil {
+		return err
+	}
 	//Now data for just the _timescaledb_catalog and _timescaledb_config  schemas
-	restore = getRestoreCmd(restorePath, cf.PgDumpDir, baseArgs, "--section=data", "--schema=_timescaledb_catalog", "--schema=_timescaledb_config")
-	err = util.RunCommandAndFilterOutput(restore, os.Stdout, os.Stderr, true)
+	err = summary.timePhase(phaseCatalogData, func() error {
+		return runTrackedRestore(cf, state, phaseCatalogData, restorePath, cf.PgDumpDir, entries, append(baseArgs, "--section=data", "--schema=_timescaledb_catalog", "--schema=_timescaledb_config")...)
+	})
 	if err != nil {
 		return fmt.Errorf("pg_restore run failed while restoring _timescaledb_catalog: %w", err)
 	}
+	err = mapCatalogTablespaces(cf)
+	if err != nil {
+		return fmt.Errorf("failed to map the tablespaces attached to hypertables: %w", err)
+	}
+	//Chunks left out of a time range dump still have their catalog rows
+	err = trimExcludedChunks(cf.DbURI, tsInfo)
+	if err != nil {
+		return fmt.Errorf("pg_restore run failed while removing excluded chunks from the catalog: %w", err)
+	}
 	// now we can add parallel jobs to baseArgs for the rest of the process, if we have them.
 	if cf.Jobs > 0 {
 		baseArgs = append(baseArgs, fmt.Sprintf("--jobs=%d", cf.Jobs))
 	}
+	dataArgs := append(baseArgs, "--section=data", "--exclude-schema=_timescaledb_catalog", "--exclude-schema=_timescaledb_config")
+	//Recent chunks can go ahead of the rest, see recent.go
+	dataEntries := entries
+	if cf.RestoreRecentFirst {
+		err = checkRecentResume(cf, state)
+		if err != nil {
+			return err
+		}
+		var since time.Time
+		if cf.RestoreRecentDays > 0 {
+			since = recentSince(cf, tsInfo)
+		}
+		var recent []util.TOCEntry
+		recent, dataEntries, err = orderRecentFirst(cf.DbURI, entries, since)
+		if err != nil {
+			return fmt.Errorf("failed to order chunks by time: %w", err)
+		}
+		if cf.RestoreRecentDays > 0 {
+			restored := state.isDone(phaseRecentData)
+			err = summary.timePhase(phaseRecentData, func() error {
+				return runTrackedRestore(cf, state, phaseRecentData, restorePath, cf.PgDumpDir, recent, dataArgs...)
+			})
+			if err != nil {
+				return fmt.Errorf("pg_restore run failed while restoring recent data: %w", err)
+			}
+			if !restored {
+				recentDataRestored(cf, since, summary)
+			}
+		} else {
+			dataEntries = recent
+		}
+	}
 	//Now the data for everything else
-	restore = getRestoreCmd(restorePath, cf.PgDumpDir, baseArgs, "--section=data", "--exclude-schema=_timescaledb_catalog", "--exclude-schema=_timescaledb_config")
-	err = util.RunCommandAndFilterOutput(restore, os.Stdout, os.Stderr, true)
+	err = summary.timePhase(phaseData, func() error {
+		return runTrackedRestore(cf, state, phaseData, restorePath, cf.PgDumpDir, dataEntries, dataArgs...)
+	})
 	if err != nil {
 		return fmt.Errorf("pg_restore run failed while restoring user data: %w", err)
 	}
+	//Incremental dumps only contain the data of chunks that changed since their
+	//parent, the rest comes from the parent dumps.
+	if tsInfo.ParentDumpDir != "" {
+		err = summary.timePhase(phaseParentData, func() error {
+			return restoreParentChunkData(cf, restorePath, tsInfo, state)
+		})
+		if err != nil {
+			return fmt.Errorf("pg_restore run failed while restoring incremental chunk data: %w", err)
+		}
+	}
 
 	//Now the full post-data run, which should also be in parallel
-	restore = getRestoreCmd(restorePath, cf.PgDumpDir, baseArgs, "--section=post-data")
-	err = util.RunCommandAndFilterOutput(restore, os.Stdout, os.Stderr, true)
+	err = summary.timePhase(phasePostData, func() error {
+		return runTrackedRestore(cf, state, phasePostData, restorePath, cf.PgDumpDir, entries, append(baseArgs, "--section=post-data")...)
+	})
 	if err != nil {
 		return fmt.Errorf("pg_restore run failed during post-data step: %w", err)
 	}
+	err = plan.placeIndexes(cf)
+	if err != nil {
+		return err
+	}
 
 	//Now perform the extension update if we're doing that.
 	if cf.DoUpdate {
-		err = doUpdate(cf.DbURI)
+		err = summary.timePhase(phaseUpdate, func() error {
+			return doUpdate(cf.DbURI)
+		})
 		if err != nil {
 			return fmt.Errorf("pg_restore run failed while updating extension: %w", err)
 		}
@@ -109,15 +386,16 @@ func DoRestore(cf *util.Config) error {
 
 func getRestoreCmd(restorePath string, dumpDir string, baseArgs []string, addlArgs ...string) *exec.Cmd {
 	restore := exec.Command(restorePath)
-	restore.Env = append(os.Environ()) //may use this to set other environmental vars
+	//the output is parsed to follow the progress, see util.ParseRestoreMessage
+	restore.Env = append(os.Environ(), "LC_ALL=C")
 	restore.Args = append(restore.Args, baseArgs...)
 	restore.Args = append(restore.Args, addlArgs...)
 	restore.Args = append(restore.Args, dumpDir) // the location of the dump has to be the last argument
 	return restore
 }
 
-//makeRestoreTOC creates a filtered table of contents in a temp file to use for
-//the rest of the restore.
+//makeRestoreTOC creates a filtered table of contents to use for the rest of
+//the restore.
 //Some background: In order to support non-superuser restores without errors due
 //to a few objects not having the correct permissions, we first have to create a
 //table of contents (TOC) file and filter out a couple of lines. This TOC will
@@ -131,16 +409,22 @@ func getRestoreCmd(restorePath string, dumpDir string, baseArgs []string, addlAr
 //we cannot distinguish easily between this error and a real error that could
 //have caused real problems, so we just do not perform the restore of the
 //comment.
-func makeRestoreTOC(restorePath string, dumpDir string, TOCFile *os.File) error {
-	restore := exec.Command(restorePath)
-	restore.Args = append(restore.Args, dumpDir)
-	restore.Args = append(restore.Args, "--list")
-	TOCWriter := bufio.NewWriter(TOCFile)
-	err := util.RunCommandAndFilterOutput(restore, TOCWriter, os.Stderr, false, "COMMENT - EXTENSION timescaledb")
+//Entries keep returns false for are filtered out as well, if it is not nil.
+func makeRestoreTOC(restorePath string, dumpDir string, keep func(util.TOCEntry) bool) ([]util.TOCEntry, error) {
+	entries, err := util.ReadTOC(restorePath, dumpDir)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var kept []util.TOCEntry
+	for _, entry := range entries {
+		if entry.Desc == "COMMENT" && entry.Name == "EXTENSION timescaledb" {
+			continue
+		}
+		if keep == nil || keep(entry) {
+			kept = append(kept, entry)
+		}
 	}
-	return TOCWriter.Flush()
+	return kept, nil
 }
 
 func getRestoreVersion() (string, error) {
@@ -158,19 +442,7 @@ func getRestoreVersion() (string, error) {
 }
 
 func parseInfoFile(cf *util.Config) (util.TsInfo, error) {
-	var tsInfo util.TsInfo
-	file, err := os.Open(cf.TsInfoFileName)
-	if err != nil {
-		return tsInfo, fmt.Errorf("failed to open version file: %w", err)
-	}
-	defer file.Close()
-	decoder := json.NewDecoder(file)
-
-	err = decoder.Decode(&tsInfo)
-	if err != nil {
-		return tsInfo, fmt.Errorf("failed to decode tsInfo JSON: %w", err)
-	}
-	return tsInfo, err
+	return util.ReadTsInfo(cf.TsInfoFileName)
 }
 
 func preRestoreTimescale(dbURI string, tsInfo util.TsInfo) error {
@@ -180,6 +452,12 @@ func preRestoreTimescale(dbURI string, tsInfo util.TsInfo) error {
 	if err != nil {
 		return err
 	}
+	return enterRestoringMode(dbURI, tsInfo.TsSchema)
+}
+
+//enterRestoringMode runs the pre-restoring function, which stops background
+//workers and keeps TimescaleDB out of the way of the restore
+func enterRestoringMode(dbURI string, tsSchema string) error {
 	conn, err := util.GetDBConn(context.Background(), dbURI)
 	if err != nil {
 		return err
@@ -187,7 +465,7 @@ func preRestoreTimescale(dbURI string, tsInfo util.TsInfo) error {
 	defer conn.Close(context.Background())
 	// Now run our pre-restoring function
 	var pr bool
-	err = conn.QueryRow(context.Background(), fmt.Sprintf("SELECT %s.timescaledb_pre_restore() ", tsInfo.TsSchema)).Scan(&pr)
+	err = conn.QueryRow(context.Background(), fmt.Sprintf("SELECT %s.timescaledb_pre_restore() ", tsSchema)).Scan(&pr)
 	if err != nil {
 		return err
 	}
@@ -198,7 +476,7 @@ func preRestoreTimescale(dbURI string, tsInfo util.TsInfo) error {
 	return err
 }
 
-func postRestoreTimescale(dbURI string, tsInfo util.TsInfo) error {
+func postRestoreTimescale(dbURI string, tsSchema string) error {
 
 	conn, err := util.GetDBConn(context.Background(), dbURI)
 	if err != nil {
@@ -208,7 +486,7 @@ func postRestoreTimescale(dbURI string, tsInfo util.TsInfo) error {
 
 	// Now run our post-restoring function
 	var pr bool
-	err = conn.QueryRow(context.Background(), fmt.Sprintf("SELECT %s.timescaledb_post_restore() ", tsInfo.TsSchema)).Scan(&pr)
+	err = conn.QueryRow(context.Background(), fmt.Sprintf("SELECT %s.timescaledb_post_restore() ", tsSchema)).Scan(&pr)
 	if err != nil {
 		return err
 	}
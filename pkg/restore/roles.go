@@ -0,0 +1,261 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// Ownership and grants are restored by pg_restore with ALTER ... OWNER TO and
+// GRANT statements naming the roles of the source, which it reads from the
+// binary TOC, so like tablespaces they can't be rewritten on the way in.
+// Instead, source roles that don't exist are created for the duration of the
+// restore, marked as such with a comment naming their oid, so that a role
+// given the same comment by hand isn't taken for one, and once the restore is
+// done:
+//
+//   - everything they own in the database is handed to the mapped roles with
+//     REASSIGN OWNED, which also takes care of ownership restored from
+//     TimescaleDB's own catalog
+//   - the grants and default privileges of the dump that name them are
+//     replayed with the mapped roles in their place
+//   - the owners of TimescaleDB's jobs are mapped
+//   - the temporary roles are dropped, along with their privileges
+//
+// Source roles that exist are left alone apart from losing what they own in
+// the database, their privileges stay.
+
+// marks the roles created for the restore, so that a resumed restore knows
+const temporaryRoleComment = "created by ts-restore for --role-map, dropped once the restore is done"
+
+// TOC entries holding grants
+var grantDescs = map[string]bool{"ACL": true, "DEFAULT ACL": true}
+
+//prepareRoleMap checks that the roles mapped to exist and creates the source
+//roles that don't, see above
+func prepareRoleMap(cf *util.Config) error {
+	if len(cf.RoleMap) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	conn, err := util.GetDBConn(ctx, cf.DbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	for src, dst := range cf.RoleMap {
+		if dst == "" {
+			return fmt.Errorf("role %s has to be mapped to a role", src)
+		}
+		var exists bool
+		err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)", dst).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("role %s that role %s is mapped to does not exist", dst, src)
+		}
+		err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)", src).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if cf.Verbose {
+			fmt.Printf("%sCreating temporary role %s for the restore\n", time.Now().Format("2006/01/02 15:04:05 "), src)
+		}
+		err = createTemporaryRole(conn, src)
+		if err != nil {
+			return fmt.Errorf("failed to create temporary role %s, mapping roles needs the CREATEROLE privilege: %w", src, err)
+		}
+	}
+	return nil
+}
+
+//createTemporaryRole creates the role and marks it as temporary, in one
+//transaction so that it isn't left unmarked
+func createTemporaryRole(conn *pgx.Conn, role string) error {
+	ctx := context.Background()
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, fmt.Sprintf("CREATE ROLE %s NOLOGIN", pgx.Identifier{role}.Sanitize()))
+	if err != nil {
+		return err
+	}
+	var oid uint32
+	err = tx.QueryRow(ctx, "SELECT oid FROM pg_roles WHERE rolname = $1", role).Scan(&oid)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, fmt.Sprintf("COMMENT ON ROLE %s IS %s", pgx.Identifier{role}.Sanitize(), util.QuoteLiteral(temporaryRoleMark(oid))))
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func temporaryRoleMark(oid uint32) string {
+	return fmt.Sprintf("%s (oid %d)", temporaryRoleComment, oid)
+}
+
+//isTemporaryRole tells whether the role was created by createTemporaryRole
+func isTemporaryRole(conn *pgx.Conn, role string) (bool, error) {
+	var oid uint32
+	var comment *string
+	err := conn.QueryRow(context.Background(), "SELECT oid, shobj_description(oid, 'pg_authid') FROM pg_roles WHERE rolname = $1", role).Scan(&oid, &comment)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return comment != nil && *comment == temporaryRoleMark(oid), nil
+}
+
+//applyRoleMap hands what the source roles own and were granted in the
+//restored database to the mapped roles and drops the temporary roles, see
+//above
+func applyRoleMap(cf *util.Config) error {
+	if len(cf.RoleMap) == 0 {
+		return nil
+	}
+	restorePath, err := exec.LookPath("pg_restore")
+	if err != nil {
+		return errors.New("could not find pg_restore")
+	}
+	grants, err := mappedGrants(cf, restorePath)
+	if err != nil {
+		return fmt.Errorf("failed to read the grants of the dump: %w", err)
+	}
+
+	ctx := context.Background()
+	conn, err := util.GetDBConn(ctx, cf.DbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	for src, dst := range cf.RoleMap {
+		if cf.Verbose {
+			fmt.Printf("%sHanding objects of role %s to role %s\n", time.Now().Format("2006/01/02 15:04:05 "), src, dst)
+		}
+		// REASSIGN OWNED reassigns databases and tablespaces as well, which
+		// are none of our business
+		var shared []string
+		err = conn.QueryRow(ctx, `SELECT coalesce(array_agg(stmnt), '{}') FROM (
+			SELECT format('ALTER DATABASE %I OWNER TO %I', d.datname, r.rolname) stmnt FROM pg_database d INNER JOIN pg_roles r ON r.oid = d.datdba WHERE r.rolname = $1
+			UNION ALL SELECT format('ALTER TABLESPACE %I OWNER TO %I', t.spcname, r.rolname) FROM pg_tablespace t INNER JOIN pg_roles r ON r.oid = t.spcowner WHERE r.rolname = $1) s`,
+			src).Scan(&shared)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Exec(ctx, fmt.Sprintf("REASSIGN OWNED BY %s TO %s", pgx.Identifier{src}.Sanitize(), pgx.Identifier{dst}.Sanitize()))
+		if err != nil {
+			return fmt.Errorf("failed to hand objects of role %s to role %s, the user restoring has to be a member of both: %w", src, dst, err)
+		}
+		for _, stmnt := range shared {
+			_, err = conn.Exec(ctx, stmnt)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, stmnt := range grants {
+		_, err = conn.Exec(ctx, stmnt)
+		if err != nil {
+			return fmt.Errorf("failed to grant privileges to mapped role: %w, in statement: %s", err, stmnt)
+		}
+	}
+	err = mapJobOwners(conn, cf.RoleMap)
+	if err != nil {
+		return fmt.Errorf("failed to map the owners of jobs: %w", err)
+	}
+	for src := range cf.RoleMap {
+		temporary, err := isTemporaryRole(conn, src)
+		if err != nil {
+			return err
+		}
+		if !temporary {
+			continue
+		}
+		_, err = conn.Exec(ctx, fmt.Sprintf("DROP OWNED BY %s", pgx.Identifier{src}.Sanitize()))
+		if err == nil {
+			_, err = conn.Exec(ctx, fmt.Sprintf("DROP ROLE %s", pgx.Identifier{src}.Sanitize()))
+		}
+		if err != nil {
+			fmt.Printf("%sWARNING: failed to drop temporary role %s, drop it manually: %s\n", time.Now().Format("2006/01/02 15:04:05 "), src, err)
+		}
+	}
+	return nil
+}
+
+//mappedGrants returns the grants and default privileges of the dump with the
+//mapped roles in place of the source roles, if they name any. They are all
+//replayed, which changes nothing for those that don't name them, as they may
+//depend on the session authorization set by the statements before them.
+func mappedGrants(cf *util.Config, restorePath string) ([]string, error) {
+	entries, err := makeRestoreTOC(restorePath, cf.PgDumpDir, func(entry util.TOCEntry) bool {
+		return grantDescs[entry.Desc]
+	})
+	if err != nil || len(entries) == 0 {
+		return nil, err
+	}
+	TOCFile, err := writeTOCFile(entries)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(TOCFile)
+	var script bytes.Buffer
+	restore := getRestoreCmd(restorePath, cf.PgDumpDir, []string{"--format=directory", "--file=-", fmt.Sprintf("--use-list=%s", TOCFile)})
+	restore.Stdout = &script
+	restore.Stderr = os.Stderr
+	err = restore.Run()
+	if err != nil {
+		return nil, err
+	}
+	var grants []string
+	mapped := false
+	for _, stmnt := range util.SplitStatements(script.String()) {
+		grant := util.MapRoles(stmnt, cf.RoleMap)
+		mapped = mapped || grant != stmnt
+		grants = append(grants, grant)
+	}
+	if !mapped {
+		return nil, nil
+	}
+	return grants, nil
+}
+
+//mapJobOwners maps the owners of TimescaleDB's jobs, which only have owners of
+//their own from TimescaleDB 2 on
+func mapJobOwners(conn *pgx.Conn, roleMap util.Mapping) error {
+	ctx := context.Background()
+	var hasOwner bool
+	err := conn.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_attribute
+		WHERE attrelid = to_regclass('_timescaledb_config.bgw_job') AND attname = 'owner' AND NOT attisdropped)`).Scan(&hasOwner)
+	if err != nil || !hasOwner {
+		return err
+	}
+	for src, dst := range roleMap {
+		// the column is a name in older versions and a regrole in newer ones
+		_, err = conn.Exec(ctx, fmt.Sprintf("UPDATE _timescaledb_config.bgw_job SET owner = %s WHERE owner::text IN (%s, %s)",
+			util.QuoteLiteral(dst), util.QuoteLiteral(src), util.QuoteLiteral(pgx.Identifier{src}.Sanitize())))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
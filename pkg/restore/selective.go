@@ -0,0 +1,471 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// A selective dump holds the definitions of the parent tables of the dumped
+// hypertables and their data, but none of the TimescaleDB catalog (see the
+// dump package). It is restored into a database that may have hypertables of
+// its own: we don't run the pre and post restore functions or recreate the
+// extension, instead each hypertable is created like a user would create it and
+// the data is copied in through the hypertable, letting TimescaleDB create the
+// chunks.
+
+// triggers TimescaleDB creates on hypertables itself, restoring them from the
+// dump would make creating the hypertable fail
+var timescaleTriggers = []string{"ts_insert_blocker", "ts_cagg_invalidation_trigger"}
+
+//mergeSelectiveDump restores a selective dump of hypertables into the database,
+//alongside anything that is already there
+func mergeSelectiveDump(cf *util.Config, tsInfo util.TsInfo) error {
+	return mergeHypertables(cf, tsInfo, func(h util.HypertableInfo) error {
+		return copyHypertableIn(cf.DbURI, h, filepath.Join(cf.DumpDir, h.DataFile))
+	}, nil)
+}
+
+//mergeHypertables creates the hypertables of tsInfo from the parent table
+//definitions in cf.PgDumpDir, fills them using copyData and then restores
+//their compression, continuous aggregates and policies. afterPostData, if not nil, runs
+//once the post-data section is restored.
+func mergeHypertables(cf *util.Config, tsInfo util.TsInfo, copyData func(util.HypertableInfo) error, afterPostData func(restorePath string) error) error {
+	restorePath, err := getRestoreVersion()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	createdExtension, err := ensureTimescale(cf.DbURI, tsInfo)
+	if err != nil {
+		return err
+	}
+	tsSchema, tsMajorVersion, err := getTargetTimescale(cf.DbURI)
+	if err != nil {
+		return err
+	}
+	err = prepareMergeTargets(cf.DbURI, tsInfo.Hypertables)
+	if err != nil {
+		return err
+	}
+
+	entries, err := util.ReadTOC(restorePath, cf.PgDumpDir)
+	if err != nil {
+		return err
+	}
+	entries = filterTimescaleTriggers(entries)
+	TOCFile, err := writeTOCFile(entries)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(TOCFile)
+	plan, err := planTablespaces(cf, restorePath, cf.PgDumpDir, entries)
+	if err != nil {
+		return err
+	}
+
+	var baseArgs = []string{fmt.Sprintf("--dbname=%s", cf.DbURI), "--format=directory", fmt.Sprintf("--use-list=%s", TOCFile)}
+	baseArgs = append(baseArgs, cf.PGRestoreFlags...)
+	baseArgs = append(baseArgs, tablespaceArgs(cf)...)
+	if cf.Verbose {
+		baseArgs = append(baseArgs, "--verbose")
+	}
+	restore := getRestoreCmd(restorePath, cf.PgDumpDir, baseArgs, "--section=pre-data")
+	err = util.RunCommandAndFilterOutput(restore, os.Stdout, os.Stderr, true)
+	if err != nil {
+		return fmt.Errorf("pg_restore run failed in pre-data section: %w", err)
+	}
+	err = plan.placeTables(cf)
+	if err != nil {
+		return err
+	}
+
+	conn, err := util.GetDBConn(ctx, cf.DbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	for _, h := range tsInfo.Hypertables {
+		h.Tablespaces = mapTablespaces(cf.TablespaceMap, h.Tablespaces)
+		err = createHypertable(conn, tsSchema, h)
+		if err != nil {
+			return fmt.Errorf("failed to create hypertable %s: %w", h.QualifiedName(), err)
+		}
+	}
+
+	// sequences and the like, the parent tables themselves are empty
+	restore = getRestoreCmd(restorePath, cf.PgDumpDir, baseArgs, "--section=data")
+	err = util.RunCommandAndFilterOutput(restore, os.Stdout, os.Stderr, true)
+	if err != nil {
+		return fmt.Errorf("pg_restore run failed in data section: %w", err)
+	}
+	err = parallelOverHypertables(cf, tsInfo.Hypertables, copyData)
+	if err != nil {
+		return err
+	}
+
+	if cf.Jobs > 0 {
+		baseArgs = append(baseArgs, fmt.Sprintf("--jobs=%d", cf.Jobs))
+	}
+	restore = getRestoreCmd(restorePath, cf.PgDumpDir, baseArgs, "--section=post-data")
+	err = util.RunCommandAndFilterOutput(restore, os.Stdout, os.Stderr, true)
+	if err != nil {
+		return fmt.Errorf("pg_restore run failed during post-data step: %w", err)
+	}
+	err = plan.placeIndexes(cf)
+	if err != nil {
+		return err
+	}
+	if afterPostData != nil {
+		err = afterPostData(restorePath)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, h := range tsInfo.Hypertables {
+		err = restoreCompression(conn, tsSchema, h)
+		if err != nil {
+			return fmt.Errorf("failed to restore compression of hypertable %s: %w", h.QualifiedName(), err)
+		}
+		err = createContinuousAggs(conn, tsSchema, tsMajorVersion, h)
+		if err != nil {
+			return fmt.Errorf("failed to create continuous aggregates of hypertable %s: %w", h.QualifiedName(), err)
+		}
+		err = addPolicies(conn, tsSchema, tsMajorVersion, h.QualifiedName(), h.Policies)
+		if err != nil {
+			return fmt.Errorf("failed to add policies of hypertable %s: %w", h.QualifiedName(), err)
+		}
+		for _, ca := range h.ContinuousAggs {
+			err = addPolicies(conn, tsSchema, tsMajorVersion, ca.QualifiedName(), ca.Policies)
+			if err != nil {
+				return fmt.Errorf("failed to add policies of continuous aggregate %s: %w", ca.QualifiedName(), err)
+			}
+		}
+	}
+
+	if createdExtension && cf.DoUpdate {
+		err = doUpdate(cf.DbURI)
+		if err != nil {
+			return fmt.Errorf("pg_restore run failed while updating extension: %w", err)
+		}
+	}
+	return nil
+}
+
+//ensureTimescale creates the extension at the dumped version if the database
+//doesn't have it yet, and warns if it has it at a different version.
+func ensureTimescale(dbURI string, tsInfo util.TsInfo) (created bool, err error) {
+	conn, err := util.GetDBConn(context.Background(), dbURI)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close(context.Background())
+	var version string
+	err = conn.QueryRow(context.Background(), "SELECT extversion FROM pg_extension WHERE extname='timescaledb'").Scan(&version)
+	if err == pgx.ErrNoRows {
+		return true, util.CreateTimescaleAtVer(context.Background(), dbURI, tsInfo.TsSchema, tsInfo.TsVersion)
+	}
+	if err != nil {
+		return false, err
+	}
+	if version != tsInfo.TsVersion {
+		fmt.Printf("%sWARNING: dump was taken at TimescaleDB %s, restoring into existing TimescaleDB %s\n", time.Now().Format("2006/01/02 15:04:05 "), tsInfo.TsVersion, version)
+	}
+	return false, nil
+}
+
+func getTargetTimescale(dbURI string) (schema string, majorVersion int, err error) {
+	conn, err := util.GetDBConn(context.Background(), dbURI)
+	if err != nil {
+		return schema, majorVersion, err
+	}
+	defer conn.Close(context.Background())
+	err = conn.QueryRow(context.Background(), `SELECT quote_ident(n.nspname), split_part(e.extversion, '.', 1)::INT
+		FROM pg_extension e INNER JOIN pg_namespace n ON e.extnamespace = n.oid WHERE e.extname='timescaledb'`).Scan(&schema, &majorVersion)
+	if err == pgx.ErrNoRows {
+		return schema, majorVersion, errors.New("TimescaleDB extension not found in the database being restored to")
+	}
+	return schema, majorVersion, err
+}
+
+//prepareMergeTargets makes sure none of the hypertables or their continuous
+//aggregates exist in the database yet, and that the schemas to put them in do
+func prepareMergeTargets(dbURI string, hypertables []util.HypertableInfo) error {
+	conn, err := util.GetDBConn(context.Background(), dbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	for _, h := range hypertables {
+		names := []string{h.QualifiedName()}
+		schemas := []string{h.Schema}
+		for _, ca := range h.ContinuousAggs {
+			names = append(names, ca.QualifiedName())
+			schemas = append(schemas, ca.Schema)
+		}
+		for _, name := range names {
+			var exists bool
+			err = conn.QueryRow(context.Background(), "SELECT to_regclass($1) IS NOT NULL", name).Scan(&exists)
+			if err != nil {
+				return err
+			}
+			if exists {
+				return fmt.Errorf("%s already exists in the database being restored to, drop or rename it first", name)
+			}
+		}
+		for _, schema := range schemas {
+			_, err = conn.Exec(context.Background(), fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s", pgx.Identifier{schema}.Sanitize()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func filterTimescaleTriggers(entries []util.TOCEntry) []util.TOCEntry {
+	var filtered []util.TOCEntry
+	for _, entry := range entries {
+		if entry.Desc == "TRIGGER" && isTimescaleTrigger(entry.Name) {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	return filtered
+}
+
+// trigger names in the TOC are prefixed with the name of their table
+func isTimescaleTrigger(name string) bool {
+	for _, trigger := range timescaleTriggers {
+		if name == trigger || strings.HasSuffix(name, " "+trigger) {
+			return true
+		}
+	}
+	return false
+}
+
+//writeTOCFile writes entries to a temporary file for use with --use-list and
+//returns its name, the caller is responsible for removing it
+func writeTOCFile(entries []util.TOCEntry) (string, error) {
+	TOCFile, err := ioutil.TempFile("", "ts_restore_toc")
+	if err != nil {
+		return "", fmt.Errorf("failed to create TOC file: %w", err)
+	}
+	err = util.WriteTOC(TOCFile, entries)
+	if err != nil {
+		TOCFile.Close()
+		os.Remove(TOCFile.Name())
+		return "", fmt.Errorf("failed to write TOC file: %w", err)
+	}
+	err = TOCFile.Close()
+	if err != nil {
+		os.Remove(TOCFile.Name())
+		return "", fmt.Errorf("failed to close TOC file: %w", err)
+	}
+	return TOCFile.Name(), nil
+}
+
+func createHypertable(conn *pgx.Conn, tsSchema string, h util.HypertableInfo) error {
+	ctx := context.Background()
+	var timeDim *util.DimensionInfo
+	for i := range h.Dimensions {
+		if h.Dimensions[i].Open {
+			timeDim = &h.Dimensions[i]
+			break
+		}
+	}
+	if timeDim == nil {
+		return errors.New("no time dimension recorded")
+	}
+	// indexes come from the dump, so don't create the default ones
+	_, err := conn.Exec(ctx, fmt.Sprintf("SELECT %s.create_hypertable($1::regclass, $2::name, chunk_time_interval => $3::bigint, create_default_indexes => false)", tsSchema),
+		h.QualifiedName(), timeDim.ColumnName, timeDim.IntervalLength)
+	if err != nil {
+		return err
+	}
+	for i, d := range h.Dimensions {
+		if &h.Dimensions[i] == timeDim {
+			continue
+		}
+		if d.Open {
+			_, err = conn.Exec(ctx, fmt.Sprintf("SELECT %s.add_dimension($1::regclass, $2::name, chunk_time_interval => $3::bigint)", tsSchema),
+				h.QualifiedName(), d.ColumnName, d.IntervalLength)
+		} else if d.PartitioningFunc != "" {
+			_, err = conn.Exec(ctx, fmt.Sprintf("SELECT %s.add_dimension($1::regclass, $2::name, number_partitions => $3::int, partitioning_func => $4::regproc)", tsSchema),
+				h.QualifiedName(), d.ColumnName, d.NumSlices, d.PartitioningFunc)
+		} else {
+			_, err = conn.Exec(ctx, fmt.Sprintf("SELECT %s.add_dimension($1::regclass, $2::name, number_partitions => $3::int)", tsSchema),
+				h.QualifiedName(), d.ColumnName, d.NumSlices)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to add dimension %s: %w", d.ColumnName, err)
+		}
+	}
+	for _, tablespace := range h.Tablespaces {
+		_, err = conn.Exec(ctx, fmt.Sprintf("SELECT %s.attach_tablespace($1::name, $2::regclass, if_not_attached => true)", tsSchema), tablespace, h.QualifiedName())
+		if err != nil {
+			return fmt.Errorf("failed to attach tablespace %s: %w", tablespace, err)
+		}
+	}
+	return nil
+}
+
+//parallelOverHypertables runs f for each hypertable, up to cf.Jobs at a time,
+//and returns the first error encountered
+func parallelOverHypertables(cf *util.Config, hypertables []util.HypertableInfo, f func(util.HypertableInfo) error) error {
+	jobs := cf.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	sem := make(chan bool, jobs)
+	errs := make(chan error, len(hypertables))
+	var wg sync.WaitGroup
+	for _, h := range hypertables {
+		wg.Add(1)
+		go func(h util.HypertableInfo) {
+			defer wg.Done()
+			sem <- true
+			defer func() { <-sem }()
+			if cf.Verbose {
+				fmt.Printf("%sRestoring data of hypertable %s\n", time.Now().Format("2006/01/02 15:04:05 "), h.QualifiedName())
+			}
+			err := f(h)
+			if err != nil {
+				errs <- fmt.Errorf("failed to restore data of hypertable %s: %w", h.QualifiedName(), err)
+			}
+		}(h)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		return err
+	}
+	return nil
+}
+
+func copyHypertableIn(dbURI string, h util.HypertableInfo, fileName string) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+	return copyIntoHypertable(dbURI, h, gz)
+}
+
+func copyIntoHypertable(dbURI string, h util.HypertableInfo, data io.Reader) error {
+	conn, err := util.GetDBConn(context.Background(), dbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	_, err = conn.PgConn().CopyFrom(context.Background(), data, fmt.Sprintf("COPY %s%s FROM STDIN", h.QualifiedName(), h.ColumnList()))
+	return err
+}
+
+// chunks of a hypertable whose time slice lies within a range
+const chunksInRangeSQL = `SELECT format('%I.%I', c.schema_name, c.table_name)
+	FROM _timescaledb_catalog.chunk c
+	INNER JOIN _timescaledb_catalog.hypertable h ON h.id = c.hypertable_id
+	INNER JOIN _timescaledb_catalog.chunk_constraint cc ON cc.chunk_id = c.id
+	INNER JOIN _timescaledb_catalog.dimension_slice ds ON ds.id = cc.dimension_slice_id
+	INNER JOIN _timescaledb_catalog.dimension d ON d.id = ds.dimension_id
+	WHERE h.schema_name = $1 AND h.table_name = $2 AND d.column_name = $3
+	AND ds.range_start >= $4 AND ds.range_end <= $5 AND c.compressed_chunk_id IS NULL`
+
+//restoreCompression enables compression with the dumped settings and
+//compresses the chunks covering the time ranges that were compressed when
+//the dump was taken
+func restoreCompression(conn *pgx.Conn, tsSchema string, h util.HypertableInfo) error {
+	if !h.Compressed {
+		return nil
+	}
+	ctx := context.Background()
+	options := []string{"timescaledb.compress"}
+	if h.CompressSegmentBy != "" {
+		options = append(options, fmt.Sprintf("timescaledb.compress_segmentby = '%s'", strings.ReplaceAll(h.CompressSegmentBy, "'", "''")))
+	}
+	if h.CompressOrderBy != "" {
+		options = append(options, fmt.Sprintf("timescaledb.compress_orderby = '%s'", strings.ReplaceAll(h.CompressOrderBy, "'", "''")))
+	}
+	_, err := conn.Exec(ctx, fmt.Sprintf("ALTER TABLE %s SET (%s)", h.QualifiedName(), strings.Join(options, ", ")))
+	if err != nil {
+		return err
+	}
+	var timeColumn string
+	for _, d := range h.Dimensions {
+		if d.Open {
+			timeColumn = d.ColumnName
+			break
+		}
+	}
+	for _, r := range h.CompressedRanges {
+		rows, err := conn.Query(ctx, chunksInRangeSQL, h.Schema, h.Table, timeColumn, r.Start, r.End)
+		if err != nil {
+			return err
+		}
+		var chunks []string
+		for rows.Next() {
+			var chunk string
+			if err = rows.Scan(&chunk); err != nil {
+				rows.Close()
+				return err
+			}
+			chunks = append(chunks, chunk)
+		}
+		rows.Close()
+		for _, chunk := range chunks {
+			_, err = conn.Exec(ctx, fmt.Sprintf("SELECT %s.compress_chunk($1::regclass)", tsSchema), chunk)
+			if err != nil {
+				return fmt.Errorf("failed to compress chunk %s: %w", chunk, err)
+			}
+		}
+	}
+	return nil
+}
+
+//createContinuousAggs recreates the continuous aggregates of a hypertable from
+//their definitions and materializes them, using the syntax of the TimescaleDB
+//version installed in the database being restored to
+func createContinuousAggs(conn *pgx.Conn, tsSchema string, tsMajorVersion int, h util.HypertableInfo) error {
+	ctx := context.Background()
+	for _, ca := range h.ContinuousAggs {
+		definition := strings.TrimRight(strings.TrimSpace(ca.Definition), ";")
+		var create, refresh string
+		if tsMajorVersion == 1 {
+			create = fmt.Sprintf("CREATE VIEW %s WITH (timescaledb.continuous, timescaledb.materialized_only = %t) AS %s", ca.QualifiedName(), ca.MaterializedOnly, definition)
+			refresh = fmt.Sprintf("REFRESH MATERIALIZED VIEW %s", ca.QualifiedName())
+		} else {
+			create = fmt.Sprintf("CREATE MATERIALIZED VIEW %s WITH (timescaledb.continuous, timescaledb.materialized_only = %t) AS %s WITH NO DATA", ca.QualifiedName(), ca.MaterializedOnly, definition)
+			refresh = fmt.Sprintf("CALL %s.refresh_continuous_aggregate('%s', NULL, NULL)", tsSchema, strings.ReplaceAll(ca.QualifiedName(), "'", "''"))
+		}
+		_, err := conn.Exec(ctx, create)
+		if err != nil {
+			return fmt.Errorf("failed to create continuous aggregate %s: %w", ca.QualifiedName(), err)
+		}
+		_, err = conn.Exec(ctx, refresh)
+		if err != nil {
+			return fmt.Errorf("failed to refresh continuous aggregate %s: %w", ca.QualifiedName(), err)
+		}
+	}
+	return nil
+}
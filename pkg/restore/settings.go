@@ -0,0 +1,88 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+//applySettings sets the settings of the dumped database, and of roles in it,
+//on the database restored to. It runs once TimescaleDB is out of restoring
+//mode, settings such as default_transaction_read_only would get in the way of
+//the restore. Settings that fail are reported and skipped, the restore is done
+//by now.
+func applySettings(cf *util.Config, db *util.DatabaseInfo, summary *restoreSummary) error {
+	if db == nil || len(db.Settings) == 0 && len(db.RoleSettings) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	conn, err := util.GetDBConn(ctx, cf.DbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	var name string
+	err = conn.QueryRow(ctx, "SELECT current_database()").Scan(&name)
+	if err != nil {
+		return err
+	}
+	database := pgx.Identifier{name}.Sanitize()
+	applied := 0
+	for _, setting := range db.Settings {
+		if applySetting(conn, "ALTER DATABASE "+database, setting, summary) {
+			applied++
+		}
+	}
+	for _, s := range db.RoleSettings {
+		role := s.Role
+		if mapped, ok := cf.RoleMap[role]; ok {
+			role = mapped
+		}
+		var exists bool
+		err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)", role).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			summary.warn("skipped the settings of role %s in the database, the role does not exist", role)
+			continue
+		}
+		for _, setting := range s.Settings {
+			if applySetting(conn, fmt.Sprintf("ALTER ROLE %s IN DATABASE %s", pgx.Identifier{role}.Sanitize(), database), setting, summary) {
+				applied++
+			}
+		}
+	}
+	if cf.Verbose {
+		fmt.Printf("%sApplied %d database and role settings\n", time.Now().Format("2006/01/02 15:04:05 "), applied)
+	}
+	return nil
+}
+
+//applySetting runs alter SET setting and reports whether it succeeded
+func applySetting(conn *pgx.Conn, alter string, setting string, summary *restoreSummary) bool {
+	name, _, err := util.SplitSetting(setting)
+	if err != nil {
+		summary.warn("skipped setting: %s", err)
+		return false
+	}
+	// restoring mode and disabled jobs are managed by the restore itself
+	if name == "timescaledb.restoring" || name == disabledJobsSetting {
+		return false
+	}
+	clause, err := util.SetClause(setting)
+	if err == nil {
+		_, err = conn.Exec(context.Background(), alter+" SET "+clause)
+	}
+	if err != nil {
+		summary.warn("failed to apply setting, %s SET %s: %s", alter, setting, err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,505 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// The progress of a restore is recorded in a state file, so that a restore that
+// fails after hours in the data phase can be resumed rather than started over.
+// The file is a log of JSON events, one per line, appended to as the restore
+// goes: phases beginning and completing, and within the phases run by
+// pg_restore, TOC entries starting and finishing. pg_restore reports those
+// with --verbose, in parallel mode by dump id ("launching item 3012 ...",
+// "finished item 3012 ..."), otherwise only by name, which is mapped back to
+// the dump id through the TOC. Entries pg_restore reports errors for ("from
+// TOC entry 3012; ...") are never recorded as finished.
+//
+// On resume, completed phases are skipped and the others are restored with a
+// use-list leaving out the entries that finished. Entries that started but did
+// not finish may or may not have made it into the database: tables they were
+// loading data into are emptied first, and indexes, constraints and triggers
+// that exist already are taken as finished. The schema is restored in one go,
+// so a restore that failed while creating it can't be resumed.
+
+// phases of a restore, those run by pg_restore are tracked per TOC entry
+const (
+	phasePreRestore  = "pre-restore"
+	phasePreData     = "pre-data"
+	phaseCatalogData = "catalog-data"
+	phaseRecentData  = "recent-data"
+	phaseData        = "data"
+	phaseParentData  = "parent-data" // followed by the parent dump's directory
+	phasePostData    = "post-data"
+	phaseUpdate      = "update"
+	phaseAnalyze     = "analyze"
+	phaseRoleMap     = "role-map"
+	phaseVerify      = "verify"
+	phaseJobRules    = "job-rules"
+	phaseDisableJobs = "disable-jobs"
+	phasePostRestore = "post-restore"
+	phaseCheck       = "catalog-check"
+	phaseSettings    = "settings"
+	phaseRefresh     = "refresh-caggs"
+)
+
+type stateEvent struct {
+	Event string // dump, begin, done, started or finished
+	Phase string `json:",omitempty"`
+	Entry int    `json:",omitempty"`
+	Dump  string `json:",omitempty"` // identifies the dump being restored, in the first event
+}
+
+//restoreState is the progress of a restore, all of its methods do nothing on
+//a nil restoreState, which is used when progress isn't recorded
+type restoreState struct {
+	path     string
+	dump     string
+	file     *os.File
+	mu       sync.Mutex
+	began    map[string]bool
+	done     map[string]bool
+	started  map[string]map[int]bool
+	finished map[string]map[int]bool
+}
+
+//openRestoreState starts recording the progress of a restore, or loads the
+//progress of the interrupted restore to resume if cf.RestoreResume is set
+func openRestoreState(cf *util.Config, tsInfo util.TsInfo) (*restoreState, error) {
+	s := &restoreState{
+		path:     cf.RestoreStateFile,
+		dump:     cf.DumpDir,
+		began:    make(map[string]bool),
+		done:     make(map[string]bool),
+		started:  make(map[string]map[int]bool),
+		finished: make(map[string]map[int]bool),
+	}
+	if tsInfo.Snapshot != nil {
+		s.dump += "@" + tsInfo.Snapshot.ID
+	}
+	if s.path == "" {
+		s.path = filepath.Join(cf.DumpDir, "restore_state_"+stateFileSuffix(cf.DbURI)+".json")
+	}
+	if cf.RestoreResume {
+		err := s.load()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read restore state %s: %w", s.path, err)
+		}
+		s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("%sResuming restore from state %s\n", time.Now().Format("2006/01/02 15:04:05 "), s.path)
+		return s, nil
+	}
+	var err error
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		// a dump on read only storage shouldn't prevent restoring it
+		fmt.Printf("%sWARNING: failed to create restore state %s, the restore can't be resumed if it fails: %s\n", time.Now().Format("2006/01/02 15:04:05 "), s.path, err)
+		return nil, nil
+	}
+	return s, s.record(stateEvent{Event: "dump", Dump: s.dump})
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// the state file is named after the database, so one dump can be restored into several
+func stateFileSuffix(dbURI string) string {
+	config, err := pgx.ParseConfig(dbURI)
+	if err != nil || config.Database == "" {
+		return "default"
+	}
+	return unsafeFileChars.ReplaceAllString(config.Database, "_")
+}
+
+func (s *restoreState) load() error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	first := true
+	for scanner.Scan() {
+		var event stateEvent
+		err = json.Unmarshal(scanner.Bytes(), &event)
+		if err != nil {
+			// the last line may be cut short if we were killed while writing it
+			continue
+		}
+		if first {
+			if event.Event != "dump" || event.Dump != s.dump {
+				return fmt.Errorf("the state is of a restore of %s, not of this dump", event.Dump)
+			}
+			first = false
+			continue
+		}
+		s.apply(event)
+	}
+	if first {
+		return errors.New("state file is empty")
+	}
+	return scanner.Err()
+}
+
+func (s *restoreState) apply(event stateEvent) {
+	switch event.Event {
+	case "begin":
+		s.began[event.Phase] = true
+	case "done":
+		s.done[event.Phase] = true
+	case "started":
+		if s.started[event.Phase] == nil {
+			s.started[event.Phase] = make(map[int]bool)
+		}
+		s.started[event.Phase][event.Entry] = true
+	case "finished":
+		if s.finished[event.Phase] == nil {
+			s.finished[event.Phase] = make(map[int]bool)
+		}
+		s.finished[event.Phase][event.Entry] = true
+	}
+}
+
+func (s *restoreState) record(event stateEvent) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apply(event)
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = s.file.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to record restore state: %w", err)
+	}
+	return nil
+}
+
+func (s *restoreState) isDone(phase string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.done[phase]
+}
+
+// a phase that began in an earlier run without completing
+func (s *restoreState) interrupted(phase string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.began[phase] && !s.done[phase]
+}
+
+func (s *restoreState) isFinished(phase string, entry int) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.finished[phase][entry]
+}
+
+// entries that started in an earlier run but did not finish
+func (s *restoreState) unfinished(phase string) map[int]bool {
+	unfinished := make(map[int]bool)
+	if s == nil {
+		return unfinished
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for entry := range s.started[phase] {
+		if !s.finished[phase][entry] {
+			unfinished[entry] = true
+		}
+	}
+	return unfinished
+}
+
+//runPhase runs f unless the phase completed in an earlier run
+func (s *restoreState) runPhase(phase string, f func() error) error {
+	if s.isDone(phase) {
+		fmt.Printf("%sSkipping %s, completed before\n", time.Now().Format("2006/01/02 15:04:05 "), phase)
+		return nil
+	}
+	err := s.record(stateEvent{Event: "begin", Phase: phase})
+	if err != nil {
+		return err
+	}
+	err = f()
+	if err != nil {
+		return err
+	}
+	return s.record(stateEvent{Event: "done", Phase: phase})
+}
+
+func (s *restoreState) close() {
+	if s == nil {
+		return
+	}
+	s.file.Close()
+}
+
+//complete removes the state once the restore has completed
+func (s *restoreState) complete() {
+	if s == nil {
+		return
+	}
+	s.file.Close()
+	os.Remove(s.path)
+}
+
+//runTrackedRestore runs pg_restore from pgDumpDir with a use-list of entries,
+//leaving out those that finished in an earlier run, and records the progress
+//of the entries as the phase goes
+func runTrackedRestore(cf *util.Config, state *restoreState, phase string, restorePath string, pgDumpDir string, entries []util.TOCEntry, args ...string) error {
+	resumed := state.interrupted(phase)
+	return state.runPhase(phase, func() error {
+		if resumed {
+			if phase == phasePreData {
+				return errors.New("the restore failed while creating the schema and can't be resumed, please restore into an empty database again")
+			}
+			err := resolveUnfinished(cf.DbURI, state, phase, entries)
+			if err != nil {
+				return fmt.Errorf("failed to clean up after the interrupted restore: %w", err)
+			}
+		}
+		var pending []util.TOCEntry
+		for _, entry := range entries {
+			if !state.isFinished(phase, entry.DumpID) {
+				pending = append(pending, entry)
+			}
+		}
+		TOCFile, err := writeTOCFile(pending)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(TOCFile)
+		args = append([]string{fmt.Sprintf("--use-list=%s", TOCFile)}, args...)
+		if state == nil {
+			return util.RunCommandAndFilterOutput(getRestoreCmd(restorePath, pgDumpDir, args), os.Stdout, os.Stderr, true)
+		}
+
+		progress := newProgressWriter(state, phase, entries, os.Stderr)
+		if !cf.Verbose {
+			// progress is only reported in verbose mode, but the user didn't ask for it
+			args = append(args, "--verbose")
+			progress.quiet = true
+		}
+		for _, arg := range args {
+			if strings.HasPrefix(arg, "--jobs=") && arg != "--jobs=1" {
+				progress.parallel = true
+			}
+		}
+		defer progress.Flush()
+		err = util.RunCommandAndFilterOutput(getRestoreCmd(restorePath, pgDumpDir, args), os.Stdout, progress, true)
+		if err != nil {
+			return err
+		}
+		return progress.finishCurrent()
+	})
+}
+
+//resolveUnfinished deals with the entries of phase that started but did not
+//finish in an earlier run: tables they loaded data into are emptied, indexes,
+//constraints and triggers they created are recorded as finished
+func resolveUnfinished(dbURI string, state *restoreState, phase string, entries []util.TOCEntry) error {
+	unfinished := state.unfinished(phase)
+	if len(unfinished) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	conn, err := util.GetDBConn(ctx, dbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	for _, entry := range entries {
+		if !unfinished[entry.DumpID] {
+			continue
+		}
+		var exists bool
+		table, name := entry.Name, ""
+		if i := strings.Index(entry.Name, " "); i > 0 {
+			table, name = entry.Name[:i], entry.Name[i+1:]
+		}
+		switch entry.Desc {
+		case "TABLE DATA":
+			err = conn.QueryRow(ctx, fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM ONLY %s)", entry.QualifiedName())).Scan(&exists)
+			if err != nil || !exists {
+				break
+			}
+			fmt.Printf("%sRemoving partially restored data of %s\n", time.Now().Format("2006/01/02 15:04:05 "), entry.QualifiedName())
+			if entry.Schema == "_timescaledb_catalog" || entry.Schema == "_timescaledb_config" {
+				// referenced by foreign keys, which TRUNCATE won't have
+				_, err = conn.Exec(ctx, fmt.Sprintf("DELETE FROM ONLY %s", entry.QualifiedName()))
+			} else {
+				_, err = conn.Exec(ctx, fmt.Sprintf("TRUNCATE ONLY %s", entry.QualifiedName()))
+			}
+			exists = false
+		case "INDEX":
+			err = conn.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", entry.QualifiedName()).Scan(&exists)
+		case "CONSTRAINT", "FK CONSTRAINT", "CHECK CONSTRAINT":
+			err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = to_regclass($1) AND conname = $2)",
+				pgx.Identifier{entry.Schema, table}.Sanitize(), name).Scan(&exists)
+		case "TRIGGER":
+			err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_trigger WHERE tgrelid = to_regclass($1) AND tgname = $2)",
+				pgx.Identifier{entry.Schema, table}.Sanitize(), name).Scan(&exists)
+		}
+		if err != nil {
+			return fmt.Errorf("TOC entry %d %s %s: %w", entry.DumpID, entry.Desc, entry.QualifiedName(), err)
+		}
+		if exists {
+			err = state.record(stateEvent{Event: "finished", Phase: phase, Entry: entry.DumpID})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//progressWriter passes the output of pg_restore on and records the progress
+//of TOC entries it reports in the state
+type progressWriter struct {
+	state    *restoreState
+	phase    string
+	out      io.Writer
+	quiet    bool // leave out the progress messages
+	parallel bool
+	byName   map[string]int // TOC entries by how pg_restore names them when not in parallel mode
+	failed   map[int]bool
+	current  int // the entry being restored by the main pg_restore process
+	partial  []byte
+	err      error
+}
+
+func newProgressWriter(state *restoreState, phase string, entries []util.TOCEntry, out io.Writer) *progressWriter {
+	p := &progressWriter{state: state, phase: phase, out: out, byName: make(map[string]int), failed: make(map[int]bool)}
+	for _, entry := range entries {
+		name := entry.Name
+		if entry.Schema != "-" {
+			name = entry.Schema + "." + entry.Name
+		}
+		p.byName[entry.Desc+" "+name] = entry.DumpID
+	}
+	return p
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.partial = append(p.partial, b...)
+	for {
+		i := strings.IndexByte(string(p.partial), '\n')
+		if i < 0 {
+			break
+		}
+		line := string(p.partial[:i+1])
+		p.partial = p.partial[i+1:]
+		if p.track(strings.TrimRight(line, "\n")) && p.quiet {
+			continue
+		}
+		_, err := io.WriteString(p.out, line)
+		if err != nil {
+			return len(b), err
+		}
+	}
+	return len(b), p.err
+}
+
+//Flush writes out what is left of an incomplete last line
+func (p *progressWriter) Flush() {
+	if len(p.partial) > 0 {
+		p.out.Write(p.partial)
+		p.partial = nil
+	}
+}
+
+func (p *progressWriter) started(entry int) {
+	p.setErr(p.state.record(stateEvent{Event: "started", Phase: p.phase, Entry: entry}))
+}
+
+func (p *progressWriter) finished(entry int) {
+	if entry == 0 || p.failed[entry] {
+		return
+	}
+	p.setErr(p.state.record(stateEvent{Event: "finished", Phase: p.phase, Entry: entry}))
+}
+
+func (p *progressWriter) setErr(err error) {
+	if p.err == nil {
+		p.err = err
+	}
+}
+
+//finishCurrent records the entry the main process was restoring as finished,
+//once pg_restore has exited successfully
+func (p *progressWriter) finishCurrent() error {
+	p.finished(p.current)
+	p.current = 0
+	return p.err
+}
+
+// switch the main process over to the next entry
+func (p *progressWriter) next(entry int) {
+	p.finished(p.current)
+	p.current = entry
+	p.started(entry)
+}
+
+//track records the progress reported in a line of pg_restore's output and
+//returns whether the line is an informational message
+func (p *progressWriter) track(line string) bool {
+	m := util.ParseRestoreMessage(line)
+	switch m.Kind {
+	case util.RestoreOutputOther, util.RestoreOutputProblem:
+		return false
+	case util.RestoreOutputFailed:
+		if m.Entry > 0 {
+			p.failed[m.Entry] = true
+		}
+		return false
+	case util.RestoreOutputLaunch:
+		// the main process hands out the remaining entries to the workers
+		p.finished(p.current)
+		p.current = 0
+		if m.Entry > 0 {
+			p.started(m.Entry)
+		}
+	case util.RestoreOutputFinished:
+		p.finished(m.Entry)
+	case util.RestoreOutputProcess:
+		if m.Entry > 0 {
+			p.next(m.Entry)
+		}
+	case util.RestoreOutputNamed:
+		// workers report the names of the entries they restore too
+		if id, ok := p.byName[m.Name]; ok && !p.parallel {
+			p.next(id)
+		}
+	}
+	return true
+}
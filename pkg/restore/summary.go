@@ -0,0 +1,90 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+//restoreSummary collects how long each phase of a restore took and the
+//warnings raised along the way, to print them together once the restore is
+//done. All of its methods do nothing on a nil restoreSummary.
+type restoreSummary struct {
+	mu       sync.Mutex
+	start    time.Time
+	phases   []summaryPhase
+	warnings []string
+	notes    []string
+}
+
+type summaryPhase struct {
+	name     string
+	duration time.Duration
+	failed   bool
+}
+
+func newRestoreSummary() *restoreSummary {
+	return &restoreSummary{start: time.Now()}
+}
+
+//timePhase runs f and records how long it took
+func (s *restoreSummary) timePhase(name string, f func() error) error {
+	start := time.Now()
+	err := f()
+	if s == nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.phases = append(s.phases, summaryPhase{name: name, duration: time.Since(start), failed: err != nil})
+	return err
+}
+
+//warn prints a warning right away and repeats it in the summary
+func (s *restoreSummary) warn(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Printf("%sWARNING: %s\n", time.Now().Format("2006/01/02 15:04:05 "), msg)
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.warnings = append(s.warnings, msg)
+}
+
+//note prints a message right away and repeats it in the summary
+func (s *restoreSummary) note(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Printf("%s%s\n", time.Now().Format("2006/01/02 15:04:05 "), msg)
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notes = append(s.notes, msg)
+}
+
+func (s *restoreSummary) print() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Printf("%sRestore summary, %s in total:\n", time.Now().Format("2006/01/02 15:04:05 "), time.Since(s.start).Round(time.Second))
+	for _, p := range s.phases {
+		status := ""
+		if p.failed {
+			status = " FAILED"
+		}
+		fmt.Printf("    %-20s %10s%s\n", p.name, p.duration.Round(time.Millisecond), status)
+	}
+	for _, n := range s.notes {
+		fmt.Printf("    %s\n", n)
+	}
+	for _, w := range s.warnings {
+		fmt.Printf("    WARNING: %s\n", w)
+	}
+}
@@ -0,0 +1,212 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// Tablespaces are recorded per TOC entry in the dump, and pg_restore sets
+// default_tablespace to them before creating each object, which fails if the
+// tablespace doesn't exist. There is no way to change them short of rewriting
+// the binary TOC, so when tablespaces are mapped the restore runs with
+// --no-tablespaces and places the objects itself: tables right after the
+// schema is created, while they are still empty, and indexes once they are
+// built, which rebuilds them. Objects mapped to the default tablespace stay
+// where --no-tablespaces puts them. The tablespaces TimescaleDB creates new
+// chunks in are mapped in its catalog.
+
+// the index of a constraint, by the schema and the name of its TOC entry, the
+// name of its table and the constraint's name, which may both hold spaces
+const constraintIndexSQL = `SELECT i.relname
+	FROM pg_constraint con
+	INNER JOIN pg_class t ON t.oid = con.conrelid
+	INNER JOIN pg_namespace n ON n.oid = t.relnamespace
+	INNER JOIN pg_class i ON i.oid = con.conindid
+	WHERE n.nspname = $1 AND t.relname || ' ' || con.conname = $2`
+
+//placement is an object to be moved into a tablespace
+type placement struct {
+	kind       string // the kind of relation, as used by ALTER, or CONSTRAINT for the index of one
+	schema     string
+	name       string
+	tablespace string
+}
+
+func (p placement) String() string {
+	return fmt.Sprintf("%s %s", strings.ToLower(p.kind), pgx.Identifier{p.schema, p.name}.Sanitize())
+}
+
+//tablespacePlan lists the tables and indexes of a restore that are placed in a
+//tablespace, it is nil if no tablespaces are mapped
+type tablespacePlan struct {
+	tables  []placement
+	indexes []placement
+}
+
+//mapTablespace returns the tablespace to restore into in place of tablespace,
+//or "" for the default tablespace
+func mapTablespace(tablespaceMap util.Mapping, tablespace string) string {
+	if mapped, ok := tablespaceMap[tablespace]; ok {
+		return mapped
+	}
+	return tablespace
+}
+
+//tablespaceArgs returns the pg_restore arguments needed to map tablespaces
+func tablespaceArgs(cf *util.Config) []string {
+	if len(cf.TablespaceMap) == 0 {
+		return nil
+	}
+	return []string{"--no-tablespaces"}
+}
+
+//planTablespaces finds the tablespaces of the tables and indexes among entries
+//and maps them, from the headers of the script pg_restore writes for them
+func planTablespaces(cf *util.Config, restorePath string, dumpDir string, entries []util.TOCEntry) (*tablespacePlan, error) {
+	if len(cf.TablespaceMap) == 0 {
+		return nil, nil
+	}
+	TOCFile, err := writeTOCFile(entries)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(TOCFile)
+	restore := getRestoreCmd(restorePath, dumpDir, []string{"--format=directory", "--schema-only", "--file=-", fmt.Sprintf("--use-list=%s", TOCFile)})
+	restore.Stderr = os.Stderr
+	script, err := restore.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = restore.Start()
+	if err != nil {
+		return nil, err
+	}
+	plan := &tablespacePlan{}
+	scanner := bufio.NewScanner(script)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		header, ok := util.ParseScriptHeader(scanner.Text())
+		if !ok || header.Tablespace == "" {
+			continue
+		}
+		p := placement{kind: header.Desc, schema: header.Schema, name: header.Name, tablespace: mapTablespace(cf.TablespaceMap, header.Tablespace)}
+		if p.tablespace == "" {
+			continue
+		}
+		switch header.Desc {
+		case "TABLE", "MATERIALIZED VIEW":
+			plan.tables = append(plan.tables, p)
+		case "INDEX", "CONSTRAINT":
+			plan.indexes = append(plan.indexes, p)
+		}
+	}
+	scanErr := scanner.Err()
+	err = restore.Wait()
+	if scanErr != nil {
+		return nil, scanErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the tablespaces of the dump: %w", err)
+	}
+	return plan, nil
+}
+
+//placeTables moves the tables of the plan into their tablespaces
+func (plan *tablespacePlan) placeTables(cf *util.Config) error {
+	if plan == nil {
+		return nil
+	}
+	return place(cf, plan.tables)
+}
+
+//placeIndexes moves the indexes of the plan into their tablespaces
+func (plan *tablespacePlan) placeIndexes(cf *util.Config) error {
+	if plan == nil {
+		return nil
+	}
+	return place(cf, plan.indexes)
+}
+
+func place(cf *util.Config, placements []placement) error {
+	if len(placements) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	conn, err := util.GetDBConn(ctx, cf.DbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	for _, p := range placements {
+		if p.kind == "CONSTRAINT" {
+			// the index of a constraint is named after it, unless it was renamed
+			p.kind = "INDEX"
+			err = conn.QueryRow(ctx, constraintIndexSQL, p.schema, p.name).Scan(&p.name)
+			if err != nil {
+				return fmt.Errorf("failed to find the index of constraint %s: %w", p.name, err)
+			}
+		}
+		if cf.Verbose {
+			fmt.Printf("%sMoving %s to tablespace %s\n", time.Now().Format("2006/01/02 15:04:05 "), p, p.tablespace)
+		}
+		_, err = conn.Exec(ctx, fmt.Sprintf("ALTER %s %s SET TABLESPACE %s", p.kind, pgx.Identifier{p.schema, p.name}.Sanitize(), pgx.Identifier{p.tablespace}.Sanitize()))
+		if err != nil {
+			return fmt.Errorf("failed to move %s to tablespace %s: %w", p, p.tablespace, err)
+		}
+	}
+	return nil
+}
+
+//mapCatalogTablespaces maps the tablespaces attached to hypertables in the
+//TimescaleDB catalog, tablespaces mapped to the default one are detached
+func mapCatalogTablespaces(cf *util.Config) error {
+	if len(cf.TablespaceMap) == 0 {
+		return nil
+	}
+	ctx := context.Background()
+	conn, err := util.GetDBConn(ctx, cf.DbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	for old, to := range cf.TablespaceMap {
+		// a hypertable can only have a tablespace attached once
+		_, err = tx.Exec(ctx, `DELETE FROM _timescaledb_catalog.tablespace t WHERE t.tablespace_name = $1
+			AND ($2 = '' OR EXISTS (SELECT 1 FROM _timescaledb_catalog.tablespace o WHERE o.hypertable_id = t.hypertable_id AND o.tablespace_name = $2))`, old, to)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, "UPDATE _timescaledb_catalog.tablespace SET tablespace_name = $2 WHERE tablespace_name = $1", old, to)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+//mapTablespaces maps a list of tablespaces, leaving out those mapped to the
+//default tablespace
+func mapTablespaces(tablespaceMap util.Mapping, tablespaces []string) []string {
+	var mapped []string
+	for _, tablespace := range tablespaces {
+		if t := mapTablespace(tablespaceMap, tablespace); t != "" {
+			mapped = append(mapped, t)
+		}
+	}
+	return mapped
+}
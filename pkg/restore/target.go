@@ -0,0 +1,273 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// A restore drops and recreates the TimescaleDB extension and expects to create
+// every object in the dump, so restoring into the wrong database can destroy
+// it. Before anything is written, roles included, the target is inspected, and
+// if it holds any user schemas or relations the restore is refused unless
+// --force is given. --clean drops the objects of the dump that exist already,
+// and nothing else, once the roles are restored.
+
+// user relations, leaving out system schemas, TimescaleDB's internal schemas and
+// anything belonging to an extension
+const targetRelationsSQL = `SELECT n.nspname, c.relname, CASE c.relkind WHEN 'v' THEN 'view' WHEN 'm' THEN 'materialized view' WHEN 'f' THEN 'foreign table' ELSE 'table' END
+	FROM pg_class c INNER JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE c.relkind IN ('r', 'p', 'v', 'm', 'f')
+	AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname !~ '^(pg_toast|pg_temp|_timescaledb|timescaledb_)'
+	AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'e')
+	ORDER BY 1, 2`
+
+const targetSchemasSQL = `SELECT n.nspname FROM pg_namespace n
+	WHERE n.nspname NOT IN ('pg_catalog', 'information_schema', 'public') AND n.nspname !~ '^(pg_toast|pg_temp|_timescaledb|timescaledb_)'
+	AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.classid = 'pg_namespace'::regclass AND d.objid = n.oid AND d.deptype = 'e')
+	ORDER BY 1`
+
+const targetHypertablesSQL = `SELECT schema_name, table_name FROM _timescaledb_catalog.hypertable`
+
+// at most this many objects are listed when reporting on the target
+const maxReportedObjects = 20
+
+type targetObject struct {
+	Schema     string
+	Name       string
+	Kind       string
+	Hypertable bool
+	HasData    bool
+}
+
+func (o targetObject) String() string {
+	s := fmt.Sprintf("%s %s", o.Kind, pgx.Identifier{o.Schema, o.Name}.Sanitize())
+	if o.Hypertable {
+		s = "hyper" + s
+	}
+	if o.HasData {
+		s += " (with data)"
+	}
+	return s
+}
+
+//inspectTarget lists the user schemas and relations in the database
+func inspectTarget(dbURI string) (schemas []string, relations []targetObject, err error) {
+	ctx := context.Background()
+	conn, err := util.GetDBConn(ctx, dbURI)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close(ctx)
+
+	rows, err := conn.Query(ctx, targetSchemasSQL)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var schema string
+		if err = rows.Scan(&schema); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		schemas = append(schemas, schema)
+	}
+	rows.Close()
+
+	rows, err = conn.Query(ctx, targetRelationsSQL)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		o := targetObject{}
+		if err = rows.Scan(&o.Schema, &o.Name, &o.Kind); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		relations = append(relations, o)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	hypertables := make(map[string]bool)
+	var hasCatalog bool
+	err = conn.QueryRow(ctx, "SELECT to_regclass('_timescaledb_catalog.hypertable') IS NOT NULL").Scan(&hasCatalog)
+	if err != nil {
+		return nil, nil, err
+	}
+	if hasCatalog {
+		rows, err = conn.Query(ctx, targetHypertablesSQL)
+		if err != nil {
+			return nil, nil, err
+		}
+		for rows.Next() {
+			var schema, table string
+			if err = rows.Scan(&schema, &table); err != nil {
+				rows.Close()
+				return nil, nil, err
+			}
+			hypertables[schema+"."+table] = true
+		}
+		rows.Close()
+	}
+	for i := range relations {
+		o := &relations[i]
+		o.Hypertable = hypertables[o.Schema+"."+o.Name]
+		if o.Kind != "table" {
+			continue
+		}
+		err = conn.QueryRow(ctx, fmt.Sprintf("SELECT EXISTS (SELECT 1 FROM %s)", pgx.Identifier{o.Schema, o.Name}.Sanitize())).Scan(&o.HasData)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return schemas, relations, nil
+}
+
+//checkTarget refuses to restore into a database that isn't empty, unless told
+//to with --force. With --clean it returns the TOC entries whose objects are
+//to be dropped by cleanTarget, it doesn't write anything itself.
+func checkTarget(cf *util.Config) ([]util.TOCEntry, error) {
+	schemas, relations, err := inspectTarget(cf.DbURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect the database being restored to: %w", err)
+	}
+	if len(schemas) == 0 && len(relations) == 0 {
+		return nil, nil
+	}
+	restorePath, err := exec.LookPath("pg_restore")
+	if err != nil {
+		return nil, errors.New("could not find pg_restore")
+	}
+	entries, err := makeRestoreTOC(restorePath, cf.PgDumpDir, nil)
+	if err != nil {
+		return nil, err
+	}
+	inDump := make(map[string]bool)
+	for _, entry := range entries {
+		switch entry.Desc {
+		case "SCHEMA":
+			inDump[entry.Name] = true
+		case "TABLE", "VIEW", "MATERIALIZED VIEW", "FOREIGN TABLE":
+			inDump[entry.Schema+"."+entry.Name] = true
+		}
+	}
+	var clashing, other []string
+	for _, schema := range schemas {
+		if !inDump[schema] {
+			other = append(other, fmt.Sprintf("schema %s", pgx.Identifier{schema}.Sanitize()))
+		}
+	}
+	for _, o := range relations {
+		if inDump[o.Schema+"."+o.Name] {
+			clashing = append(clashing, o.String())
+		} else {
+			other = append(other, o.String())
+		}
+	}
+
+	if len(clashing) > 0 {
+		fmt.Printf("%sThe database being restored to already has %d of the relations in the dump:\n%s", time.Now().Format("2006/01/02 15:04:05 "), len(clashing), listObjects(clashing))
+	}
+	if len(other) > 0 {
+		fmt.Printf("%sThe database being restored to has %d schemas and relations that are not in the dump:\n%s", time.Now().Format("2006/01/02 15:04:05 "), len(other), listObjects(other))
+	}
+	switch {
+	case cf.RestoreClean && (len(other) == 0 || cf.RestoreForce):
+		return entries, nil
+	case cf.RestoreClean:
+		return nil, errors.New("the database being restored to is not empty and --clean only drops the objects in the dump, pass --force as well to restore alongside the other objects")
+	case !cf.RestoreForce:
+		return nil, errors.New("the database being restored to is not empty, check that the database URI is right, pass --clean to drop the objects in the dump before restoring or --force to restore into it anyway")
+	}
+	fmt.Printf("%sWARNING: restoring into a database that is not empty because of --force\n", time.Now().Format("2006/01/02 15:04:05 "))
+	return nil, nil
+}
+
+func listObjects(objects []string) string {
+	var b strings.Builder
+	for i, o := range objects {
+		if i == maxReportedObjects {
+			fmt.Fprintf(&b, "    ... and %d more\n", len(objects)-i)
+			break
+		}
+		fmt.Fprintf(&b, "    %s\n", o)
+	}
+	return b.String()
+}
+
+//cleanTarget drops the objects of the dump that exist in the database. The
+//drop statements are taken from the script pg_restore --clean --if-exists
+//writes, which drops everything before creating anything, and are run in a
+//single transaction, so either all of them are dropped or none.
+func cleanTarget(cf *util.Config, entries []util.TOCEntry) error {
+	restorePath, err := exec.LookPath("pg_restore")
+	if err != nil {
+		return errors.New("could not find pg_restore")
+	}
+	TOCFile, err := writeTOCFile(entries)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(TOCFile)
+	var script bytes.Buffer
+	restore := getRestoreCmd(restorePath, cf.PgDumpDir, []string{"--format=directory", "--clean", "--if-exists", "--schema-only", "--file=-", fmt.Sprintf("--use-list=%s", TOCFile)})
+	restore.Stdout = &script
+	restore.Stderr = os.Stderr
+	err = restore.Run()
+	if err != nil {
+		return fmt.Errorf("failed to get the statements dropping the objects in the dump: %w", err)
+	}
+	var drops strings.Builder
+	scanner := bufio.NewScanner(&script)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		// the first object created ends the drops
+		if strings.HasPrefix(scanner.Text(), "-- Name: ") {
+			break
+		}
+		// the pre restore recreates the extension, in a connection of its own
+		if strings.HasPrefix(scanner.Text(), "DROP EXTENSION IF EXISTS timescaledb;") {
+			continue
+		}
+		drops.WriteString(scanner.Text())
+		drops.WriteString("\n")
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%sDropping the objects in the dump from the database because of --clean\n", time.Now().Format("2006/01/02 15:04:05 "))
+	conn, err := util.GetDBConn(context.Background(), cf.DbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+	_, err = tx.Exec(context.Background(), drops.String())
+	if err == nil {
+		err = tx.Commit(context.Background())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to drop the objects in the dump, nothing was dropped: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package restore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// catalog tables referencing chunks by id, along with the referencing columns.
+// The rows for the chunks themselves need to go last. Not all of these exist in
+// every TimescaleDB version, the ones that don't are skipped.
+var chunkReferences = []struct {
+	table   string
+	columns []string
+}{
+	{"_timescaledb_catalog.compression_chunk_size", []string{"chunk_id", "compressed_chunk_id"}},
+	{"_timescaledb_catalog.chunk_index", []string{"chunk_id"}},
+	{"_timescaledb_catalog.chunk_data_node", []string{"chunk_id"}},
+	{"_timescaledb_config.bgw_policy_chunk_stats", []string{"chunk_id"}},
+	{"_timescaledb_catalog.chunk_constraint", []string{"chunk_id"}},
+	{"_timescaledb_catalog.chunk", []string{"id"}},
+}
+
+func warnPartialDump(tsInfo util.TsInfo) {
+	if tsInfo.TimeRange == nil {
+		return
+	}
+	since, until := "the beginning", "the end"
+	if !tsInfo.TimeRange.Since.IsZero() {
+		since = tsInfo.TimeRange.Since.Format(time.RFC3339)
+	}
+	if !tsInfo.TimeRange.Until.IsZero() {
+		until = tsInfo.TimeRange.Until.Format(time.RFC3339)
+	}
+	fmt.Printf("%sWARNING: this is a partial dump, it only contains chunks with data from %s until %s, %d chunks were left out\n", time.Now().Format("2006/01/02 15:04:05 "), since, until, len(tsInfo.TimeRange.ExcludedChunkIDs))
+}
+
+//trimExcludedChunks removes the catalog rows of chunks that were left out of a
+//time range dump, along with the dimension slices that only they used. It must
+//run after the catalog data has been restored and before the restore finishes,
+//so TimescaleDB never sees chunks without tables. The catalog's own foreign
+//keys are created with the extension, so referencing rows are removed first.
+func trimExcludedChunks(dbURI string, tsInfo util.TsInfo) error {
+	if tsInfo.TimeRange == nil || len(tsInfo.TimeRange.ExcludedChunkIDs) == 0 {
+		return nil
+	}
+	ids := tsInfo.TimeRange.ExcludedChunkIDs
+	conn, err := util.GetDBConn(context.Background(), dbURI)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	tx, err := conn.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.Background())
+
+	var sliceIDs []int64
+	rows, err := tx.Query(context.Background(), "SELECT DISTINCT dimension_slice_id FROM _timescaledb_catalog.chunk_constraint WHERE chunk_id = ANY($1) AND dimension_slice_id IS NOT NULL", ids)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var id int64
+		if err = rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		sliceIDs = append(sliceIDs, id)
+	}
+	rows.Close()
+
+	for _, ref := range chunkReferences {
+		var exists bool
+		err = tx.QueryRow(context.Background(), "SELECT to_regclass($1) IS NOT NULL", ref.table).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		for _, column := range ref.columns {
+			_, err = tx.Exec(context.Background(), fmt.Sprintf("DELETE FROM %s WHERE %s = ANY($1)", ref.table, pgx.Identifier{column}.Sanitize()), ids)
+			if err != nil {
+				return fmt.Errorf("failed to remove excluded chunks from %s: %w", ref.table, err)
+			}
+		}
+	}
+	_, err = tx.Exec(context.Background(), `DELETE FROM _timescaledb_catalog.dimension_slice ds WHERE ds.id = ANY($1)
+		AND NOT EXISTS (SELECT 1 FROM _timescaledb_catalog.chunk_constraint cc WHERE cc.dimension_slice_id = ds.id)`, sliceIDs)
+	if err != nil {
+		return fmt.Errorf("failed to remove unused dimension slices: %w", err)
+	}
+	return tx.Commit(context.Background())
+}
@@ -0,0 +1,106 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// Every dump stored into a repository is registered in <repository>/dumps, by
+// a file holding the path of its dump directory. Prune removes the objects no
+// registered dump references anymore, once the dumps using them have been
+// deleted, and forgets the dumps whose directories are gone. A dump being
+// stored has no manifest yet, so objects stored or used again within the grace
+// period are never removed.
+
+//PruneGracePeriod is how long objects are kept after they were last stored,
+//longer than storing the data files of a dump takes
+const PruneGracePeriod = 24 * time.Hour
+
+//register records the dump in dumpDir as using the repository
+func (s *Store) register(dumpDir string) error {
+	dumpDir, err := filepath.Abs(dumpDir)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256([]byte(dumpDir))
+	return ioutil.WriteFile(filepath.Join(s.Dir, "dumps", hex.EncodeToString(sum[:])), []byte(dumpDir), 0600)
+}
+
+//referencedObjects returns the hashes of the objects referenced by the
+//registered dumps, forgetting the dumps that no longer exist
+func (s *Store) referencedObjects(gracePeriod time.Duration) (map[string]bool, error) {
+	refs, err := ioutil.ReadDir(filepath.Join(s.Dir, "dumps"))
+	if err != nil {
+		return nil, err
+	}
+	referenced := make(map[string]bool)
+	for _, ref := range refs {
+		refPath := filepath.Join(s.Dir, "dumps", ref.Name())
+		content, err := ioutil.ReadFile(refPath)
+		if err != nil {
+			return nil, err
+		}
+		dumpDir := string(content)
+		dirInfo, err := os.Stat(dumpDir)
+		if os.IsNotExist(err) {
+			err = os.Remove(refPath)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		tsInfo, err := util.ReadTsInfo(filepath.Join(dumpDir, util.TsInfoFileName))
+		if err != nil {
+			// a dump being taken, its objects are within the grace period
+			if time.Since(dirInfo.ModTime()) < gracePeriod {
+				continue
+			}
+			return nil, fmt.Errorf("dump %s has no readable manifest, remove its directory to prune the objects only it used: %w", dumpDir, err)
+		}
+		for _, f := range tsInfo.StoredFiles {
+			referenced[f.Hash] = true
+		}
+	}
+	return referenced, nil
+}
+
+//Prune removes the objects that no registered dump references and that were
+//last stored before the grace period, along with temporary files left behind.
+//It returns how many objects were removed and their total size.
+func (s *Store) Prune(gracePeriod time.Duration) (removed int, freed int64, err error) {
+	referenced, err := s.referencedObjects(gracePeriod)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = filepath.Walk(filepath.Join(s.Dir, "objects"), func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || time.Since(info.ModTime()) < gracePeriod {
+			return err
+		}
+		name := info.Name()
+		if !strings.Contains(name, ".tmp") && referenced[name] {
+			return nil
+		}
+		err = os.Remove(path)
+		if err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	return removed, freed, err
+}
@@ -0,0 +1,231 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package store
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// A repository stores the data files of directory format dumps by the SHA-256
+// of their content, so that a file that is identical between backups (as the
+// data of old chunks usually is) is only stored once. A dump taken into a
+// repository keeps everything but its data files in its own dump directory
+// and records the hash of each data file in its TsInfo. Before restoring, the
+// pgdump directory is put back together from the repository in a temporary
+// directory, so the restore itself works exactly as it does for any other dump.
+//
+// Objects live in <repository>/objects/<first two characters of hash>/<hash>,
+// temporary directories for restores in <repository>/tmp so that objects can be
+// hard linked rather than copied. The data files of a dump are only removed
+// from its directory once its manifest, recording where they went, is written.
+// Objects are checked against their hash before they are restored from.
+
+//Store is a content addressed store of dump data files
+type Store struct {
+	Dir string
+}
+
+//Open opens the repository in dir, creating it if it does not exist yet
+func Open(dir string) (*Store, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range []string{"objects", "tmp", "dumps"} {
+		err = os.MkdirAll(filepath.Join(dir, sub), 0700)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create repository %s: %w", dir, err)
+		}
+	}
+	return &Store{Dir: dir}, nil
+}
+
+func (s *Store) objectPath(hash string) string {
+	return filepath.Join(s.Dir, "objects", hash[:2], hash)
+}
+
+//Put stores the content of the file at path, leaving the file itself alone. It
+//returns the hash of the file's content and whether it was new to the store.
+func (s *Store) Put(path string) (hash string, isNew bool, err error) {
+	hash, err = hashFile(path)
+	if err != nil {
+		return hash, false, err
+	}
+	objPath := s.objectPath(hash)
+	// objects are stamped with the time they were last stored, see Prune
+	now := time.Now()
+	if _, err = os.Stat(objPath); err == nil {
+		return hash, false, os.Chtimes(objPath, now, now)
+	}
+	err = os.MkdirAll(filepath.Dir(objPath), 0700)
+	if err != nil {
+		return hash, false, err
+	}
+	// linking is atomic, if another dump stored the same content in the
+	// meantime the object is there and it is just as good
+	err = os.Link(path, objPath)
+	if err == nil || os.IsExist(err) {
+		return hash, err == nil, os.Chtimes(objPath, now, now)
+	}
+	// probably on a different filesystem than the dump, the copy is written
+	// under a temporary name of its own first, so a crash or a concurrent dump
+	// never leaves a partial object behind
+	tmp, err := ioutil.TempFile(filepath.Dir(objPath), hash+".tmp")
+	if err != nil {
+		return hash, false, err
+	}
+	defer os.Remove(tmp.Name())
+	err = copyInto(tmp, path)
+	if err != nil {
+		return hash, false, err
+	}
+	return hash, true, os.Rename(tmp.Name(), objPath)
+}
+
+//StoreDumpFiles stores all data files of the directory format dump in
+//pgDumpDir and returns the record of where they went. The files stay in the
+//dump directory until RemoveStoredFiles is called, which should only happen
+//once the record is safely written. tables maps file names to the name of the
+//table whose data they contain, if known. It also returns how many of the
+//files were not in the store before.
+func (s *Store) StoreDumpFiles(pgDumpDir string, tables map[string]string) ([]util.StoredFile, int, error) {
+	files, err := ioutil.ReadDir(pgDumpDir)
+	if err != nil {
+		return nil, 0, err
+	}
+	err = s.register(filepath.Dir(pgDumpDir))
+	if err != nil {
+		return nil, 0, err
+	}
+	var stored []util.StoredFile
+	var newFiles int
+	for _, f := range files {
+		if f.IsDir() || f.Name() == "toc.dat" {
+			continue
+		}
+		hash, isNew, err := s.Put(filepath.Join(pgDumpDir, f.Name()))
+		if err != nil {
+			return nil, newFiles, fmt.Errorf("failed to store %s: %w", f.Name(), err)
+		}
+		if isNew {
+			newFiles++
+		}
+		stored = append(stored, util.StoredFile{File: f.Name(), Hash: hash, Size: f.Size(), Table: tables[f.Name()]})
+	}
+	return stored, newFiles, nil
+}
+
+//RemoveStoredFiles removes the files stored by StoreDumpFiles from pgDumpDir
+func RemoveStoredFiles(pgDumpDir string, files []util.StoredFile) error {
+	for _, f := range files {
+		err := os.Remove(filepath.Join(pgDumpDir, f.File))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+//Materialize recreates the pgdump directory of a dump stored in the repository
+//in a new temporary directory. Files of the dump directory itself are copied,
+//stored files are linked (or copied if linking is not possible), after
+//checking that their content still has the hash they are stored by. The
+//caller is responsible for removing the returned directory.
+func (s *Store) Materialize(pgDumpDir string, files []util.StoredFile) (string, error) {
+	dir, err := ioutil.TempDir(filepath.Join(s.Dir, "tmp"), "restore")
+	if err != nil {
+		return dir, err
+	}
+	local, err := ioutil.ReadDir(pgDumpDir)
+	if err != nil {
+		return dir, err
+	}
+	for _, f := range local {
+		if f.IsDir() {
+			continue
+		}
+		err = copyFile(filepath.Join(pgDumpDir, f.Name()), filepath.Join(dir, f.Name()))
+		if err != nil {
+			return dir, err
+		}
+	}
+	for _, f := range files {
+		objPath := s.objectPath(f.Hash)
+		err = s.checkObject(f.Hash)
+		if err != nil {
+			return dir, fmt.Errorf("failed to materialize %s: %w", f.File, err)
+		}
+		target := filepath.Join(dir, f.File)
+		err = os.Link(objPath, target)
+		if err != nil {
+			err = copyFile(objPath, target)
+		}
+		if err != nil {
+			return dir, fmt.Errorf("failed to materialize %s from object %s: %w", f.File, f.Hash, err)
+		}
+	}
+	return dir, nil
+}
+
+//checkObject makes sure the object stored by hash exists and has that hash
+func (s *Store) checkObject(hash string) error {
+	actual, err := hashFile(s.objectPath(hash))
+	if err != nil {
+		return fmt.Errorf("object %s is missing: %w", hash, err)
+	}
+	if actual != hash {
+		return fmt.Errorf("object %s is corrupt, its content has hash %s", hash, actual)
+	}
+	return nil
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func copyFile(src string, dst string) error {
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	return copyInto(out, src)
+}
+
+//copyInto copies the content of the file at src into out and closes it
+func copyInto(out *os.File, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	defer in.Close()
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
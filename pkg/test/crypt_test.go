@@ -0,0 +1,53 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ts_crypt_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	otherKeyFile := filepath.Join(dir, "other_key")
+	if err = ioutil.WriteFile(keyFile, []byte("a secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(otherKeyFile, []byte("another secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	plain := []byte("ALTER ROLE app WITH PASSWORD 'SCRAM-SHA-256$4096:...';\n")
+	encrypted, err := util.Encrypt(plain, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(encrypted, []byte("SCRAM")) {
+		t.Error("encrypted data contains the plain text")
+	}
+	decrypted, err := util.Decrypt(encrypted, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, plain) {
+		t.Errorf("decrypted %q, expected %q", decrypted, plain)
+	}
+	if _, err = util.Decrypt(encrypted, otherKeyFile); err == nil {
+		t.Error("decrypting with the wrong key succeeded")
+	}
+	encrypted[len(encrypted)-1] ^= 1
+	if _, err = util.Decrypt(encrypted, keyFile); err == nil {
+		t.Error("decrypting modified data succeeded")
+	}
+}
@@ -0,0 +1,114 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+func TestReadJobRules(t *testing.T) {
+	cases := []struct {
+		desc  string
+		rules string
+		err   string
+		count int
+	}{
+		{
+			desc: "valid",
+			rules: `[{"type": "retention", "disable": true},
+				{"type": "all", "shift": "6 hours"},
+				{"type": "compression", "config": {"compress_after": "30 days"}},
+				{"type": "refresh", "schedule_interval": "1 day"}]`,
+			count: 4,
+		},
+		{
+			desc:  "unknown type",
+			rules: `[{"type": "retention", "disable": true}, {"type": "vacuum", "disable": true}]`,
+			err:   `job rule 2: unknown job type "vacuum"`,
+		},
+		{
+			desc:  "no-op",
+			rules: `[{"type": "reorder"}]`,
+			err:   "job rule 1: the rule does nothing",
+		},
+		{
+			desc:  "not a list",
+			rules: `{"type": "retention", "disable": true}`,
+			err:   "failed to parse job rules",
+		},
+	}
+	for _, c := range cases {
+		f, err := ioutil.TempFile("", "job-rules")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(c.rules)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules, err := util.ReadJobRules(f.Name())
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expected error %q, got %v", c.desc, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.desc, err)
+		} else if len(rules) != c.count {
+			t.Errorf("%s: expected %d rules, got %d", c.desc, c.count, len(rules))
+		}
+	}
+}
+
+func TestCheckJobRules(t *testing.T) {
+	rules := []util.JobRule{
+		{Type: "all", Shift: "1 hour"},
+		{Type: "compression", Config: map[string]json.RawMessage{"compress_after": json.RawMessage(`"30 days"`)}},
+	}
+	err := util.CheckJobRules(rules[:1], 1)
+	if err != nil {
+		t.Errorf("shifting jobs on TimescaleDB 1.x: %v", err)
+	}
+	err = util.CheckJobRules(rules, 1)
+	if err == nil || !strings.Contains(err.Error(), "job rule 2") {
+		t.Errorf("expected setting the config on TimescaleDB 1.x to fail on rule 2, got %v", err)
+	}
+	err = util.CheckJobRules(rules, 2)
+	if err != nil {
+		t.Errorf("setting the config on TimescaleDB 2.x: %v", err)
+	}
+}
+
+func TestJobRuleSQL(t *testing.T) {
+	for _, major := range []int{1, 2} {
+		typeSQL, configSQL, intervalSQL, shiftSQL, disableSQL, err := util.JobRuleSQL(major, "public")
+		if err != nil {
+			t.Fatalf("TimescaleDB %d: %v", major, err)
+		}
+		if typeSQL == "" || intervalSQL == "" || shiftSQL == "" || disableSQL == "" {
+			t.Errorf("TimescaleDB %d: missing statements", major)
+		}
+		if (configSQL != "") != (major == 2) {
+			t.Errorf("TimescaleDB %d: setting the config is only supported on 2, got %q", major, configSQL)
+		}
+		for _, stmnt := range []string{intervalSQL, shiftSQL, disableSQL} {
+			if !strings.Contains(stmnt, "public.alter_job") {
+				t.Errorf("TimescaleDB %d: %q doesn't use the TimescaleDB schema", major, stmnt)
+			}
+		}
+	}
+	_, _, _, _, _, err := util.JobRuleSQL(3, "public")
+	if err == nil {
+		t.Error("expected an error for an unknown major version")
+	}
+}
@@ -0,0 +1,87 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package test
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+func TestNumberRangePattern(t *testing.T) {
+	ranges := [][2]int64{{0, 0}, {1, 9}, {7, 7}, {5, 123}, {10, 99}, {99, 1000}, {120, 4567}, {1000, 1999}, {9998, 10002}, {31, 31000}}
+	for _, r := range ranges {
+		re := regexp.MustCompile("^(" + util.NumberRangePattern(r[0], r[1]) + ")$")
+		for n := int64(0); n <= 40000; n++ {
+			if re.MatchString(strconv.FormatInt(n, 10)) != (n >= r[0] && n <= r[1]) {
+				t.Fatalf("pattern for [%d, %d] is wrong about %d: %s", r[0], r[1], n, re)
+			}
+		}
+		if re.MatchString(fmt.Sprintf("0%d", r[0])) {
+			t.Errorf("pattern for [%d, %d] matches a leading zero", r[0], r[1])
+		}
+	}
+}
+
+// psqlPattern translates a pattern as pg_dump reads it into a regular
+// expression matching schema qualified names
+func psqlPattern(pattern string) *regexp.Regexp {
+	var re strings.Builder
+	quoted := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '"' && quoted && i+1 < len(pattern) && pattern[i+1] == '"':
+			re.WriteString(`"`)
+			i++
+		case c == '"':
+			quoted = !quoted
+		case quoted:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		case c == '.':
+			re.WriteString(`\.`)
+		default:
+			re.WriteByte(c)
+		}
+	}
+	return regexp.MustCompile("^(" + re.String() + ")$")
+}
+
+func TestChunkTablePatterns(t *testing.T) {
+	var chunks []util.ChunkInfo
+	excluded := make(map[int64]bool)
+	// two hypertables with interleaved chunk ids, and a chunk with a name of its own
+	for id := int64(1); id <= 2000; id++ {
+		ht := 1 + id%2
+		chunks = append(chunks, util.ChunkInfo{ID: id, Schema: "_timescaledb_internal", Table: fmt.Sprintf("_hyper_%d_%d_chunk", ht, id)})
+		if id < 1500 && (ht == 1 || id%7 != 0) {
+			excluded[id] = true
+		}
+	}
+	chunks = append(chunks, util.ChunkInfo{ID: 3000, Schema: "My.Schema", Table: `odd "name"`})
+	excluded[3000] = true
+
+	patterns := util.ChunkTablePatterns(chunks, excluded)
+	if len(patterns) > 10 {
+		t.Fatalf("expected a few patterns, got %d", len(patterns))
+	}
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		res = append(res, psqlPattern(p))
+	}
+	for _, c := range chunks {
+		name := c.Schema + "." + c.Table
+		matched := false
+		for _, re := range res {
+			matched = matched || re.MatchString(name)
+		}
+		if matched != excluded[c.ID] {
+			t.Errorf("patterns %q are wrong about chunk %d %s", patterns, c.ID, name)
+		}
+	}
+}
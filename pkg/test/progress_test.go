@@ -0,0 +1,120 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// verbose output of pg_restore --jobs=2 failing on a duplicate key, as printed
+// by PostgreSQL 10 and 11, which share their messages, and by 12 and later
+const (
+	restoreOutput11 = `pg_restore: connecting to database for restore
+pg_restore: processing item 3075 ENCODING ENCODING
+pg_restore: processing item 3076 STDSTRINGS STDSTRINGS
+pg_restore: creating SCHEMA "_timescaledb_cache"
+pg_restore: creating TABLE "public.two_Partitions"
+pg_restore: entering main parallel loop
+pg_restore: launching item 3012 TABLE DATA _hyper_1_1_chunk
+pg_restore: processing data for table "_timescaledb_internal._hyper_1_1_chunk"
+pg_restore: [archiver (db)] Error while PROCESSING TOC:
+pg_restore: [archiver (db)] Error from TOC entry 3012; 0 16423 TABLE DATA _hyper_1_1_chunk postgres
+pg_restore: [archiver (db)] COPY failed for table "_hyper_1_1_chunk": ERROR:  duplicate key value violates unique constraint "1_1_two_Partitions_pkey"
+DETAIL:  Key ("timeCustom", device_id)=(1257894000000000000, dev1) already exists.
+CONTEXT:  COPY _hyper_1_1_chunk, line 2
+pg_restore: finished item 3012 TABLE DATA _hyper_1_1_chunk
+pg_restore: finished main parallel loop
+WARNING: errors ignored on restore: 1`
+
+	restoreOutput12 = `pg_restore: connecting to database for restore
+pg_restore: processing item 3075 ENCODING ENCODING
+pg_restore: processing missed item 3077 SEARCHPATH SEARCHPATH
+pg_restore: creating SCHEMA "_timescaledb_cache"
+pg_restore: creating TABLE "public.two_Partitions"
+pg_restore: entering main parallel loop
+pg_restore: launching item 3012 TABLE DATA _hyper_1_1_chunk
+pg_restore: processing data for table "_timescaledb_internal._hyper_1_1_chunk"
+pg_restore: while PROCESSING TOC:
+pg_restore: from TOC entry 3012; 0 16423 TABLE DATA _hyper_1_1_chunk postgres
+pg_restore: error: COPY failed for table "_hyper_1_1_chunk": ERROR:  duplicate key value violates unique constraint "1_1_two_Partitions_pkey"
+DETAIL:  Key ("timeCustom", device_id)=(1257894000000000000, dev1) already exists.
+CONTEXT:  COPY _hyper_1_1_chunk, line 2
+pg_restore: finished item 3012 TABLE DATA _hyper_1_1_chunk
+pg_restore: finished main parallel loop
+pg_restore: warning: errors ignored on restore: 1`
+)
+
+func TestParseRestoreMessage(t *testing.T) {
+	named := func(name string) util.RestoreMessage {
+		return util.RestoreMessage{Kind: util.RestoreOutputNamed, Name: name}
+	}
+	info := util.RestoreMessage{Kind: util.RestoreOutputInfo}
+	problem := util.RestoreMessage{Kind: util.RestoreOutputProblem}
+	other := util.RestoreMessage{Kind: util.RestoreOutputOther}
+	cases := []struct {
+		desc     string
+		output   string
+		expected []util.RestoreMessage
+	}{
+		{
+			desc:   "pg_restore 10 and 11",
+			output: restoreOutput11,
+			expected: []util.RestoreMessage{
+				info,
+				{Kind: util.RestoreOutputProcess, Entry: 3075},
+				{Kind: util.RestoreOutputProcess, Entry: 3076},
+				named(`SCHEMA _timescaledb_cache`),
+				named(`TABLE public.two_Partitions`),
+				info,
+				{Kind: util.RestoreOutputLaunch, Entry: 3012},
+				named(`TABLE DATA _timescaledb_internal._hyper_1_1_chunk`),
+				problem,
+				{Kind: util.RestoreOutputFailed, Entry: 3012},
+				problem,
+				other,
+				other,
+				{Kind: util.RestoreOutputFinished, Entry: 3012},
+				info,
+				other,
+			},
+		},
+		{
+			desc:   "pg_restore 12 and later",
+			output: restoreOutput12,
+			expected: []util.RestoreMessage{
+				info,
+				{Kind: util.RestoreOutputProcess, Entry: 3075},
+				{Kind: util.RestoreOutputProcess, Entry: 3077},
+				named(`SCHEMA _timescaledb_cache`),
+				named(`TABLE public.two_Partitions`),
+				info,
+				{Kind: util.RestoreOutputLaunch, Entry: 3012},
+				named(`TABLE DATA _timescaledb_internal._hyper_1_1_chunk`),
+				problem,
+				{Kind: util.RestoreOutputFailed, Entry: 3012},
+				problem,
+				other,
+				other,
+				{Kind: util.RestoreOutputFinished, Entry: 3012},
+				info,
+				problem,
+			},
+		},
+	}
+	for _, c := range cases {
+		lines := strings.Split(c.output, "\n")
+		if len(lines) != len(c.expected) {
+			t.Fatalf("%s: %d lines but %d expected messages", c.desc, len(lines), len(c.expected))
+		}
+		for i, line := range lines {
+			m := util.ParseRestoreMessage(line)
+			if m != c.expected[i] {
+				t.Errorf("%s: line %q parsed as %+v, expected %+v", c.desc, line, m, c.expected[i])
+			}
+		}
+	}
+}
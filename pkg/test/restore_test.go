@@ -6,9 +6,15 @@ package test
 import (
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/docker/go-connections/nat"
 	"github.com/jackc/pgconn"
@@ -17,7 +23,9 @@ import (
 	"github.com/testcontainers/testcontainers-go/wait"
 	"github.com/timescale/timescaledb-backup/pkg/dump"
 	"github.com/timescale/timescaledb-backup/pkg/restore"
+	"github.com/timescale/timescaledb-backup/pkg/store"
 	"github.com/timescale/timescaledb-backup/pkg/util"
+	"github.com/timescale/timescaledb-backup/pkg/verify"
 )
 
 type dbInfo struct {
@@ -154,6 +162,7 @@ func TestBackupRestore(t *testing.T) {
 		},
 	}
 	for _, c := range cases {
+		c := c
 		t.Run(c.desc, func(t *testing.T) {
 			t.Parallel()
 			ctx := context.Background()
@@ -182,6 +191,7 @@ func TestBackupRestore(t *testing.T) {
 			dumpConfig.DumpPauseJobs = true
 			dumpConfig.DumpPauseUDAs = true
 			dumpConfig.DumpJobFinishTimeout = 100 //set a lower timeout for testing
+			dumpConfig.DumpFingerprints = true
 			util.CleanConfig(dumpConfig)
 			// corresponding restore config
 
@@ -192,6 +202,7 @@ func TestBackupRestore(t *testing.T) {
 			restoreConfig.Verbose = true                                                   //default settings
 			restoreConfig.Jobs = c.numJobs
 			restoreConfig.DoUpdate = c.doUpdate
+			restoreConfig.RestoreVerify = util.VerifyFail //the restore fails on mismatched fingerprints
 			util.CleanConfig(restoreConfig)
 
 			//make sure we remove the dumpDir at the end no matter what
@@ -200,23 +211,1113 @@ func TestBackupRestore(t *testing.T) {
 			if err != nil {
 				t.Fatal("Failed on restore: ", err)
 			}
+			tsInfo, err := util.ReadTsInfo(dumpConfig.TsInfoFileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tsInfo.Fingerprints) == 0 {
+				t.Fatal("the dump recorded no fingerprints")
+			}
 			err = restore.DoRestore(restoreConfig)
 			if err != nil {
 				t.Fatal("Failed on restore: ", err)
 			}
 			confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"two_Partitions"}, dumpConfig.DbURI, restoreConfig.DbURI)
 			confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"insert_test"}, dumpConfig.DbURI, restoreConfig.DbURI)
+			verifyConfig := &util.Config{VerifySourceURI: dumpConfig.DbURI, VerifyTargetURI: restoreConfig.DbURI, Jobs: c.numJobs}
+			err = verify.DoVerify(verifyConfig)
+			if err != nil {
+				t.Fatal("Failed to verify restore: ", err)
+			}
+			confirmCatalogConsistent(t, restoreConfig.DbURI)
 			confirmCanStillInsert(t, restoreConfig.DbURI)
 		})
 	}
 }
 
-func confirmTablesCongruent(t *testing.T, tableSchema pgx.Identifier, tableName pgx.Identifier, origURI string, restoredURI string) {
+//backupTest is a database set up by setupOrigDB to dump and an empty
+//cluster to restore into, each in a container of its own that is terminated
+//at the end of the test
+type backupTest struct {
+	dumpContainer    testcontainers.Container
+	dumpDb           dbInfo
+	restoreContainer testcontainers.Container
+	restoreDb        dbInfo
+}
+
+//newBackupTest starts the containers of a backupTest from image and sets up
+//the database to dump with TimescaleDB tsVersion
+func newBackupTest(t *testing.T, image string, tsVersion string) *backupTest {
+	ctx := context.Background()
+	b := &backupTest{}
+	var err error
+	b.dumpContainer, b.dumpDb, err = startContainer(ctx, image)
+	if err != nil {
+		t.Fatal("Failed to create dump container ", err)
+	}
+	t.Cleanup(func() { b.dumpContainer.Terminate(ctx) })
+	b.dumpDb.dbName = "dump_test"
+	b.restoreContainer, b.restoreDb, err = startContainer(ctx, image)
+	if err != nil {
+		t.Fatal("Failed to create restore container ", err)
+	}
+	t.Cleanup(func() { b.restoreContainer.Terminate(ctx) })
+	b.restoreDb.dbName = "restore_test"
+	setupOrigDB(t, b.dumpDb, "public", tsVersion)
+	return b
+}
+
+//testConn connects to dbURI for the rest of the test
+func testConn(t *testing.T, dbURI string) *pgx.Conn {
+	conn, err := util.GetDBConn(context.Background(), dbURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close(context.Background()) })
+	return conn
+}
+
+//dumpConn connects to the database to dump
+func (b *backupTest) dumpConn(t *testing.T) *pgx.Conn {
+	return testConn(t, PGConnectURI(b.dumpDb, false))
+}
+
+//restoreConn connects to the database restored to
+func (b *backupTest) restoreConn(t *testing.T) *pgx.Conn {
+	return testConn(t, PGConnectURI(b.restoreDb, false))
+}
+
+//clusterConn connects to the default database of the cluster restored to
+func (b *backupTest) clusterConn(t *testing.T) *pgx.Conn {
+	return testConn(t, PGConnectURI(b.restoreDb, true))
+}
+
+//dump dumps the database to a directory named after name, which is removed at
+//the end of the test, with the config changed by configure if it isn't nil
+func (b *backupTest) dump(t *testing.T, name string, configure func(*util.Config)) *util.Config {
+	cf := &util.Config{}
+	cf.DbURI = PGConnectURI(b.dumpDb, false)
+	cf.DumpDir = fmt.Sprintf("%s.%d.%s", b.dumpDb.dbName, b.dumpDb.port.Int(), name)
+	if configure != nil {
+		configure(cf)
+	}
+	util.CleanConfig(cf)
+	t.Cleanup(func() { os.RemoveAll(cf.DumpDir) })
+	err := dump.DoDump(cf)
+	if err != nil {
+		t.Fatal("Failed on dump: ", err)
+	}
+	return cf
+}
+
+//restoreConfig returns the config restoring the dump of dumpConfig into the
+//database restored to, changed by configure if it isn't nil
+func (b *backupTest) restoreConfig(dumpConfig *util.Config, configure func(*util.Config)) *util.Config {
+	cf := &util.Config{}
+	cf.DbURI = PGConnectURI(b.restoreDb, false)
+	cf.DumpDir = dumpConfig.DumpDir
+	if configure != nil {
+		configure(cf)
+	}
+	util.CleanConfig(cf)
+	return cf
+}
+
+//restore creates the database restored to and restores the dump of
+//dumpConfig into it, with the config changed by configure if it isn't nil
+func (b *backupTest) restore(t *testing.T, dumpConfig *util.Config, configure func(*util.Config)) *util.Config {
+	createTestDB(t, b.restoreDb)
+	cf := b.restoreConfig(dumpConfig, configure)
+	err := restore.DoRestore(cf)
+	if err != nil {
+		t.Fatal("Failed on restore: ", err)
+	}
+	return cf
+}
+
+func TestIncrementalBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	fullConfig := b.dump(t, "full", func(cf *util.Config) {
+		cf.Jobs = 4
+		cf.DumpFingerprints = true
+	})
+
+	// add a row to an existing chunk and one to a new chunk, and update a row in
+	// place without changing the size of its chunk, the other chunks are unchanged
+	conn := b.dumpConn(t)
+	mustExec(t, conn, `INSERT INTO public."insert_test"(tstamp, device_id, series_0, series_1) VALUES
+	('2020-10-04 15:21:08+00', 'dev3', 1.5, 1),
+	('2020-11-04 14:21:08+00', 'dev3', 1.5, 1)`)
+	var sizeBefore, sizeAfter int64
+	var updatedChunk string
+	err := conn.QueryRow(ctx, `SELECT tableoid::regclass::text, pg_table_size(tableoid) FROM public."insert_test" WHERE tstamp = '2020-10-10 14:21:30+00'`).Scan(&updatedChunk, &sizeBefore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustExec(t, conn, `UPDATE public."insert_test" SET series_1 = 9 WHERE tstamp = '2020-10-10 14:21:30+00'`)
+	err = conn.QueryRow(ctx, `SELECT pg_table_size($1::regclass)`, updatedChunk).Scan(&sizeAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizeBefore != sizeAfter {
+		t.Fatalf("the update changed the size of chunk %s, expected it not to", updatedChunk)
+	}
+
+	incConfig := b.dump(t, "inc", func(cf *util.Config) {
+		cf.DumpIncrementalFrom = fullConfig.DumpDir
+		cf.Jobs = 4
+	})
+	tsInfo, err := util.ReadTsInfo(incConfig.TsInfoFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var skipped int
+	for _, c := range tsInfo.Chunks {
+		if !c.Dumped {
+			skipped++
+		}
+		if c.Schema+"."+c.Table == updatedChunk && !c.Dumped {
+			t.Fatalf("Incremental dump skipped chunk %s, which was updated", updatedChunk)
+		}
+	}
+	if skipped == 0 {
+		t.Fatal("Incremental dump did not skip any unchanged chunks")
+	}
+
+	restoreConfig := b.restore(t, incConfig, func(cf *util.Config) {
+		cf.Jobs = 4
+	})
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"two_Partitions"}, incConfig.DbURI, restoreConfig.DbURI)
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"insert_test"}, incConfig.DbURI, restoreConfig.DbURI)
+	confirmCatalogConsistent(t, restoreConfig.DbURI)
+	confirmCanStillInsert(t, restoreConfig.DbURI)
+}
+
+func TestRepositoryBackupRestore(t *testing.T) {
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	repoDir, err := ioutil.TempDir("", "ts_repository")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(repoDir)
+	firstConfig := b.dump(t, "repo1", func(cf *util.Config) {
+		cf.Repository = repoDir
+	})
+	// the second dump shares the data files of all chunks but the changed one
+	mustExec(t, b.dumpConn(t), `INSERT INTO public."insert_test"(tstamp, device_id, series_0, series_1) VALUES ('2020-10-04 15:21:08+00', 'dev3', 1.5, 1)`)
+	secondConfig := b.dump(t, "repo2", func(cf *util.Config) {
+		cf.Repository = repoDir
+	})
+
+	// objects stored within the grace period are never pruned, so they are
+	// made to look older, and the first dump is deleted
+	objects := func() int {
+		count := 0
+		err := filepath.Walk(filepath.Join(repoDir, "objects"), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				count++
+				old := time.Now().Add(-2 * store.PruneGracePeriod)
+				return os.Chtimes(path, old, old)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	before := objects()
+	err = os.RemoveAll(firstConfig.DumpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dump.PruneRepository(&util.Config{Repository: repoDir})
+	if err != nil {
+		t.Fatal("Failed to prune repository: ", err)
+	}
+	after := objects()
+	if after >= before {
+		t.Errorf("expected pruning to remove the objects only the deleted dump used, %d objects before and %d after", before, after)
+	}
+
+	restoreConfig := b.restore(t, secondConfig, nil)
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"two_Partitions"}, secondConfig.DbURI, restoreConfig.DbURI)
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"insert_test"}, secondConfig.DbURI, restoreConfig.DbURI)
+}
+
+func TestResumeRestore(t *testing.T) {
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	// rows of dev2 fail the check while the database restored to has the
+	// setting on, which fails the restore in the middle of the data phase
+	conn := b.dumpConn(t)
+	mustExec(t, conn, `CREATE FUNCTION public.restorable(device TEXT) RETURNS BOOLEAN LANGUAGE sql AS
+		$$ SELECT device <> 'dev2' OR coalesce(current_setting('test.fail_restore', true), '') <> 'on' $$`)
+	mustExec(t, conn, `ALTER TABLE public."insert_test" ADD CONSTRAINT restorable CHECK (public.restorable(device_id))`)
+	dumpConfig := b.dump(t, "resume", nil)
+
+	createTestDB(t, b.restoreDb)
+	mustExec(t, b.clusterConn(t), fmt.Sprintf("ALTER DATABASE %s SET test.fail_restore = 'on'", b.restoreDb.dbName))
+	restoreConfig := b.restoreConfig(dumpConfig, nil)
+	err := restore.DoRestore(restoreConfig)
+	if err == nil {
+		t.Fatal("expected the restore to fail on the rows failing the check")
+	}
+
+	mustExec(t, b.clusterConn(t), fmt.Sprintf("ALTER DATABASE %s RESET test.fail_restore", b.restoreDb.dbName))
+	restoreConfig.RestoreResume = true
+	err = restore.DoRestore(restoreConfig)
+	if err != nil {
+		t.Fatal("Failed to resume restore: ", err)
+	}
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"insert_test"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"two_Partitions"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	confirmCatalogConsistent(t, restoreConfig.DbURI)
+	confirmCanStillInsert(t, restoreConfig.DbURI)
+}
+
+func TestFinishRestore(t *testing.T) {
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	mustExec(t, b.dumpConn(t), `SELECT add_retention_policy('public.insert_test', INTERVAL '200 years')`)
+	dumpConfig := b.dump(t, "finish", nil)
+	restoreConfig := b.restore(t, dumpConfig, nil)
+	// as a restore killed before the post restore would have left it
+	mustExec(t, b.restoreConn(t), `SELECT timescaledb_pre_restore()`)
+
+	finishConfig := &util.Config{DbURI: restoreConfig.DbURI}
+	err := restore.FinishRestore(finishConfig)
+	if err != nil {
+		t.Fatal("Failed to finish restore: ", err)
+	}
+	// settings of the database apply to new connections only
+	conn := b.restoreConn(t)
+	var restoring string
+	err = conn.QueryRow(context.Background(), `SELECT current_setting('timescaledb.restoring')`).Scan(&restoring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restoring != "off" {
+		t.Errorf("expected the database to be out of restoring mode, timescaledb.restoring is %s", restoring)
+	}
+	var scheduled bool
+	err = conn.QueryRow(context.Background(), `SELECT bool_and(scheduled) FROM timescaledb_information.jobs WHERE proc_name = 'policy_retention'`).Scan(&scheduled)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !scheduled {
+		t.Error("expected the retention policy to be scheduled")
+	}
+	// the scheduler of the database is started again by the post restore
+	var schedulers int
+	for i := 0; i < 20 && schedulers == 0; i++ {
+		time.Sleep(500 * time.Millisecond)
+		err = conn.QueryRow(context.Background(), `SELECT count(*) FROM pg_stat_activity
+			WHERE datname = current_database() AND application_name = 'TimescaleDB Background Worker Scheduler'`).Scan(&schedulers)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if schedulers == 0 {
+		t.Error("expected the background worker scheduler to be running")
+	}
+	// there is nothing left to do the second time
+	err = restore.FinishRestore(finishConfig)
+	if err != nil {
+		t.Fatal("Failed to finish restore that was finished: ", err)
+	}
+}
+
+func TestTargetRestore(t *testing.T) {
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	dumpConfig := b.dump(t, "target", nil)
+	createTestDB(t, b.restoreDb)
+	conn := b.restoreConn(t)
+	mustExec(t, conn, `CREATE TABLE public.unrelated (id INT)`)
+	mustExec(t, conn, `INSERT INTO public.unrelated VALUES (1)`)
+	confirmUnrelated := func() {
+		var count int
+		err := conn.QueryRow(context.Background(), `SELECT count(*) FROM public.unrelated`).Scan(&count)
+		if err != nil {
+			t.Fatal("Failed to read the table that isn't in the dump: ", err)
+		}
+		if count != 1 {
+			t.Errorf("expected the table that isn't in the dump to keep its row, it has %d", count)
+		}
+	}
+
+	err := restore.DoRestore(b.restoreConfig(dumpConfig, nil))
+	if err == nil {
+		t.Fatal("expected the restore into a database that isn't empty to fail")
+	}
+	var restored bool
+	err = conn.QueryRow(context.Background(), `SELECT to_regclass('public.insert_test') IS NOT NULL`).Scan(&restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored {
+		t.Error("expected the refused restore not to write anything")
+	}
+	confirmUnrelated()
+
+	restoreConfig := b.restoreConfig(dumpConfig, func(cf *util.Config) {
+		cf.RestoreForce = true
+	})
+	err = restore.DoRestore(restoreConfig)
+	if err != nil {
+		t.Fatal("Failed on restore with --force: ", err)
+	}
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"insert_test"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	confirmUnrelated()
+
+	// a row that isn't in the dump is gone after restoring with --clean, which
+	// needs --force as well to leave the table that isn't in the dump be
+	mustExec(t, b.restoreConn(t), `INSERT INTO public."insert_test"(tstamp, device_id, series_0, series_1) VALUES ('2020-10-04 15:21:08+00', 'dev3', 1.5, 1)`)
+	err = restore.DoRestore(b.restoreConfig(dumpConfig, func(cf *util.Config) {
+		cf.RestoreClean = true
+	}))
+	if err == nil {
+		t.Fatal("expected the restore with --clean alone into a database with other tables to fail")
+	}
+	restoreConfig = b.restoreConfig(dumpConfig, func(cf *util.Config) {
+		cf.RestoreClean = true
+		cf.RestoreForce = true
+	})
+	err = restore.DoRestore(restoreConfig)
+	if err != nil {
+		t.Fatal("Failed on restore with --clean: ", err)
+	}
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"insert_test"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"two_Partitions"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	confirmCatalogConsistent(t, restoreConfig.DbURI)
+	confirmUnrelated()
+}
+
+func TestTimeRangeBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	// of the daily chunks of insert_test only the one of 2020-10-10 is in range,
+	// two_Partitions has integer time and is dumped whole
+	dumpConfig := b.dump(t, "range", func(cf *util.Config) {
+		cf.Jobs = 4
+		cf.DumpSince = "2020-10-09T00:00:00Z"
+		cf.DumpUntil = "2020-10-12T00:00:00Z"
+	})
+	tsInfo, err := util.ReadTsInfo(dumpConfig.TsInfoFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tsInfo.TimeRange == nil || len(tsInfo.TimeRange.ExcludedChunkIDs) != 2 {
+		t.Fatalf("expected the time range dump to leave out 2 chunks, got %v", tsInfo.TimeRange)
+	}
+
+	restoreConfig := b.restore(t, dumpConfig, func(cf *util.Config) {
+		cf.Jobs = 4
+	})
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"two_Partitions"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	confirmRowsCongruent(t, `SELECT * FROM public."insert_test" AS t WHERE tstamp >= '2020-10-09T00:00:00Z' AND tstamp < '2020-10-12T00:00:00Z' ORDER BY t`, dumpConfig.DbURI, restoreConfig.DbURI)
+	conn := b.restoreConn(t)
+	var rows, chunks int
+	err = conn.QueryRow(ctx, `SELECT (SELECT count(*) FROM public."insert_test"), (SELECT count(*) FROM show_chunks('public."insert_test"'))`).Scan(&rows, &chunks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows != 1 || chunks != 1 {
+		t.Fatalf("expected the restore to hold 1 row in 1 chunk of insert_test, got %d rows in %d chunks", rows, chunks)
+	}
+	// the removed chunks left no catalog rows behind, so their time can be inserted into again
+	confirmCatalogConsistent(t, restoreConfig.DbURI)
+	confirmCanStillInsert(t, restoreConfig.DbURI)
+}
+
+func TestAnalyzeRestore(t *testing.T) {
+	ctx := context.Background()
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	mustExec(t, b.dumpConn(t), `CREATE TABLE public."regular_test" AS SELECT i FROM generate_series(1, 10) i`)
+	dumpConfig := b.dump(t, "analyze", nil)
+
+	// of the daily chunks of insert_test the ones of 2020-10-10 and 2020-10-14
+	// are recent, the regular table is analyzed anyway and the hypertable isn't
+	b.restore(t, dumpConfig, func(cf *util.Config) {
+		cf.Jobs = 2
+		cf.RestoreAnalyze = true
+		cf.RestoreAnalyzeSince = "2020-10-09T00:00:00Z"
+	})
+	conn := b.restoreConn(t)
+	// pg_statistic has rows for the columns of analyzed tables only
+	const analyzedSQL = `SELECT count(*) FILTER (WHERE EXISTS (SELECT 1 FROM pg_statistic s WHERE s.starelid = r.oid)), count(*) FROM (%s) r(oid)`
+	cases := []struct {
+		desc     string
+		tables   string
+		analyzed int
+		total    int
+	}{
+		{"recent chunks", `SELECT show_chunks('public."insert_test"', newer_than => '2020-10-09T00:00:00Z'::timestamptz)`, 2, 2},
+		{"old chunks", `SELECT show_chunks('public."insert_test"', older_than => '2020-10-09T00:00:00Z'::timestamptz)`, 0, 1},
+		{"hypertable", `SELECT 'public."insert_test"'::regclass`, 0, 1},
+		{"regular table", `SELECT 'public."regular_test"'::regclass`, 1, 1},
+	}
+	for _, c := range cases {
+		var analyzed, total int
+		err := conn.QueryRow(ctx, fmt.Sprintf(analyzedSQL, c.tables)).Scan(&analyzed, &total)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if analyzed != c.analyzed || total != c.total {
+			t.Errorf("%s: expected %d of %d to be analyzed, got %d of %d", c.desc, c.analyzed, c.total, analyzed, total)
+		}
+	}
+}
+
+func TestOrderBySizeRestore(t *testing.T) {
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	dumpConfig := b.dump(t, "sizes", func(cf *util.Config) {
+		cf.Jobs = 4
+	})
+	tsInfo, err := util.ReadTsInfo(dumpConfig.TsInfoFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tsInfo.IndexSizes) == 0 {
+		t.Fatal("expected the dump to record the sizes of indexes")
+	}
+	restoreConfig := b.restore(t, dumpConfig, func(cf *util.Config) {
+		cf.Jobs = 4
+		cf.RestoreOrderBySize = true
+	})
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"two_Partitions"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"insert_test"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	indexesSQL := `SELECT schemaname, tablename, indexname, indexdef FROM pg_indexes
+		WHERE schemaname IN ('public', '_timescaledb_internal') ORDER BY 1, 2, 3`
+	confirmRowsCongruent(t, indexesSQL, dumpConfig.DbURI, restoreConfig.DbURI)
+	confirmCatalogConsistent(t, restoreConfig.DbURI)
+}
+
+func TestRecentFirstRestore(t *testing.T) {
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	// a chunk of recent data next to the ones of 2020
+	mustExec(t, b.dumpConn(t), `INSERT INTO public."insert_test"(tstamp, device_id, series_0, series_1) VALUES (now() - interval '1 hour', 'dev3', 1.5, 1)`)
+	dumpConfig := b.dump(t, "recent", func(cf *util.Config) {
+		cf.Jobs = 2
+	})
+	tsInfo, err := util.ReadTsInfo(dumpConfig.TsInfoFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a hook recording the start of the recent data it is told is restored
+	hookDir, err := ioutil.TempDir("", "recent_hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(hookDir)
+	sinceFile := filepath.Join(hookDir, "since")
+	hook := filepath.Join(hookDir, "hook")
+	script := fmt.Sprintf("#!/bin/sh\nprintf '%%s\\n' \"$TS_RESTORE_RECENT_SINCE\" >> '%s'\n", sinceFile)
+	err = ioutil.WriteFile(hook, []byte(script), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restoreConfig := b.restore(t, dumpConfig, func(cf *util.Config) {
+		cf.Jobs = 2
+		cf.RestoreRecentDays = 2
+		cf.RestoreRecentHook = hook
+	})
+	if !restoreConfig.RestoreRecentFirst {
+		t.Fatal("expected --recent-days to imply --recent-first")
+	}
+	announced, err := ioutil.ReadFile(sinceFile)
+	if err != nil {
+		t.Fatal("The recent data hook was not run: ", err)
+	}
+	expected := tsInfo.Snapshot.Time.AddDate(0, 0, -2).Format(time.RFC3339) + "\n"
+	if string(announced) != expected {
+		t.Errorf("expected the hook to be run once with TS_RESTORE_RECENT_SINCE=%q, got %q", expected, announced)
+	}
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"two_Partitions"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"insert_test"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	confirmCatalogConsistent(t, restoreConfig.DbURI)
+}
+
+func TestDumpSnapshot(t *testing.T) {
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+
+	// a pg_dump recording its arguments ahead of the real one on the PATH
+	pgDump, err := exec.LookPath("pg_dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapperDir, err := ioutil.TempDir("", "pg_dump_wrapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(wrapperDir)
+	argsFile := filepath.Join(wrapperDir, "args")
+	script := fmt.Sprintf("#!/bin/sh\nprintf '%%s\\n' \"$@\" >> '%s'\nexec '%s' \"$@\"\n", argsFile, pgDump)
+	err = ioutil.WriteFile(filepath.Join(wrapperDir, "pg_dump"), []byte(script), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", wrapperDir+string(os.PathListSeparator)+path)
+	defer os.Setenv("PATH", path)
+
+	dumpConfig := b.dump(t, "snapshot", func(cf *util.Config) {
+		cf.Jobs = 4
+	})
+	tsInfo, err := util.ReadTsInfo(dumpConfig.TsInfoFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tsInfo.Snapshot == nil || tsInfo.Snapshot.ID == "" || tsInfo.Snapshot.LSN == "" || tsInfo.Snapshot.Time.IsZero() {
+		t.Fatalf("expected the dump to record its snapshot, got %+v", tsInfo.Snapshot)
+	}
+	args, err := ioutil.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, arg := range strings.Split(string(args), "\n") {
+		found = found || arg == "--snapshot="+tsInfo.Snapshot.ID
+	}
+	if !found {
+		t.Fatalf("expected pg_dump to be run with --snapshot=%s, got %q", tsInfo.Snapshot.ID, args)
+	}
+}
+
+func TestTablespaceMapRestore(t *testing.T) {
+	ctx := context.Background()
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	createTablespace(t, b.dumpContainer, b.dumpDb, "old_space")
+	createTablespace(t, b.restoreContainer, b.restoreDb, "new_space")
+	conn := b.dumpConn(t)
+	// the index of the constraint is named by a table with a space in its name
+	mustExec(t, conn, `CREATE TABLE public."spaced table" (id INT, CONSTRAINT "spaced table_pkey" PRIMARY KEY (id) USING INDEX TABLESPACE old_space) TABLESPACE old_space`)
+	mustExec(t, conn, `INSERT INTO public."spaced table" VALUES (1), (2)`)
+
+	dumpConfig := b.dump(t, "tablespaces", nil)
+	restoreConfig := b.restore(t, dumpConfig, func(cf *util.Config) {
+		cf.TablespaceMap = util.Mapping{"old_space": "new_space"}
+	})
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"spaced table"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	restoredConn := b.restoreConn(t)
+	for _, relation := range []string{`public."spaced table"`, `public."spaced table_pkey"`} {
+		var tablespace string
+		err := restoredConn.QueryRow(ctx, `SELECT coalesce(t.spcname, '') FROM pg_class c LEFT JOIN pg_tablespace t ON t.oid = c.reltablespace WHERE c.oid = $1::regclass`, relation).Scan(&tablespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tablespace != "new_space" {
+			t.Errorf("expected %s in tablespace new_space, got %q", relation, tablespace)
+		}
+	}
+}
+
+//createTablespace creates a tablespace in a directory of its own in the container
+func createTablespace(t *testing.T, container testcontainers.Container, db dbInfo, name string) {
+	dir := "/var/lib/postgresql/" + name
+	code, err := container.Exec(context.Background(), []string{"sh", "-c", fmt.Sprintf("mkdir -p %s && chown postgres %s", dir, dir)})
+	if err != nil || code != 0 {
+		t.Fatalf("failed to create directory for tablespace %s: %v (exit code %d)", name, err, code)
+	}
+	conn, err := util.GetDBConn(context.Background(), PGConnectURI(db, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(context.Background())
+	mustExec(t, conn, fmt.Sprintf("CREATE TABLESPACE %s LOCATION '%s'", name, dir))
+}
+
+func TestNativeRolesBackupRestore(t *testing.T) {
+	ctx := context.Background()
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	conn := b.dumpConn(t)
+	// an owner, a grantee and the group it is a member of are referenced,
+	// the other role is not
+	mustExec(t, conn, `CREATE ROLE "Table Owner" CREATEDB`)
+	mustExec(t, conn, `COMMENT ON ROLE "Table Owner" IS 'owns; things'`)
+	mustExec(t, conn, `CREATE ROLE readers_group`)
+	mustExec(t, conn, `CREATE ROLE reader LOGIN CONNECTION LIMIT 5`)
+	mustExec(t, conn, `ALTER ROLE reader SET work_mem = '16MB'`)
+	mustExec(t, conn, `GRANT readers_group TO reader WITH ADMIN OPTION`)
+	mustExec(t, conn, `CREATE ROLE unrelated`)
+	mustExec(t, conn, `ALTER TABLE public."insert_test" OWNER TO "Table Owner"`)
+	mustExec(t, conn, `GRANT SELECT ON public."two_Partitions" TO reader`)
+
+	dumpConfig := b.dump(t, "roles", func(cf *util.Config) {
+		cf.DumpRoles = true
+		cf.DumpRolesMethod = util.RolesNative
+	})
+	tsInfo, err := util.ReadTsInfo(dumpConfig.TsInfoFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tsInfo.RolesMethod != util.RolesNative {
+		t.Fatalf("expected the dump to record the native roles method, got %q", tsInfo.RolesMethod)
+	}
+
+	restoreConfig := b.restore(t, dumpConfig, func(cf *util.Config) {
+		cf.RestoreGlobals = true
+	})
+	rolesSQL := `SELECT r.rolname, r.rolcreatedb, r.rolcanlogin, r.rolconnlimit, shobj_description(r.oid, 'pg_authid'),
+		(SELECT s.setconfig FROM pg_db_role_setting s WHERE s.setrole = r.oid AND s.setdatabase = 0),
+		(SELECT array_agg(g.rolname || ' ' || m.admin_option) FROM pg_auth_members m INNER JOIN pg_roles g ON g.oid = m.roleid WHERE m.member = r.oid)
+		FROM pg_roles r WHERE r.rolname IN ('Table Owner', 'readers_group', 'reader') ORDER BY r.rolname`
+	confirmRowsCongruent(t, rolesSQL, dumpConfig.DbURI, restoreConfig.DbURI)
+	ownersSQL := `SELECT c.relname, pg_get_userbyid(c.relowner), c.relacl::text FROM pg_class c
+		WHERE c.relname IN ('insert_test', 'two_Partitions') ORDER BY c.relname`
+	confirmRowsCongruent(t, ownersSQL, dumpConfig.DbURI, restoreConfig.DbURI)
+	restoredConn := b.restoreConn(t)
+	var unrelated bool
+	err = restoredConn.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = 'unrelated')`).Scan(&unrelated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unrelated {
+		t.Error("expected a role the database doesn't refer to not to be dumped")
+	}
+}
+
+func TestRoleMapRestore(t *testing.T) {
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	conn := b.dumpConn(t)
+	mustExec(t, conn, `CREATE ROLE source_owner`)
+	mustExec(t, conn, `CREATE ROLE source_reader`)
+	mustExec(t, conn, `ALTER TABLE public."insert_test" OWNER TO source_owner`)
+	mustExec(t, conn, `GRANT SELECT ON public."insert_test" TO source_reader`)
+	mustExec(t, conn, `SET ROLE source_owner`)
+	mustExec(t, conn, `SELECT add_retention_policy('public.insert_test', INTERVAL '200 years')`)
+	mustExec(t, conn, `RESET ROLE`)
+	dumpConfig := b.dump(t, "rolemap", nil)
+
+	// source_owner is stood in for by a temporary role, source_reader exists
+	// and has the comment of one, but wasn't created by the restore
+	cluster := b.clusterConn(t)
+	mustExec(t, cluster, `CREATE ROLE target_owner`)
+	mustExec(t, cluster, `CREATE ROLE target_reader`)
+	mustExec(t, cluster, `CREATE ROLE source_reader`)
+	mustExec(t, cluster, `COMMENT ON ROLE source_reader IS 'created by ts-restore for --role-map, dropped once the restore is done'`)
+	restoreConfig := b.restore(t, dumpConfig, func(cf *util.Config) {
+		cf.RoleMap = util.Mapping{"source_owner": "target_owner", "source_reader": "target_reader"}
+	})
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"insert_test"}, dumpConfig.DbURI, restoreConfig.DbURI)
+
+	var owner string
+	var canRead bool
+	err := b.restoreConn(t).QueryRow(context.Background(), `SELECT pg_get_userbyid(relowner), has_table_privilege('target_reader', oid, 'SELECT')
+		FROM pg_class WHERE oid = 'public.insert_test'::regclass`).Scan(&owner, &canRead)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != "target_owner" {
+		t.Errorf("expected the hypertable to be owned by the mapped role, it is owned by %s", owner)
+	}
+	if !canRead {
+		t.Error("expected the mapped role to be granted the privileges of the source role")
+	}
+	var jobOwners []string
+	err = b.restoreConn(t).QueryRow(context.Background(), `SELECT array_agg(DISTINCT owner::text) FROM timescaledb_information.jobs WHERE proc_name = 'policy_retention'`).Scan(&jobOwners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(jobOwners, []string{"target_owner"}) {
+		t.Errorf("expected the job to be owned by the mapped role, it is owned by %v", jobOwners)
+	}
+	var roles []string
+	err = cluster.QueryRow(context.Background(), `SELECT coalesce(array_agg(rolname::text ORDER BY rolname), '{}') FROM pg_roles WHERE rolname LIKE 'source\_%'`).Scan(&roles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(roles, []string{"source_reader"}) {
+		t.Errorf("expected only the temporary role to be dropped, the source roles left are %v", roles)
+	}
+}
+
+func TestRolePasswordsBackupRestore(t *testing.T) {
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	mustExec(t, b.dumpConn(t), `CREATE ROLE reader LOGIN PASSWORD 'reader secret'`)
+	mustExec(t, b.dumpConn(t), `GRANT SELECT ON public."insert_test" TO reader`)
+	keyFile, err := ioutil.TempFile("", "ts_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(keyFile.Name())
+	_, err = keyFile.WriteString("not much of a key")
+	keyFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dumpConfig := b.dump(t, "passwords", func(cf *util.Config) {
+		cf.DumpRoles = true
+		cf.DumpRolePasswords = true
+		cf.RolePasswordsKeyFile = keyFile.Name()
+	})
+	tsInfo, err := util.ReadTsInfo(dumpConfig.TsInfoFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(tsInfo.RolePasswordsFile, util.EncryptedSuffix) {
+		t.Fatalf("expected the role passwords to be encrypted, they are in %s", tsInfo.RolePasswordsFile)
+	}
+	restoreConfig := b.restore(t, dumpConfig, func(cf *util.Config) {
+		cf.RestoreGlobals = true
+		cf.RolePasswordsKeyFile = keyFile.Name()
+	})
+
+	readerDb := b.restoreDb
+	readerDb.dbUser = "reader"
+	readerDb.dbPass = "reader secret"
+	readerConn, err := util.GetDBConn(context.Background(), PGConnectURI(readerDb, false))
+	if err != nil {
+		t.Fatal("Failed to log in with the restored password: ", err)
+	}
+	defer readerConn.Close(context.Background())
+	var rows int
+	err = readerConn.QueryRow(context.Background(), `SELECT count(*) FROM public."insert_test"`).Scan(&rows)
+	if err != nil {
+		t.Fatal("Failed to read as the restored role: ", err)
+	}
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"insert_test"}, dumpConfig.DbURI, restoreConfig.DbURI)
+}
+
+func TestSettingsBackupRestore(t *testing.T) {
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	conn := b.dumpConn(t)
+	mustExec(t, conn, `CREATE ROLE app`)
+	mustExec(t, conn, `ALTER DATABASE dump_test SET work_mem = '32MB'`)
+	mustExec(t, conn, `ALTER DATABASE dump_test SET search_path = public, "My Schema"`)
+	mustExec(t, conn, `ALTER ROLE app IN DATABASE dump_test SET statement_timeout = '5s'`)
+
+	dumpConfig := b.dump(t, "settings", nil)
+
+	// roles are created in the cluster, not in the database restored to
+	mustExec(t, b.clusterConn(t), `CREATE ROLE app`)
+	restoreConfig := b.restore(t, dumpConfig, func(cf *util.Config) {
+		cf.RestoreSettings = true
+	})
+	settingsSQL := `SELECT coalesce(r.rolname, ''), s.setconfig FROM pg_db_role_setting s
+		INNER JOIN pg_database d ON d.oid = s.setdatabase
+		LEFT JOIN pg_roles r ON r.oid = s.setrole
+		WHERE d.datname = current_database() ORDER BY 1`
+	confirmRowsCongruent(t, settingsSQL, dumpConfig.DbURI, restoreConfig.DbURI)
+}
+
+func TestJobsDisabledRestore(t *testing.T) {
+	cases := []struct {
+		desc        string
+		image       string
+		tsVersion   string
+		policySQL   string
+		disabledSQL string // counts the policy jobs that are not scheduled
+	}{
+		{
+			desc:        "ts-1.7",
+			image:       "timescale/timescaledb:1.7.4-pg12",
+			tsVersion:   "1.7.4",
+			policySQL:   `SELECT add_drop_chunks_policy('public."insert_test"', INTERVAL '100 years')`,
+			disabledSQL: `SELECT count(*) FROM _timescaledb_internal.bgw_job_stat WHERE next_start = 'infinity'`,
+		},
+		{
+			desc:        "ts-2.0",
+			image:       "timescale/timescaledb:2.0.0-pg12",
+			tsVersion:   "2.0.0",
+			policySQL:   `SELECT add_retention_policy('public."insert_test"', INTERVAL '100 years')`,
+			disabledSQL: `SELECT count(*) FROM _timescaledb_config.bgw_job WHERE id >= 1000 AND NOT scheduled`,
+		},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.desc, func(t *testing.T) {
+			t.Parallel()
+			b := newBackupTest(t, c.image, c.tsVersion)
+			mustExec(t, b.dumpConn(t), c.policySQL)
+			dumpConfig := b.dump(t, "jobs", nil)
+			restoreConfig := b.restore(t, dumpConfig, func(cf *util.Config) {
+				cf.RestoreJobsDisabled = true
+			})
+			confirmDisabledJobs(t, restoreConfig.DbURI, c.disabledSQL, 1, true)
+
+			err := restore.EnableJobs(restoreConfig)
+			if err != nil {
+				t.Fatal("Failed to enable jobs: ", err)
+			}
+			confirmDisabledJobs(t, restoreConfig.DbURI, c.disabledSQL, 0, false)
+		})
+	}
+}
+
+//confirmDisabledJobs checks how many policy jobs are not scheduled, and
+//whether the jobs disabled by the restore are recorded in the database
+func TestJobRulesRestore(t *testing.T) {
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	conn := b.dumpConn(t)
+	mustExec(t, conn, `SELECT add_retention_policy('public.insert_test', INTERVAL '200 years')`)
+	mustExec(t, conn, `ALTER TABLE public."insert_test" SET (timescaledb.compress)`)
+	mustExec(t, conn, `SELECT add_compression_policy('public.insert_test', INTERVAL '100 years')`)
+	dumpConfig := b.dump(t, "jobrules", nil)
+
+	rulesFile, err := ioutil.TempFile("", "ts_job_rules")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(rulesFile.Name())
+	_, err = rulesFile.WriteString(`[{"type": "retention", "disable": true}]`)
+	rulesFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.restore(t, dumpConfig, func(cf *util.Config) {
+		cf.RestoreJobRules = rulesFile.Name()
+	})
+
+	rows, err := b.restoreConn(t).Query(context.Background(), `SELECT proc_name::text, scheduled FROM _timescaledb_config.bgw_job
+		WHERE proc_name IN ('policy_retention', 'policy_compression') ORDER BY proc_name`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	scheduled := make(map[string]bool)
+	for rows.Next() {
+		var proc string
+		var s bool
+		if err = rows.Scan(&proc, &s); err != nil {
+			t.Fatal(err)
+		}
+		scheduled[proc] = s
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]bool{"policy_compression": true, "policy_retention": false}
+	if !reflect.DeepEqual(scheduled, expected) {
+		t.Errorf("expected only the retention policy to be disabled, the jobs scheduled are %v", scheduled)
+	}
+}
+
+func TestRefreshCaggsRestore(t *testing.T) {
+	cases := []struct {
+		name      string
+		image     string
+		tsVersion string
+		setup     []string
+		refresh   string
+		note      string
+	}{
+		{
+			name:      "1.x",
+			image:     "timescale/timescaledb:1.7.2-pg12",
+			tsVersion: "1.7.2",
+			setup: []string{`CREATE VIEW public.daily WITH (timescaledb.continuous) AS
+				SELECT time_bucket('1 day', tstamp) AS day, device_id, sum(series_0) FROM public.insert_test GROUP BY 1, 2`},
+			refresh: util.RefreshFull,
+			// the background job may have refreshed it before the dump
+			note: `continuous aggregate "public"."daily" has 3 rows after refreshing (`,
+		},
+		{
+			name:      "2.x full",
+			image:     "timescale/timescaledb:2.0.0-pg12",
+			tsVersion: "2.0.0",
+			setup: []string{`CREATE MATERIALIZED VIEW public.daily WITH (timescaledb.continuous) AS
+				SELECT time_bucket('1 day', tstamp) AS day, device_id, sum(series_0) FROM public.insert_test GROUP BY 1, 2 WITH NO DATA`},
+			refresh: util.RefreshFull,
+			note:    `continuous aggregate "public"."daily" has 3 rows after refreshing (0 when dumped)`,
+		},
+		{
+			name:      "2.x policy",
+			image:     "timescale/timescaledb:2.0.0-pg12",
+			tsVersion: "2.0.0",
+			setup: []string{`CREATE MATERIALIZED VIEW public.daily WITH (timescaledb.continuous) AS
+				SELECT time_bucket('1 day', tstamp) AS day, device_id, sum(series_0) FROM public.insert_test GROUP BY 1, 2 WITH NO DATA`,
+				`SELECT add_continuous_aggregate_policy('public.daily', INTERVAL '7 days', INTERVAL '1 hour', INTERVAL '1 hour')`},
+			refresh: util.RefreshPolicy,
+			// the data is older than the window of the policy
+			note: `continuous aggregate "public"."daily" has 0 rows after refreshing (0 when dumped)`,
+		},
+	}
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			b := newBackupTest(t, c.image, c.tsVersion)
+			conn := b.dumpConn(t)
+			for _, sql := range c.setup {
+				mustExec(t, conn, sql)
+			}
+			dumpConfig := b.dump(t, "refresh", func(cf *util.Config) {
+				cf.DumpCaggRows = true
+			})
+			output := captureStdout(t, func() {
+				b.restore(t, dumpConfig, func(cf *util.Config) {
+					cf.RestoreRefreshCaggs = c.refresh
+				})
+			})
+			if !strings.Contains(output, c.note) {
+				t.Errorf("expected the restore summary to note %q", c.note)
+			}
+			if !strings.Contains(output, "refreshed 1 of 1 continuous aggregates") {
+				t.Error("expected the restore summary to note that the continuous aggregate was refreshed")
+			}
+		})
+	}
+}
+
+//captureStdout returns what f writes to os.Stdout, which pg_restore's output
+//and the restore summary are written to
+func captureStdout(t *testing.T, f func()) (captured string) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	output := make(chan string)
+	go func() {
+		var b strings.Builder
+		io.Copy(io.MultiWriter(&b, stdout), reader)
+		output <- b.String()
+	}()
+	// also when f fails the test
+	defer func() {
+		os.Stdout = stdout
+		writer.Close()
+		captured = <-output
+	}()
+	f()
+	return ""
+}
+
+func confirmDisabledJobs(t *testing.T, dbURI string, disabledSQL string, expected int, recorded bool) {
+	conn, err := util.GetDBConn(context.Background(), dbURI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(context.Background())
+	var disabled int
+	var setting *string
+	err = conn.QueryRow(context.Background(), disabledSQL).Scan(&disabled)
+	if err == nil {
+		err = conn.QueryRow(context.Background(), `SELECT nullif(current_setting('timescaledb_backup.disabled_jobs', true), '')`).Scan(&setting)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disabled != expected {
+		t.Errorf("expected %d disabled jobs, got %d", expected, disabled)
+	}
+	if (setting != nil) != recorded {
+		t.Errorf("expected the disabled jobs to be recorded: %v, got %v", recorded, setting)
+	}
+}
+
+func TestSelectiveMergeRestore(t *testing.T) {
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	conn := b.dumpConn(t)
+	// a dropped and a generated column, which can't be copied into
+	mustExec(t, conn, `CREATE TABLE public.merge_test (
+		tstamp timestamptz NOT NULL,
+		dropped INT,
+		device_id TEXT NOT NULL,
+		value DOUBLE PRECISION,
+		doubled DOUBLE PRECISION GENERATED ALWAYS AS (value * 2) STORED)`)
+	mustExec(t, conn, `ALTER TABLE public.merge_test DROP COLUMN dropped`)
+	mustExec(t, conn, `SELECT create_hypertable('public.merge_test', 'tstamp', chunk_time_interval => '1 day'::interval)`)
+	mustExec(t, conn, `INSERT INTO public.merge_test(tstamp, device_id, value) VALUES
+		('2020-10-04 14:21:08+00', 'dev1', 1.5),
+		('2020-10-10 14:21:30+00', 'dev2', 2.5)`)
+	mustExec(t, conn, `ALTER TABLE public.merge_test SET (timescaledb.compress, timescaledb.compress_segmentby = 'device_id')`)
+	mustExec(t, conn, `SELECT add_compression_policy('public.merge_test', INTERVAL '100 years')`)
+	mustExec(t, conn, `SELECT add_retention_policy('public.merge_test', INTERVAL '200 years')`)
+	mustExec(t, conn, `CREATE MATERIALIZED VIEW public.merge_daily WITH (timescaledb.continuous) AS
+		SELECT time_bucket('1 day', tstamp) AS day, device_id, sum(value) FROM public.merge_test GROUP BY 1, 2`)
+	mustExec(t, conn, `SELECT add_continuous_aggregate_policy('public.merge_daily', NULL, INTERVAL '1 hour', INTERVAL '2 hours')`)
 
-	quotedTableSchema := tableSchema.Sanitize()
-	quotedTableName := tableName.Sanitize()
+	dumpConfig := b.dump(t, "merge", func(cf *util.Config) {
+		cf.Hypertables = []string{"public.merge_test"}
+	})
+
+	// the database merged into has hypertables of its own
+	setupOrigDB(t, b.restoreDb, "public", "2.0.0")
+	restoreConfig := b.restoreConfig(dumpConfig, nil)
+	err := restore.DoRestore(restoreConfig)
+	if err != nil {
+		t.Fatal("Failed on restore: ", err)
+	}
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"merge_test"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"merge_daily"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"insert_test"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"two_Partitions"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	// the jobs of continuous aggregates are by their materialization hypertable
+	policiesSQL := `SELECT j.proc_name, coalesce(ca.view_name, j.hypertable_name), j.schedule_interval::text,
+		coalesce(j.config - 'hypertable_id' - 'mat_hypertable_id', '{}')::text
+		FROM timescaledb_information.jobs j
+		LEFT JOIN timescaledb_information.continuous_aggregates ca ON ca.materialization_hypertable_name = j.hypertable_name
+		WHERE coalesce(ca.view_name, j.hypertable_name) IN ('merge_test', 'merge_daily') ORDER BY j.proc_name`
+	confirmRowsCongruent(t, policiesSQL, dumpConfig.DbURI, restoreConfig.DbURI)
+}
 
-	sql := fmt.Sprintf(`SELECT * FROM %s.%s AS t ORDER BY t`, quotedTableSchema, quotedTableName)
+func TestHypertableFromFullDumpRestore(t *testing.T) {
+	b := newBackupTest(t, "timescale/timescaledb:2.0.0-pg12", "2.0.0")
+	conn := b.dumpConn(t)
+	mustExec(t, conn, `CREATE TABLE public.devices (id TEXT PRIMARY KEY)`)
+	mustExec(t, conn, `INSERT INTO public.devices VALUES ('dev1'), ('dev2')`)
+	mustExec(t, conn, `CREATE TABLE public.readings (
+		tstamp timestamptz NOT NULL,
+		device_id TEXT NOT NULL REFERENCES public.devices(id),
+		value DOUBLE PRECISION)`)
+	mustExec(t, conn, `SELECT create_hypertable('public.readings', 'tstamp', chunk_time_interval => '1 day'::interval)`)
+	mustExec(t, conn, `INSERT INTO public.readings VALUES
+		('2020-10-04 14:21:08+00', 'dev1', 1.5),
+		('2020-10-10 14:21:30+00', 'dev2', 2.5)`)
+	// its foreign key is listed as "readings archive archive_device_fkey" in the
+	// TOC, which starts with the name of the hypertable too
+	mustExec(t, conn, `CREATE TABLE public."readings archive" (device_id TEXT CONSTRAINT archive_device_fkey REFERENCES public.devices(id))`)
+	dumpConfig := b.dump(t, "hypertable", nil)
+
+	// the database restored into has hypertables of its own and the table the
+	// hypertable refers to, along with a scratch database a killed restore left
+	setupOrigDB(t, b.restoreDb, "public", "2.0.0")
+	mustExec(t, b.restoreConn(t), `CREATE TABLE public.devices (id TEXT PRIMARY KEY)`)
+	mustExec(t, b.restoreConn(t), `INSERT INTO public.devices VALUES ('dev1'), ('dev2')`)
+	mustExec(t, b.clusterConn(t), `CREATE DATABASE ts_restore_scratch_1`)
+	restoreConfig := b.restoreConfig(dumpConfig, func(cf *util.Config) {
+		cf.Hypertables = []string{"readings"}
+	})
+	err := restore.DoRestore(restoreConfig)
+	if err != nil {
+		t.Fatal("Failed on restore: ", err)
+	}
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"readings"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"insert_test"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	confirmTablesCongruent(t, pgx.Identifier{"public"}, pgx.Identifier{"two_Partitions"}, dumpConfig.DbURI, restoreConfig.DbURI)
+	confirmCatalogConsistent(t, restoreConfig.DbURI)
+
+	var keys []string
+	err = b.restoreConn(t).QueryRow(context.Background(), `SELECT coalesce(array_agg(conname::text ORDER BY conname), '{}') FROM pg_constraint
+		WHERE contype = 'f' AND conrelid IN ('public.readings'::regclass, 'public.devices'::regclass)`).Scan(&keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"readings_device_id_fkey"}) {
+		t.Errorf("expected only the foreign key of the hypertable to be restored, got %v", keys)
+	}
+	var leftOver []string
+	err = b.clusterConn(t).QueryRow(context.Background(), `SELECT coalesce(array_agg(datname::text), '{}') FROM pg_database WHERE datname LIKE 'ts\_restore\_scratch\_%'`).Scan(&leftOver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftOver) != 0 {
+		t.Errorf("expected the scratch databases to be dropped, found %v", leftOver)
+	}
+}
+
+func confirmTablesCongruent(t *testing.T, tableSchema pgx.Identifier, tableName pgx.Identifier, origURI string, restoredURI string) {
+	confirmRowsCongruent(t, fmt.Sprintf(`SELECT * FROM %s.%s AS t ORDER BY t`, tableSchema.Sanitize(), tableName.Sanitize()), origURI, restoredURI)
+}
+
+func confirmRowsCongruent(t *testing.T, sql string, origURI string, restoredURI string) {
 	origConn, err := util.GetDBConn(context.Background(), origURI)
 	if err != nil {
 		t.Fatal("Unable to connect to dump db: ", err)
@@ -242,14 +1343,26 @@ func confirmTablesCongruent(t *testing.T, tableSchema pgx.Identifier, tableName
 	for origRows.Next() {
 		rowCount++
 		if !restoredRows.Next() {
-			t.Fatalf("Restored table %s.%s has too few rows", quotedTableSchema, quotedTableName)
+			t.Fatalf("Restored rows of %s are too few", sql)
 		}
 		if !reflect.DeepEqual(origRows.RawValues(), restoredRows.RawValues()) {
-			t.Fatalf("Restored table %s.%s has element unequal to original row: %d", quotedTableSchema, quotedTableName, rowCount)
+			t.Fatalf("Restored rows of %s have an element unequal to original row: %d", sql, rowCount)
 		}
 	}
 	if restoredRows.Next() {
-		t.Fatalf("Restored table %s.%s has too many rows", quotedTableSchema, quotedTableName)
+		t.Fatalf("Restored rows of %s are too many", sql)
+	}
+}
+
+//confirmCatalogConsistent checks that the TimescaleDB catalog of the
+//restored database has none of the problems ts-restore --check-catalog reports
+func confirmCatalogConsistent(t *testing.T, restoredURI string) {
+	problems, err := restore.CheckCatalog(restoredURI)
+	if err != nil {
+		t.Fatal("Failed to check the catalog: ", err)
+	}
+	for _, problem := range problems {
+		t.Errorf("catalog: %s", problem)
 	}
 }
 
@@ -0,0 +1,117 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package test
+
+import (
+	"testing"
+
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+func TestSetClause(t *testing.T) {
+	cases := []struct {
+		setting string
+		ok      bool
+		clause  string
+	}{
+		{setting: "work_mem=64MB", ok: true, clause: `"work_mem" TO '64MB'`},
+		{setting: "timescaledb.telemetry_level=off", ok: true, clause: `"timescaledb.telemetry_level" TO 'off'`},
+		{setting: "application_name=it's", ok: true, clause: `"application_name" TO 'it''s'`},
+		{setting: `search_path="$user", public`, ok: true, clause: `"search_path" TO '$user', 'public'`},
+		{setting: `search_path="a ""b""",c`, ok: true, clause: `"search_path" TO 'a "b"', 'c'`},
+		{setting: "search_path=", ok: true, clause: `"search_path" TO ''`},
+		{setting: `search_path="unterminated`, ok: false},
+		{setting: "no_value", ok: false},
+	}
+	for _, c := range cases {
+		clause, err := util.SetClause(c.setting)
+		if (err == nil) != c.ok {
+			t.Errorf("SetClause(%q) returned error %v", c.setting, err)
+			continue
+		}
+		if c.ok && clause != c.clause {
+			t.Errorf("SetClause(%q) = %s, expected %s", c.setting, clause, c.clause)
+		}
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := `--
+-- PostgreSQL database cluster dump
+--
+
+\restrict abc123
+SET default_transaction_read_only = off;
+
+CREATE ROLE "semi;colon";
+ALTER ROLE "semi;colon" WITH LOGIN;
+COMMENT ON ROLE app IS 'it''s; here';
+CREATE FUNCTION f() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql;
+/* a; comment */ GRANT app TO "semi;colon" GRANTED BY postgres;
+\unrestrict abc123
+`
+	expected := []string{
+		"SET default_transaction_read_only = off",
+		`CREATE ROLE "semi;colon"`,
+		`ALTER ROLE "semi;colon" WITH LOGIN`,
+		"COMMENT ON ROLE app IS 'it''s; here'",
+		"CREATE FUNCTION f() RETURNS int AS $body$ SELECT 1; $body$ LANGUAGE sql",
+		`GRANT app TO "semi;colon" GRANTED BY postgres`,
+	}
+	statements := util.SplitStatements(script)
+	if len(statements) != len(expected) {
+		t.Fatalf("expected %d statements, got %d: %q", len(expected), len(statements), statements)
+	}
+	for i := range expected {
+		if statements[i] != expected[i] {
+			t.Errorf("statement %d is %q, expected %q", i, statements[i], expected[i])
+		}
+	}
+}
+
+func TestMapRoles(t *testing.T) {
+	roleMap := util.Mapping{
+		"alice":      "bob",
+		"Mixed Case": "carol",
+		"pay$roll":   "payroll",
+		"user":       "app_user",
+		"all":        "everyone",
+		`quo"te`:     "plain",
+	}
+	cases := []struct {
+		stmnt    string
+		expected string
+	}{
+		{`GRANT SELECT ON TABLE public.conditions TO alice`, `GRANT SELECT ON TABLE public.conditions TO "bob"`},
+		{`GRANT SELECT ON TABLE public.conditions TO alice WITH GRANT OPTION`, `GRANT SELECT ON TABLE public.conditions TO "bob" WITH GRANT OPTION`},
+		{`GRANT SELECT ON TABLE public.conditions TO reader, alice, "Mixed Case"`, `GRANT SELECT ON TABLE public.conditions TO reader, "bob", "carol"`},
+		{`REVOKE ALL ON TABLE public.conditions FROM alice`, `REVOKE ALL ON TABLE public.conditions FROM "bob"`},
+		{`REVOKE ALL ON TABLE public.conditions FROM PUBLIC`, `REVOKE ALL ON TABLE public.conditions FROM PUBLIC`},
+		// names with characters that need quoting or escaping
+		{`GRANT USAGE ON SCHEMA public TO "pay$roll"`, `GRANT USAGE ON SCHEMA public TO "payroll"`},
+		{`GRANT USAGE ON SCHEMA public TO "quo""te"`, `GRANT USAGE ON SCHEMA public TO "plain"`},
+		{`GRANT USAGE ON SCHEMA public TO "alice2"`, `GRANT USAGE ON SCHEMA public TO "alice2"`},
+		{`GRANT USAGE ON SCHEMA public TO alice_2`, `GRANT USAGE ON SCHEMA public TO alice_2`},
+		// role memberships
+		{`GRANT alice TO "Mixed Case" GRANTED BY postgres`, `GRANT "bob" TO "carol" GRANTED BY postgres`},
+		{`GRANT reader TO app GRANTED BY alice`, `GRANT reader TO app GRANTED BY "bob"`},
+		{`REVOKE ADMIN OPTION FOR alice FROM app`, `REVOKE ADMIN OPTION FOR "bob" FROM app`},
+		// default privileges
+		{`ALTER DEFAULT PRIVILEGES FOR ROLE alice IN SCHEMA public GRANT SELECT ON TABLES TO "Mixed Case"`, `ALTER DEFAULT PRIVILEGES FOR ROLE "bob" IN SCHEMA public GRANT SELECT ON TABLES TO "carol"`},
+		{`ALTER DEFAULT PRIVILEGES FOR USER alice REVOKE ALL ON FUNCTIONS FROM PUBLIC`, `ALTER DEFAULT PRIVILEGES FOR USER "bob" REVOKE ALL ON FUNCTIONS FROM PUBLIC`},
+		{`SET SESSION AUTHORIZATION alice`, `SET SESSION AUTHORIZATION "bob"`},
+		// roles named like keywords are quoted by pg_dump, the keywords are not roles
+		{`GRANT ALL ON TABLE public.conditions TO "all"`, `GRANT ALL ON TABLE public.conditions TO "everyone"`},
+		{`GRANT SELECT ON TABLE public.conditions TO "user"`, `GRANT SELECT ON TABLE public.conditions TO "app_user"`},
+		// tables named like roles are left alone
+		{`GRANT SELECT ON TABLE public.alice TO reader`, `GRANT SELECT ON TABLE public.alice TO reader`},
+		{`GRANT SELECT ON TABLE "alice" TO reader`, `GRANT SELECT ON TABLE "alice" TO reader`},
+	}
+	for _, c := range cases {
+		mapped := util.MapRoles(c.stmnt, roleMap)
+		if mapped != c.expected {
+			t.Errorf("MapRoles(%q) = %q, expected %q", c.stmnt, mapped, c.expected)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/timescale/timescaledb-backup/pkg/store"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+func TestStoreDeduplicatesAndMaterializes(t *testing.T) {
+	base, err := ioutil.TempDir("", "ts_store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	repo, err := store.Open(filepath.Join(base, "repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two dumps that share the content of one data file
+	dumps := []map[string]string{
+		{"toc.dat": "toc1", "3001.dat.gz": "old chunk", "3002.dat.gz": "new chunk"},
+		{"toc.dat": "toc2", "3005.dat.gz": "old chunk", "3006.dat.gz": "newer chunk"},
+	}
+	var newCounts []int
+	var dumpDirs []string
+	for i, files := range dumps {
+		dumpDir := filepath.Join(base, "dump", string(rune('a'+i)))
+		dumpDirs = append(dumpDirs, dumpDir)
+		dir := filepath.Join(dumpDir, util.PgDumpDirName)
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, content := range files {
+			err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		stored, newFiles, err := repo.StoreDumpFiles(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(stored) != 2 {
+			t.Fatalf("expected 2 stored files, got %d", len(stored))
+		}
+		newCounts = append(newCounts, newFiles)
+		remaining, _ := ioutil.ReadDir(dir)
+		if len(remaining) != 3 {
+			t.Fatalf("expected the data files to stay in the dump directory until the manifest is written")
+		}
+		writeManifest(t, dumpDir, util.TsInfo{StoredFiles: stored})
+		err = store.RemoveStoredFiles(dir, stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		remaining, _ = ioutil.ReadDir(dir)
+		if len(remaining) != 1 || remaining[0].Name() != "toc.dat" {
+			t.Fatalf("expected only toc.dat to remain in dump directory")
+		}
+
+		restored, err := repo.Materialize(dir, stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, content := range files {
+			got, err := ioutil.ReadFile(filepath.Join(restored, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != content {
+				t.Fatalf("materialized %s has content %q, expected %q", name, got, content)
+			}
+		}
+		os.RemoveAll(restored)
+	}
+	if newCounts[0] != 2 || newCounts[1] != 1 {
+		t.Fatalf("expected the shared file to be stored once, new files per dump: %v", newCounts)
+	}
+
+	// deleting the first dump frees only the object no other dump uses
+	err = os.RemoveAll(dumpDirs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, freed, err := repo.Prune(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 || freed != int64(len("new chunk")) {
+		t.Fatalf("expected prune to remove the object of the deleted dump only, removed %d objects of %d bytes", removed, freed)
+	}
+	tsInfo, err := util.ReadTsInfo(filepath.Join(dumpDirs[1], util.TsInfoFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := repo.Materialize(filepath.Join(dumpDirs[1], util.PgDumpDirName), tsInfo.StoredFiles)
+	os.RemoveAll(restored)
+	if err != nil {
+		t.Fatalf("the remaining dump can't be materialized after pruning: %v", err)
+	}
+}
+
+func TestStoreDetectsCorruptObjects(t *testing.T) {
+	base, err := ioutil.TempDir("", "ts_store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	repo, err := store.Open(filepath.Join(base, "repo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(base, "dump", util.PgDumpDirName)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "3001.dat.gz"), []byte("chunk"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _, err := repo.StoreDumpFiles(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = store.RemoveStoredFiles(dir, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	object := filepath.Join(repo.Dir, "objects", stored[0].Hash[:2], stored[0].Hash)
+	err = ioutil.WriteFile(object, []byte("chunk, corrupted"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := repo.Materialize(dir, stored)
+	os.RemoveAll(restored)
+	if err == nil {
+		t.Fatal("expected materializing a corrupt object to fail")
+	}
+}
+
+func writeManifest(t *testing.T, dumpDir string, tsInfo util.TsInfo) {
+	content, err := json.Marshal(tsInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dumpDir, util.TsInfoFileName), content, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
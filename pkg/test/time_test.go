@@ -0,0 +1,38 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package test
+
+import (
+	"testing"
+
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+func TestToInternalTime(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected int64
+	}{
+		{"2000-01-01T00:00:00Z", 0},
+		{"2000-01-01", 0},
+		{"2000-01-01T00:00:01.000002Z", 1000002},
+		{"1999-12-31T23:59:59Z", -1000000},
+		{"2020-10-09 00:00:00", 655516800000000},
+	}
+	for _, c := range cases {
+		parsed, err := util.ParseTime(c.value)
+		if err != nil {
+			t.Errorf("%s: %v", c.value, err)
+			continue
+		}
+		internal := util.ToInternalTime(parsed)
+		if internal != c.expected {
+			t.Errorf("%s: expected %d, got %d", c.value, c.expected, internal)
+		}
+	}
+	_, err := util.ParseTime("09/10/2020")
+	if err == nil {
+		t.Error("expected an error parsing a time that isn't RFC 3339")
+	}
+}
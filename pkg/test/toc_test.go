@@ -0,0 +1,195 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+func TestParseTOCLine(t *testing.T) {
+	cases := []struct {
+		line   string
+		ok     bool
+		id     int
+		desc   string
+		schema string
+		name   string
+		owner  string
+	}{
+		{line: ";", ok: false},
+		{line: "; Archive created at 2020-10-18 10:00:00 UTC", ok: false},
+		{line: "", ok: false},
+		{line: "3012; 0 16423 TABLE DATA _timescaledb_internal _hyper_1_1_chunk postgres", ok: true, id: 3012, desc: "TABLE DATA", schema: "_timescaledb_internal", name: "_hyper_1_1_chunk", owner: "postgres"},
+		{line: "205; 1259 16390 TABLE public two_Partitions postgres", ok: true, id: 205, desc: "TABLE", schema: "public", name: "two_Partitions", owner: "postgres"},
+		{line: "4018; 0 0 COMMENT - EXTENSION timescaledb ", ok: true, id: 4018, desc: "COMMENT", schema: "-", name: "EXTENSION timescaledb"},
+		{line: "3100; 2606 16500 FK CONSTRAINT _timescaledb_catalog chunk chunk_hypertable_id_fkey postgres", ok: true, id: 3100, desc: "FK CONSTRAINT", schema: "_timescaledb_catalog", name: "chunk chunk_hypertable_id_fkey", owner: "postgres"},
+		{line: "3200; 0 0 SEQUENCE SET _timescaledb_catalog chunk_id_seq postgres", ok: true, id: 3200, desc: "SEQUENCE SET", schema: "_timescaledb_catalog", name: "chunk_id_seq", owner: "postgres"},
+		{line: ";3012; 0 16423 TABLE DATA _timescaledb_internal _hyper_1_1_chunk postgres", ok: false},
+	}
+	for _, c := range cases {
+		entry, ok := util.ParseTOCLine(c.line)
+		if ok != c.ok {
+			t.Fatalf("line %q: expected ok %v got %v", c.line, c.ok, ok)
+		}
+		if !ok {
+			continue
+		}
+		if entry.DumpID != c.id || entry.Desc != c.desc || entry.Schema != c.schema || entry.Name != c.name || entry.Owner != c.owner {
+			t.Fatalf("line %q parsed incorrectly: %+v", c.line, entry)
+		}
+		if entry.Line != c.line {
+			t.Fatalf("line %q not preserved: %q", c.line, entry.Line)
+		}
+	}
+}
+
+func TestParseScriptHeader(t *testing.T) {
+	cases := []struct {
+		line   string
+		ok     bool
+		header util.ScriptHeader
+	}{
+		{line: "-- Name: two_Partitions; Type: TABLE; Schema: public; Owner: postgres; Tablespace: fast", ok: true,
+			header: util.ScriptHeader{Name: "two_Partitions", Desc: "TABLE", Schema: "public", Owner: "postgres", Tablespace: "fast"}},
+		{line: "-- Name: insert_test; Type: TABLE; Schema: public; Owner: postgres", ok: true,
+			header: util.ScriptHeader{Name: "insert_test", Desc: "TABLE", Schema: "public", Owner: "postgres"}},
+		{line: "-- Name: insert_test_tstamp_idx; Type: INDEX; Schema: public; Owner: postgres; Tablespace: slow disk", ok: true,
+			header: util.ScriptHeader{Name: "insert_test_tstamp_idx", Desc: "INDEX", Schema: "public", Owner: "postgres", Tablespace: "slow disk"}},
+		// constraints are named by their table and their name, which may both hold spaces
+		{line: "-- Name: my table my table_pkey; Type: CONSTRAINT; Schema: public; Owner: postgres; Tablespace: fast", ok: true,
+			header: util.ScriptHeader{Name: "my table my table_pkey", Desc: "CONSTRAINT", Schema: "public", Owner: "postgres", Tablespace: "fast"}},
+		{line: "-- Name: conditions_summary; Type: MATERIALIZED VIEW; Schema: public; Owner: -; Tablespace: fast", ok: true,
+			header: util.ScriptHeader{Name: "conditions_summary", Desc: "MATERIALIZED VIEW", Schema: "public", Owner: "-", Tablespace: "fast"}},
+		{line: "-- Name: timescaledb; Type: EXTENSION; Schema: -; Owner: -", ok: true,
+			header: util.ScriptHeader{Name: "timescaledb", Desc: "EXTENSION", Schema: "-", Owner: "-"}},
+		{line: "-- Data for Name: two_Partitions; Type: TABLE DATA; Schema: public; Owner: postgres", ok: false},
+		{line: "CREATE TABLE public.insert_test (", ok: false},
+		{line: "--", ok: false},
+	}
+	for _, c := range cases {
+		header, ok := util.ParseScriptHeader(c.line)
+		if ok != c.ok {
+			t.Fatalf("line %q: expected ok %v got %v", c.line, c.ok, ok)
+		}
+		if ok && header != c.header {
+			t.Fatalf("line %q parsed incorrectly: %+v", c.line, header)
+		}
+	}
+}
+
+func TestOrderRecentFirst(t *testing.T) {
+	data := func(schema, name string) util.TOCEntry {
+		return util.TOCEntry{Desc: "TABLE DATA", Schema: schema, Name: name}
+	}
+	day := func(value string) int64 {
+		parsed, err := util.ParseTime(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return util.ToInternalTime(parsed)
+	}
+	const internal = "_timescaledb_internal"
+	entries := []util.TOCEntry{
+		data(internal, "_hyper_2_1_chunk"),
+		data("public", "regular"),
+		data(internal, "_hyper_1_2_chunk"),
+		{Desc: "INDEX", Schema: internal, Name: "_hyper_2_3_chunk"},
+		data(internal, "_hyper_2_3_chunk"),
+		data(internal, "compress_hyper_3_4_chunk"),
+		data(internal, "_hyper_2_5_chunk"),
+	}
+	ends := map[string]util.ChunkEnd{
+		internal + "._hyper_2_1_chunk":         {End: day("2020-10-05"), IsTime: true},
+		internal + "._hyper_1_2_chunk":         {End: 100, IsTime: false},
+		internal + "._hyper_2_3_chunk":         {End: day("2020-10-11"), IsTime: true},
+		internal + ".compress_hyper_3_4_chunk": {End: day("2020-10-05"), IsTime: true},
+		internal + "._hyper_2_5_chunk":         {End: day("2020-10-15"), IsTime: true},
+	}
+	names := func(entries []util.TOCEntry) string {
+		var names []string
+		for _, e := range entries {
+			names = append(names, strings.TrimPrefix(e.Desc, "TABLE ")+" "+e.Name)
+		}
+		return strings.Join(names, ", ")
+	}
+	cases := []struct {
+		desc  string
+		since string
+		first string
+		rest  string
+	}{
+		{
+			desc:  "newest first",
+			first: "DATA regular, INDEX _hyper_2_3_chunk, DATA _hyper_2_5_chunk, DATA _hyper_2_3_chunk, DATA _hyper_2_1_chunk, DATA compress_hyper_3_4_chunk, DATA _hyper_1_2_chunk",
+		},
+		{
+			desc:  "recent days",
+			since: "2020-10-10T00:00:00Z",
+			first: "DATA regular, INDEX _hyper_2_3_chunk, DATA _hyper_2_5_chunk, DATA _hyper_2_3_chunk",
+			rest:  "DATA _hyper_2_1_chunk, DATA compress_hyper_3_4_chunk, DATA _hyper_1_2_chunk",
+		},
+		{
+			desc:  "a chunk ending at since is old",
+			since: "2020-10-11T00:00:00Z",
+			first: "DATA regular, INDEX _hyper_2_3_chunk, DATA _hyper_2_5_chunk",
+			rest:  "DATA _hyper_2_3_chunk, DATA _hyper_2_1_chunk, DATA compress_hyper_3_4_chunk, DATA _hyper_1_2_chunk",
+		},
+	}
+	for _, c := range cases {
+		var since time.Time
+		if c.since != "" {
+			since, _ = util.ParseTime(c.since)
+		}
+		first, rest := util.OrderRecentFirst(entries, ends, since)
+		if names(first) != c.first {
+			t.Errorf("%s: expected first %s, got %s", c.desc, c.first, names(first))
+		}
+		if names(rest) != c.rest {
+			t.Errorf("%s: expected rest %s, got %s", c.desc, c.rest, names(rest))
+		}
+	}
+}
+
+func TestOrderBySize(t *testing.T) {
+	entry := func(desc, name string) util.TOCEntry {
+		return util.TOCEntry{Desc: desc, Schema: "public", Name: name}
+	}
+	entries := []util.TOCEntry{
+		entry("TABLE DATA", "small_data"),
+		entry("INDEX", "small_idx"),
+		entry("CONSTRAINT", "small_pkey"),
+		entry("INDEX", "unsized_idx"),
+		entry("TRIGGER", "trigger"),
+		entry("INDEX", "large_idx"),
+		entry("CONSTRAINT", "large_pkey"),
+		entry("FK CONSTRAINT", "fkey"),
+		entry("TABLE DATA", "large_data"),
+	}
+	sizes := map[string]int64{
+		`"public"."small_data"`: 10,
+		`"public"."large_data"`: 1000,
+		`"public"."small_idx"`:  10,
+		`"public"."large_idx"`:  1000,
+		`"public"."small_pkey"`: 10,
+		`"public"."large_pkey"`: 1000,
+		`"public"."fkey"`:       1000,
+	}
+	var names []string
+	for _, e := range util.OrderBySize(entries, sizes) {
+		names = append(names, e.Name)
+	}
+	// indexes and constraints swap places among their own kind, the data,
+	// the trigger and the foreign key stay where they were
+	expected := "small_data, large_idx, large_pkey, small_idx, trigger, unsized_idx, small_pkey, fkey, large_data"
+	if strings.Join(names, ", ") != expected {
+		t.Errorf("expected order %s, got %s", expected, strings.Join(names, ", "))
+	}
+	if entries[1].Name != "small_idx" {
+		t.Error("expected the entries passed in to be left as they were")
+	}
+}
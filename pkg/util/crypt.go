@@ -0,0 +1,73 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Files holding secrets, such as role passwords, can be encrypted with AES-256
+// in GCM mode, with the SHA-256 of the content of a key file as the key. The
+// encrypted file is the random nonce followed by the sealed content.
+
+func keyFromFile(keyFile string) ([]byte, error) {
+	secret, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("key file %s is empty", keyFile)
+	}
+	key := sha256.Sum256(secret)
+	return key[:], nil
+}
+
+func gcmFromFile(keyFile string) (cipher.AEAD, error) {
+	key, err := keyFromFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+//Encrypt encrypts data with the key in keyFile, see above
+func Encrypt(data []byte, keyFile string) ([]byte, error) {
+	gcm, err := gcmFromFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+//Decrypt decrypts data encrypted by Encrypt with the key in keyFile
+func Decrypt(data []byte, keyFile string) ([]byte, error) {
+	gcm, err := gcmFromFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt, the key is wrong or the data was modified")
+	}
+	return plain, nil
+}
@@ -0,0 +1,133 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package util
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+//DatabaseInfo records the properties of the dumped database, which pg_dump
+//only writes out with --create, so that it can be recreated alike
+type DatabaseInfo struct {
+	Name         string
+	Encoding     string
+	Collate      string
+	Ctype        string
+	Owner        string
+	Tablespace   string
+	Settings     []string      `json:",omitempty"` // ALTER DATABASE ... SET settings, as name=value
+	RoleSettings []RoleSetting `json:",omitempty"` // ALTER ROLE ... IN DATABASE ... SET settings
+}
+
+//RoleSetting holds the settings of a role in the dumped database
+type RoleSetting struct {
+	Role     string
+	Settings []string // as name=value
+}
+
+// settings whose values are lists that PostgreSQL keeps quoted, they have to be
+// split up and quoted element by element, like pg_dump does
+var listQuoteSettings = map[string]bool{
+	"local_preload_libraries":   true,
+	"search_path":               true,
+	"session_preload_libraries": true,
+	"shared_preload_libraries":  true,
+	"temp_tablespaces":          true,
+}
+
+//SplitSetting splits a setting in the name=value form pg_db_role_setting
+//keeps them in
+func SplitSetting(setting string) (name string, value string, err error) {
+	i := strings.IndexByte(setting, '=')
+	if i <= 0 {
+		return "", "", fmt.Errorf("invalid setting %q", setting)
+	}
+	return setting[:i], setting[i+1:], nil
+}
+
+//SetClause returns the "name TO value" part of an ALTER DATABASE or ALTER ROLE
+//... SET statement for a setting in the name=value form
+func SetClause(setting string) (string, error) {
+	name, value, err := SplitSetting(setting)
+	if err != nil {
+		return "", err
+	}
+	if !listQuoteSettings[strings.ToLower(name)] {
+		return fmt.Sprintf("%s TO %s", pgx.Identifier{name}.Sanitize(), QuoteLiteral(value)), nil
+	}
+	elements, err := splitSettingList(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid value of setting %s: %w", name, err)
+	}
+	if len(elements) == 0 {
+		return fmt.Sprintf("%s TO ''", pgx.Identifier{name}.Sanitize()), nil
+	}
+	for i := range elements {
+		elements[i] = QuoteLiteral(elements[i])
+	}
+	return fmt.Sprintf("%s TO %s", pgx.Identifier{name}.Sanitize(), strings.Join(elements, ", ")), nil
+}
+
+//splitSettingList splits the value of a list setting into its elements, which
+//are separated by commas and may be double quoted
+func splitSettingList(value string) ([]string, error) {
+	var elements []string
+	i := 0
+	skipSpace := func() {
+		for i < len(value) && value[i] == ' ' {
+			i++
+		}
+	}
+	skipSpace()
+	if i == len(value) {
+		return nil, nil
+	}
+	for {
+		var element strings.Builder
+		if value[i] == '"' {
+			i++
+			for {
+				if i >= len(value) {
+					return nil, fmt.Errorf("unterminated quoted element in %q", value)
+				}
+				if value[i] == '"' {
+					if i+1 < len(value) && value[i+1] == '"' {
+						element.WriteByte('"')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				element.WriteByte(value[i])
+				i++
+			}
+		} else {
+			end := strings.IndexByte(value[i:], ',')
+			if end < 0 {
+				end = len(value) - i
+			}
+			element.WriteString(strings.TrimRight(value[i:i+end], " "))
+			i += end
+		}
+		elements = append(elements, element.String())
+		skipSpace()
+		if i == len(value) {
+			return elements, nil
+		}
+		if value[i] != ',' {
+			return nil, fmt.Errorf("unexpected character after quoted element in %q", value)
+		}
+		i++
+		skipSpace()
+	}
+}
+
+//QuoteLiteral quotes s as an SQL string literal
+func QuoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
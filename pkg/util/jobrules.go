@@ -0,0 +1,126 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Copies of a database, for staging or analytics, often need other policies
+// than the database they were dumped from. Job rules change the restored jobs
+// before the database is taken out of restoring mode, so the dumped policies
+// never run. They are read from a JSON file holding a list of rules, each
+// applying to the jobs of one type, or all of them:
+//
+//   [
+//     {"type": "retention", "disable": true},
+//     {"type": "all", "shift": "6 hours"},
+//     {"type": "compression", "config": {"compress_after": "30 days"}}
+//   ]
+//
+// Rules are applied in order, a rule does the following to the jobs it
+// applies to, in this order:
+//
+//   - config: sets keys of their configuration, TimescaleDB 2 only
+//   - schedule_interval: sets how often they run
+//   - shift: moves their next start by an interval. A restored database has no
+//     job statistics, the jobs haven't run there yet, so right after a restore
+//     this moves their next start to the interval from now; later on, as with
+//     ts-restore --finish, it moves the next start recorded there.
+//   - disable: unschedules them, on TimescaleDB 1.x puts them off until infinity
+
+// types of jobs rules can apply to
+var jobTypes = map[string]bool{"all": true, "retention": true, "compression": true, "reorder": true, "refresh": true, "user-defined": true}
+
+//JobRule is a change to the restored jobs of a type, see above
+type JobRule struct {
+	Type             string                     `json:"type"`
+	Disable          bool                       `json:"disable,omitempty"`
+	Shift            string                     `json:"shift,omitempty"`
+	ScheduleInterval string                     `json:"schedule_interval,omitempty"`
+	Config           map[string]json.RawMessage `json:"config,omitempty"`
+}
+
+func (r JobRule) String() string {
+	var actions []string
+	if len(r.Config) > 0 {
+		keys := make([]string, 0, len(r.Config))
+		for key, value := range r.Config {
+			keys = append(keys, fmt.Sprintf("%s=%s", key, value))
+		}
+		actions = append(actions, "config "+strings.Join(keys, ", "))
+	}
+	if r.ScheduleInterval != "" {
+		actions = append(actions, "schedule interval "+r.ScheduleInterval)
+	}
+	if r.Shift != "" {
+		actions = append(actions, "shift by "+r.Shift)
+	}
+	if r.Disable {
+		actions = append(actions, "disable")
+	}
+	return fmt.Sprintf("%s jobs: %s", r.Type, strings.Join(actions, ", "))
+}
+
+//ReadJobRules reads and checks the job rules in fileName
+func ReadJobRules(fileName string) ([]JobRule, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read job rules: %w", err)
+	}
+	var rules []JobRule
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse job rules %s: %w", fileName, err)
+	}
+	for i, r := range rules {
+		if !jobTypes[r.Type] {
+			return nil, fmt.Errorf("job rule %d: unknown job type %q, use all, retention, compression, reorder, refresh or user-defined", i+1, r.Type)
+		}
+		if !r.Disable && r.Shift == "" && r.ScheduleInterval == "" && len(r.Config) == 0 {
+			return nil, fmt.Errorf("job rule %d: the rule does nothing", i+1)
+		}
+	}
+	return rules, nil
+}
+
+//CheckJobRules checks that the major version of TimescaleDB restored to
+//supports the job rules
+func CheckJobRules(rules []JobRule, tsMajorVersion int) error {
+	for i, r := range rules {
+		if len(r.Config) > 0 && tsMajorVersion < 2 {
+			return fmt.Errorf("job rule %d: the configuration of jobs can only be set from TimescaleDB 2 on", i+1)
+		}
+	}
+	return nil
+}
+
+//JobRuleSQL returns the statements used to apply job rules for the major
+//version of TimescaleDB: the type of a job (NULL for TimescaleDB's own jobs)
+//in terms of the columns of _timescaledb_config.bgw_job, and the statements
+//changing a job's configuration, schedule interval and next start, and
+//disabling it, which take the job's id and the new value
+func JobRuleSQL(tsMajorVersion int, tsSchema string) (typeSQL string, configSQL string, intervalSQL string, shiftSQL string, disableSQL string, err error) {
+	if tsMajorVersion == 1 {
+		typeSQL = `CASE job_type WHEN 'drop_chunks' THEN 'retention' WHEN 'compress_chunks' THEN 'compression'
+			WHEN 'reorder' THEN 'reorder' WHEN 'continuous_aggregate' THEN 'refresh' END`
+		intervalSQL = fmt.Sprintf(`SELECT %s.alter_job_schedule($1, schedule_interval => $2::interval)`, tsSchema)
+		shiftSQL = fmt.Sprintf(`SELECT %s.alter_job_schedule($1, next_start => coalesce((SELECT next_start FROM _timescaledb_internal.bgw_job_stat WHERE job_id = $1), now()) + $2::interval)`, tsSchema)
+		disableSQL = fmt.Sprintf(`SELECT %s.alter_job_schedule($1, next_start => 'infinity')`, tsSchema)
+	} else if tsMajorVersion == 2 {
+		typeSQL = `CASE WHEN id < 1000 THEN NULL WHEN proc_name = 'policy_retention' THEN 'retention'
+			WHEN proc_name = 'policy_compression' THEN 'compression' WHEN proc_name = 'policy_reorder' THEN 'reorder'
+			WHEN proc_name = 'policy_refresh_continuous_aggregate' THEN 'refresh' ELSE 'user-defined' END`
+		configSQL = fmt.Sprintf(`SELECT %s.alter_job(id, config => coalesce(config, '{}') || $2::jsonb) FROM _timescaledb_config.bgw_job WHERE id = $1`, tsSchema)
+		intervalSQL = fmt.Sprintf(`SELECT %s.alter_job($1, schedule_interval => $2::interval)`, tsSchema)
+		shiftSQL = fmt.Sprintf(`SELECT %s.alter_job($1, next_start => coalesce((SELECT next_start FROM _timescaledb_internal.bgw_job_stat WHERE job_id = $1), now()) + $2::interval)`, tsSchema)
+		disableSQL = fmt.Sprintf(`SELECT %s.alter_job($1, scheduled => false)`, tsSchema)
+	} else {
+		err = fmt.Errorf("unknown Timescale major version")
+	}
+	return typeSQL, configSQL, intervalSQL, shiftSQL, disableSQL, err
+}
@@ -0,0 +1,140 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package util
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Dumps that leave out some chunks pass them to pg_dump with --exclude-table or
+// --exclude-table-data. One option per chunk doesn't fit on the command line of
+// a database with tens of thousands of chunks, so chunks are given as patterns
+// instead (pg_dump takes the same patterns as psql's \d commands, which are
+// regular expressions apart from '.', '*', '?' and '$'). Chunk tables are named
+// by a prefix, their id and _chunk, and the chunks left out are usually runs of
+// consecutive ids, by time, so each run becomes a pattern matching its range of
+// ids. A run only spans ids of chunks left out, among those sharing the schema
+// and prefix, so the pattern doesn't match any chunk that is dumped.
+
+// longest pattern passed in a single option, well below the limit on the
+// length of a single argument
+const maxPatternLength = 4096
+
+var chunkTableNameRe = regexp.MustCompile(`^(.*)_([0-9]+)_chunk$`)
+
+//quotePattern quotes a name in a pattern, so it is matched literally
+func quotePattern(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+//NumberRangePattern returns a regular expression matching the decimal numbers
+//from lo to hi, without leading zeros
+func NumberRangePattern(lo, hi int64) string {
+	var parts []string
+	for lo <= hi {
+		//numbers up to the largest with as many digits as lo
+		top := int64(1)
+		for top <= lo {
+			top *= 10
+		}
+		end := top - 1
+		if end > hi {
+			end = hi
+		}
+		parts = append(parts, sameLengthRange(strconv.FormatInt(lo, 10), strconv.FormatInt(end, 10))...)
+		lo = end + 1
+	}
+	return strings.Join(parts, "|")
+}
+
+//sameLengthRange returns regular expressions matching the numbers from lo to
+//hi, both given with the same number of digits
+func sameLengthRange(lo, hi string) []string {
+	if lo == hi {
+		return []string{lo}
+	}
+	digits := func(from, to byte) string {
+		if from == to {
+			return string(from)
+		}
+		return fmt.Sprintf("[%c-%c]", from, to)
+	}
+	rest := len(lo) - 1
+	if strings.Trim(lo[1:], "0") == "" && strings.Trim(hi[1:], "9") == "" {
+		return []string{digits(lo[0], hi[0]) + strings.Repeat("[0-9]", rest)}
+	}
+	if lo[0] == hi[0] {
+		var parts []string
+		for _, p := range sameLengthRange(lo[1:], hi[1:]) {
+			parts = append(parts, string(lo[0])+p)
+		}
+		return parts
+	}
+	parts := sameLengthRange(lo, string(lo[0])+strings.Repeat("9", rest))
+	if hi[0]-lo[0] > 1 {
+		parts = append(parts, digits(lo[0]+1, hi[0]-1)+strings.Repeat("[0-9]", rest))
+	}
+	return append(parts, sameLengthRange(string(hi[0])+strings.Repeat("0", rest), hi)...)
+}
+
+//ChunkTablePatterns returns patterns matching the tables of the chunks whose
+//ids are in excluded, and no other chunk in chunks, see above
+func ChunkTablePatterns(chunks []ChunkInfo, excluded map[int64]bool) []string {
+	type group struct {
+		schema, prefix string
+		ids            []int64
+	}
+	groups := make(map[string]*group)
+	var keys []string
+	var patterns []string
+	for _, c := range chunks {
+		m := chunkTableNameRe.FindStringSubmatch(c.Table)
+		if m == nil || m[2] != strconv.FormatInt(c.ID, 10) {
+			if excluded[c.ID] {
+				patterns = append(patterns, quotePattern(c.Schema)+"."+quotePattern(c.Table))
+			}
+			continue
+		}
+		key := quotePattern(c.Schema) + "." + quotePattern(m[1])
+		g, ok := groups[key]
+		if !ok {
+			g = &group{schema: c.Schema, prefix: m[1]}
+			groups[key] = g
+			keys = append(keys, key)
+		}
+		g.ids = append(g.ids, c.ID)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		g := groups[key]
+		sort.Slice(g.ids, func(i, j int) bool { return g.ids[i] < g.ids[j] })
+		var ranges []string
+		for i := 0; i < len(g.ids); i++ {
+			if !excluded[g.ids[i]] {
+				continue
+			}
+			j := i
+			for j+1 < len(g.ids) && excluded[g.ids[j+1]] {
+				j++
+			}
+			ranges = append(ranges, NumberRangePattern(g.ids[i], g.ids[j]))
+			i = j
+		}
+		//ranges are split over several patterns to keep each one short
+		for len(ranges) > 0 {
+			n, length := 0, 0
+			for n < len(ranges) && (n == 0 || length+len(ranges[n]) < maxPatternLength) {
+				length += len(ranges[n]) + 1
+				n++
+			}
+			patterns = append(patterns, fmt.Sprintf("%s.%s_(%s)%s", quotePattern(g.schema), quotePattern(g.prefix), strings.Join(ranges[:n], "|"), quotePattern("_chunk")))
+			ranges = ranges[n:]
+		}
+	}
+	return patterns
+}
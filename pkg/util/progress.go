@@ -0,0 +1,91 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package util
+
+import (
+	"strconv"
+	"strings"
+)
+
+// The progress of pg_restore is followed through its verbose output, which is
+// only parsed in English, so pg_restore is run with LC_ALL=C. Up to PostgreSQL
+// 11 errors and warnings name the module reporting them in brackets, as in
+// "[archiver (db)] Error from TOC entry 3021; ...", since PostgreSQL 12 they
+// are prefixed by their level, as in "error: ..." and "from TOC entry 3021; ...".
+
+//Kinds of lines in the output of pg_restore
+const (
+	RestoreOutputOther    = iota // not a message of pg_restore
+	RestoreOutputInfo            // an informational message about nothing we track
+	RestoreOutputProblem         // an error or warning, or its details
+	RestoreOutputFailed          // the error restoring Entry
+	RestoreOutputLaunch          // the main process hands Entry to a worker
+	RestoreOutputFinished        // a worker is done with Entry
+	RestoreOutputProcess         // the main process restores Entry itself
+	RestoreOutputNamed           // an entry named Name is being restored
+)
+
+//RestoreMessage is what a line of the verbose output of pg_restore reports.
+//Entry is 0 if the line doesn't give a TOC entry id, Name is the description
+//and schema qualified name of the entry, as in "TABLE DATA public.conditions".
+type RestoreMessage struct {
+	Kind  int
+	Entry int
+	Name  string
+}
+
+//ParseRestoreMessage reads a line of the verbose output of pg_restore, see above
+func ParseRestoreMessage(line string) RestoreMessage {
+	i := strings.Index(line, "pg_restore: ")
+	if i < 0 {
+		return RestoreMessage{Kind: RestoreOutputOther}
+	}
+	msg := line[i+len("pg_restore: "):]
+	if strings.HasPrefix(msg, "[") {
+		// up to PostgreSQL 11 only problems name their module
+		if end := strings.Index(msg, "] "); end > 0 {
+			msg = msg[end+2:]
+		}
+		if strings.HasPrefix(msg, "Error from TOC entry ") {
+			return RestoreMessage{Kind: RestoreOutputFailed, Entry: leadingInt(strings.TrimPrefix(msg, "Error from TOC entry "))}
+		}
+		return RestoreMessage{Kind: RestoreOutputProblem}
+	}
+	switch {
+	case strings.HasPrefix(msg, "from TOC entry "):
+		return RestoreMessage{Kind: RestoreOutputFailed, Entry: leadingInt(strings.TrimPrefix(msg, "from TOC entry "))}
+	case strings.HasPrefix(msg, "error") || strings.HasPrefix(msg, "warning") || strings.HasPrefix(msg, "while ") ||
+		strings.HasPrefix(msg, "detail") || strings.HasPrefix(msg, "hint") || strings.HasPrefix(msg, "errors ignored"):
+		return RestoreMessage{Kind: RestoreOutputProblem}
+	case strings.HasPrefix(msg, "launching item "):
+		return RestoreMessage{Kind: RestoreOutputLaunch, Entry: leadingInt(strings.TrimPrefix(msg, "launching item "))}
+	case strings.HasPrefix(msg, "finished item "):
+		return RestoreMessage{Kind: RestoreOutputFinished, Entry: leadingInt(strings.TrimPrefix(msg, "finished item "))}
+	case strings.HasPrefix(msg, "processing item ") || strings.HasPrefix(msg, "processing missed item "):
+		msg = strings.TrimPrefix(strings.TrimPrefix(msg, "processing item "), "processing missed item ")
+		return RestoreMessage{Kind: RestoreOutputProcess, Entry: leadingInt(msg)}
+	case strings.HasPrefix(msg, "processing data for table \""):
+		name := strings.TrimSuffix(strings.TrimPrefix(msg, "processing data for table \""), "\"")
+		return RestoreMessage{Kind: RestoreOutputNamed, Name: "TABLE DATA " + name}
+	case strings.HasPrefix(msg, "creating "):
+		msg = strings.TrimPrefix(msg, "creating ")
+		if q := strings.Index(msg, " \""); q > 0 {
+			return RestoreMessage{Kind: RestoreOutputNamed, Name: msg[:q] + " " + strings.TrimSuffix(msg[q+2:], "\"")}
+		}
+	}
+	return RestoreMessage{Kind: RestoreOutputInfo}
+}
+
+//leadingInt returns the number s starts with, 0 if there is none
+func leadingInt(s string) int {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
+	}
+	n, err := strconv.Atoi(s[:end])
+	if err != nil {
+		return 0
+	}
+	return n
+}
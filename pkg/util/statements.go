@@ -0,0 +1,166 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package util
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgx/v4"
+)
+
+//SplitStatements splits an SQL script, such as those written by pg_dumpall,
+//into its statements, without the terminating semicolons. Comments between
+//statements and psql meta-commands (lines starting with a backslash) are left
+//out, quoted strings, identifiers and dollar quoted bodies are respected.
+func SplitStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	flush := func() {
+		stmnt := strings.TrimSpace(current.String())
+		if stmnt != "" {
+			statements = append(statements, stmnt)
+		}
+		current.Reset()
+	}
+	for i := 0; i < len(script); {
+		c := script[i]
+		atLineStart := i == 0 || script[i-1] == '\n'
+		empty := strings.TrimSpace(current.String()) == ""
+		switch {
+		case c == '\\' && atLineStart && empty:
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				return statements
+			}
+			i += end + 1
+		case c == '-' && strings.HasPrefix(script[i:], "--"):
+			end := strings.IndexByte(script[i:], '\n')
+			if end < 0 {
+				end = len(script) - i
+			}
+			if !empty {
+				current.WriteString(script[i : i+end])
+			}
+			i += end
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			end := blockCommentEnd(script, i)
+			if !empty {
+				current.WriteString(script[i:end])
+			}
+			i = end
+		case c == '\'' || c == '"':
+			backslashes := c == '\'' && i > 0 && (script[i-1] == 'E' || script[i-1] == 'e')
+			end := quotedEnd(script, i, c, backslashes)
+			current.WriteString(script[i:end])
+			i = end
+		case c == '$':
+			tag := dollarTag(script[i:])
+			if tag == "" {
+				current.WriteByte(c)
+				i++
+				continue
+			}
+			end := strings.Index(script[i+len(tag):], tag)
+			if end < 0 {
+				end = len(script)
+			} else {
+				end = i + len(tag) + end + len(tag)
+			}
+			current.WriteString(script[i:end])
+			i = end
+		case c == ';':
+			flush()
+			i++
+		default:
+			current.WriteByte(c)
+			i++
+		}
+	}
+	flush()
+	return statements
+}
+
+//blockCommentEnd returns the end of the, possibly nested, comment at i
+func blockCommentEnd(script string, i int) int {
+	depth := 0
+	for i < len(script) {
+		switch {
+		case strings.HasPrefix(script[i:], "/*"):
+			depth++
+			i += 2
+		case strings.HasPrefix(script[i:], "*/"):
+			depth--
+			i += 2
+			if depth == 0 {
+				return i
+			}
+		default:
+			i++
+		}
+	}
+	return len(script)
+}
+
+//quotedEnd returns the end of the string or identifier quoted with q at i
+func quotedEnd(script string, i int, q byte, backslashes bool) int {
+	for i++; i < len(script); i++ {
+		switch {
+		case backslashes && script[i] == '\\':
+			i++
+		case script[i] == q:
+			if i+1 < len(script) && script[i+1] == q {
+				i++
+				continue
+			}
+			return i + 1
+		}
+	}
+	return len(script)
+}
+
+//dollarTag returns the dollar quote tag s starts with, if any
+func dollarTag(s string) string {
+	for j := 1; j < len(s); j++ {
+		c := s[j]
+		if c == '$' {
+			return s[:j+1]
+		}
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' && j > 1 || c >= 0x80) {
+			return ""
+		}
+	}
+	return ""
+}
+
+// a role name as pg_dump writes it, quoted, or unquoted if it is all lower case
+// and not a keyword, keywords are written in upper case
+const roleNamePattern = `(?:"(?:[^"]|"")*"|[A-Za-z_][A-Za-z0-9_$]*)`
+
+// the places GRANT, REVOKE, ALTER DEFAULT PRIVILEGES and SET SESSION
+// AUTHORIZATION name roles in, followed by a list of role names
+var roleListRe = regexp.MustCompile(`((?i:\b(?:TO|FROM|FOR\s+ROLE|FOR\s+USER|GRANTED\s+BY|SESSION\s+AUTHORIZATION)|^(?:GRANT|REVOKE)(?:\s+ADMIN\s+OPTION\s+FOR)?)\s+)(` +
+	roleNamePattern + `(?:\s*,\s*` + roleNamePattern + `)*)`)
+
+var roleNameRe = regexp.MustCompile(roleNamePattern)
+
+//MapRoles replaces the mapped roles named as grantees, grantors or members in
+//a GRANT, REVOKE or ALTER DEFAULT PRIVILEGES statement written by pg_dump, or
+//in SET SESSION AUTHORIZATION. Unquoted words are only roles if they match a
+//role name exactly, so keywords such as ALL or SELECT are never taken for one.
+func MapRoles(stmnt string, roleMap Mapping) string {
+	return roleListRe.ReplaceAllStringFunc(stmnt, func(match string) string {
+		m := roleListRe.FindStringSubmatch(match)
+		return m[1] + roleNameRe.ReplaceAllStringFunc(m[2], func(name string) string {
+			role := name
+			if strings.HasPrefix(name, `"`) {
+				role = strings.ReplaceAll(name[1:len(name)-1], `""`, `"`)
+			}
+			if dst, ok := roleMap[role]; ok {
+				return pgx.Identifier{dst}.Sanitize()
+			}
+			return name
+		})
+	})
+}
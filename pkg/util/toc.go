@@ -0,0 +1,266 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+)
+
+//TOCEntry is a single entry of a table of contents as produced by pg_restore --list
+type TOCEntry struct {
+	Line   string // the original line, written back unchanged when creating --use-list files
+	DumpID int
+	Desc   string // the object type, ie TABLE DATA, INDEX, FK CONSTRAINT
+	Schema string // "-" for objects without a schema
+	Name   string
+	Owner  string
+}
+
+//QualifiedName returns the sanitized schema qualified name of the entry's object
+func (e TOCEntry) QualifiedName() string {
+	return pgx.Identifier{e.Schema, e.Name}.Sanitize()
+}
+
+// multi-word object types that pg_dump can put in a TOC, these need to be
+// matched before falling back to treating the first word as the type, as the
+// rest of the line is split on spaces. Longer types that share a prefix with
+// shorter ones must come first.
+var tocMultiWordDescs = []string{
+	"MATERIALIZED VIEW DATA",
+	"MATERIALIZED VIEW",
+	"TABLE DATA",
+	"TABLE ATTACH",
+	"SEQUENCE SET",
+	"SEQUENCE OWNED BY",
+	"FK CONSTRAINT",
+	"CHECK CONSTRAINT",
+	"DEFAULT ACL",
+	"INDEX ATTACH",
+	"LARGE OBJECT",
+	"BLOB METADATA",
+	"BLOB COMMENTS",
+	"ROW SECURITY",
+	"PUBLICATION TABLES IN SCHEMA",
+	"PUBLICATION TABLE",
+	"EVENT TRIGGER",
+	"FOREIGN TABLE",
+	"FOREIGN DATA WRAPPER",
+	"FOREIGN SERVER",
+	"USER MAPPING",
+	"SHELL TYPE",
+	"OPERATOR CLASS",
+	"OPERATOR FAMILY",
+	"PROCEDURAL LANGUAGE",
+	"ACCESS METHOD",
+	"DATABASE PROPERTIES",
+	"TEXT SEARCH CONFIGURATION",
+	"TEXT SEARCH DICTIONARY",
+	"TEXT SEARCH PARSER",
+	"TEXT SEARCH TEMPLATE",
+}
+
+//ParseTOCLine parses a line of pg_restore --list output, ok is false for
+//comment or blank lines that do not describe an entry.
+//Lines have the format: dumpId; tableoid oid desc schema name owner
+func ParseTOCLine(line string) (entry TOCEntry, ok bool) {
+	entry.Line = line
+	trimmed := strings.TrimSpace(line)
+	if trimmed == "" || strings.HasPrefix(trimmed, ";") {
+		return entry, false
+	}
+	semi := strings.Index(trimmed, ";")
+	if semi < 0 {
+		return entry, false
+	}
+	id, err := strconv.Atoi(trimmed[:semi])
+	if err != nil {
+		return entry, false
+	}
+	entry.DumpID = id
+	fields := strings.Fields(trimmed[semi+1:])
+	// skip the catalog tableoid and oid
+	if len(fields) < 3 {
+		return entry, false
+	}
+	rest := strings.Join(fields[2:], " ")
+	entry.Desc = fields[2]
+	for _, desc := range tocMultiWordDescs {
+		if strings.HasPrefix(rest, desc+" ") {
+			entry.Desc = desc
+			break
+		}
+	}
+	fields = strings.Fields(strings.TrimPrefix(rest, entry.Desc))
+	// older versions of pg_restore leave the owner empty for objects without
+	// one, which leaves a trailing space
+	noOwner := strings.HasSuffix(strings.TrimRight(line, "\r\n"), " ")
+	switch {
+	case len(fields) == 0:
+	case len(fields) == 1:
+		entry.Schema = fields[0]
+	case len(fields) == 2 || noOwner:
+		entry.Schema = fields[0]
+		entry.Name = strings.Join(fields[1:], " ")
+	default:
+		entry.Schema = fields[0]
+		entry.Name = strings.Join(fields[1:len(fields)-1], " ")
+		entry.Owner = fields[len(fields)-1]
+	}
+	return entry, true
+}
+
+//ReadTOC lists the table of contents of the directory format dump in dumpDir
+//using the pg_restore binary at restorePath.
+func ReadTOC(restorePath string, dumpDir string) ([]TOCEntry, error) {
+	var out bytes.Buffer
+	list := exec.Command(restorePath, dumpDir, "--list")
+	list.Stdout = &out
+	list.Stderr = os.Stderr
+	err := list.Run()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list table of contents of %s: %w", dumpDir, err)
+	}
+	var entries []TOCEntry
+	scanner := bufio.NewScanner(&out)
+	for scanner.Scan() {
+		if entry, ok := ParseTOCLine(scanner.Text()); ok {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+//WriteTOC writes entries in the format expected by pg_restore --use-list
+func WriteTOC(w io.Writer, entries []TOCEntry) error {
+	bw := bufio.NewWriter(w)
+	for _, entry := range entries {
+		_, err := fmt.Fprintln(bw, entry.Line)
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// header pg_restore writes in scripts before each object, the tablespace only
+// if the object has one
+var scriptHeaderRe = regexp.MustCompile(`^-- Name: (.*); Type: ([^;]+); Schema: ([^;]+); Owner: ([^;]*)(?:; Tablespace: (.+))?$`)
+
+//ChunkEnd is where the time dimension slice of a chunk ends, in TimescaleDB's
+//internal time, and whether its dimension is a time type
+type ChunkEnd struct {
+	End    int64
+	IsTime bool
+}
+
+//OrderRecentFirst orders the TABLE DATA entries of the chunks in ends, keyed
+//by schema and table name, after the other entries, newest first, with the
+//chunks of time types ahead of the others. The first batch of entries returned
+//holds everything but the chunks with data older than since only, the second
+//those chunks, it is empty if since is zero.
+func OrderRecentFirst(entries []TOCEntry, ends map[string]ChunkEnd, since time.Time) ([]TOCEntry, []TOCEntry) {
+	var first, chunks []TOCEntry
+	for _, entry := range entries {
+		if _, ok := ends[entry.Schema+"."+entry.Name]; ok && entry.Desc == "TABLE DATA" {
+			chunks = append(chunks, entry)
+		} else {
+			first = append(first, entry)
+		}
+	}
+	sort.SliceStable(chunks, func(i, j int) bool {
+		a, b := ends[chunks[i].Schema+"."+chunks[i].Name], ends[chunks[j].Schema+"."+chunks[j].Name]
+		if a.IsTime != b.IsTime {
+			return a.IsTime
+		}
+		return a.End > b.End
+	})
+	if since.IsZero() {
+		return append(first, chunks...), nil
+	}
+	internalSince := ToInternalTime(since)
+	var rest []TOCEntry
+	for _, entry := range chunks {
+		end := ends[entry.Schema+"."+entry.Name]
+		if end.IsTime && end.End > internalSince {
+			first = append(first, entry)
+		} else {
+			rest = append(rest, entry)
+		}
+	}
+	return first, rest
+}
+
+// Parallel pg_restore starts items in the order of the --use-list, as far as
+// their dependencies allow, so a huge index that happens to come last keeps one
+// worker busy long after the others are done. Data items are started by the
+// sizes pg_dump recorded for them already, but indexes only by their relpages
+// from PostgreSQL 13 on, and by TOC position before. So the index and
+// constraint entries of the post-data are reordered largest first, each kind
+// among the positions it held, by the sizes recorded in the dump, which keeps
+// the order of everything else as pg_dump wrote it.
+
+// kinds of entries reordered by size, none of them depends on another of its kind
+var sizedDescs = []string{"INDEX", "CONSTRAINT"}
+
+//OrderBySize returns the entries with those of each of sizedDescs ordered
+//largest first by sizes, keyed by their qualified names, see above. Entries
+//without a recorded size go last.
+func OrderBySize(entries []TOCEntry, sizes map[string]int64) []TOCEntry {
+	ordered := make([]TOCEntry, len(entries))
+	copy(ordered, entries)
+	for _, desc := range sizedDescs {
+		var slots []int
+		var kind []TOCEntry
+		var kindSizes []int64
+		for i, entry := range ordered {
+			if entry.Desc == desc {
+				slots = append(slots, i)
+				kind = append(kind, entry)
+				kindSizes = append(kindSizes, sizes[entry.QualifiedName()])
+			}
+		}
+		order := make([]int, len(kind))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return kindSizes[order[i]] > kindSizes[order[j]]
+		})
+		for i, slot := range slots {
+			ordered[slot] = kind[order[i]]
+		}
+	}
+	return ordered
+}
+
+//ScriptHeader is the comment pg_restore writes before each object in a script
+type ScriptHeader struct {
+	Name       string // constraints and triggers are named by their table and name
+	Desc       string
+	Schema     string // "-" for objects without a schema
+	Owner      string
+	Tablespace string // empty for the default tablespace
+}
+
+//ParseScriptHeader parses a line of a script written by pg_restore, ok is false
+//for lines that are not the header of an object, the headers of data included
+func ParseScriptHeader(line string) (header ScriptHeader, ok bool) {
+	m := scriptHeaderRe.FindStringSubmatch(line)
+	if m == nil {
+		return header, false
+	}
+	return ScriptHeader{Name: m[1], Desc: m[2], Schema: m[3], Owner: m[4], Tablespace: m[5]}, true
+}
@@ -6,10 +6,13 @@ package util
 import (
 	"bufio"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net/url"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
@@ -29,19 +32,291 @@ type Config struct {
 	Jobs                 int
 	DoUpdate             bool // whether to do an update after restoring.
 	DumpRoles            bool
+	DumpRolesMethod      string // pg_dumpall or native, see RolesMethod
+	DumpRolePasswords    bool
+	RolePasswordsKeyFile string // encrypts the role passwords on dump, decrypts them on restore
 	DumpTablespaces      bool
 	DumpPauseJobs        bool
+	DumpFingerprints     bool // record the fingerprints of the data of every table and chunk
 	DumpJobFinishTimeout int
 	DumpPauseUDAs        bool
+	DumpCaggRows         bool     // count the rows of the materializations of continuous aggregates
+	DumpAnalyzeStale     bool     // analyze tables whose size pg_dump would underestimate before a parallel dump
+	DumpIncrementalFrom  string   // the parent dump an incremental dump is taken relative to
+	Repository           string   // content addressed store for dump data files, see the store package
+	DumpSince            string   // only dump chunks with data at or after this time
+	DumpUntil            string   // only dump chunks with data before this time
+	Hypertables          []string // hypertables to dump or restore selectively, all if empty
+	RestoreResume        bool     // continue an interrupted restore where it stopped
+	RestoreStateFile     string   // where the progress of a restore is recorded, defaults to a file in the dump directory
+	RestoreForce         bool     // restore into a database that isn't empty
+	RestoreClean         bool     // drop the objects of the dump from the database before restoring
+	RestoreCreateDB      bool     // create the database being restored to like the dumped one
+	RestoreGlobals       bool     // apply the dumped roles and tablespaces before restoring
+	RestoreSettings      bool     // apply the dumped database and role settings after restoring
+	RestoreJobsDisabled  bool     // leave the restored background jobs unscheduled
+	RestoreJobRules      string   // file with rules changing the restored background jobs
+	RestoreRefreshCaggs  string   // the window to refresh continuous aggregates over after restoring, if any
+	RestoreVerify        string   // what to do when the fingerprints of the dump don't match the restored data, if checked
+	RestoreCheckCatalog  bool     // check the consistency of the TimescaleDB catalog after restoring
+	RestoreAnalyze       bool     // analyze the restored tables
+	RestoreAnalyzeSince  string   // only analyze chunks with data at or after this time
+	RestoreOrderBySize   bool     // start the largest data items and indexes first
+	RestoreRecentFirst   bool     // restore the data of the newest chunks first
+	RestoreRecentDays    int      // restore the chunks with data from this many days before the dump ahead of the rest
+	RestoreRecentHook    string   // command run once the data of the recent chunks is restored
+	VerifySourceURI      string   // the database ts-verify compares the target to
+	VerifyTargetURI      string   // the database ts-verify checks
+	TablespaceMap        Mapping  // tablespaces to restore into other tablespaces, "" is the default tablespace
+	RoleMap              Mapping  // roles whose objects and privileges are restored to other roles
 	PGDumpFlags          []string
 	PGRestoreFlags       []string
 }
 
+//Methods of dumping roles
+const (
+	//RolesPgDumpall dumps all roles of the cluster with pg_dumpall
+	RolesPgDumpall = "pg_dumpall"
+	//RolesNative dumps the roles the database refers to from the catalog
+	RolesNative = "native"
+)
+
+//What ts-restore does when fingerprints don't match
+const (
+	//VerifyWarn reports mismatched fingerprints in the restore summary
+	VerifyWarn = "warn"
+	//VerifyFail fails the restore on mismatched fingerprints
+	VerifyFail = "fail"
+)
+
+//Windows continuous aggregates are refreshed over after a restore
+const (
+	//RefreshFull refreshes continuous aggregates over all of their data
+	RefreshFull = "full"
+	//RefreshPolicy refreshes continuous aggregates over the window of their refresh policy
+	RefreshPolicy = "policy"
+)
+
+const (
+	//TsInfoFileName is the name of the JSON manifest written to every dump directory
+	TsInfoFileName = "timescaleVersionInfo.json"
+	//PgDumpDirName is the name of the pg_dump output directory inside a dump directory
+	PgDumpDirName = "pgdump"
+	//RolePasswordsFileName is the name of the file role passwords are dumped into
+	RolePasswordsFileName = "role_passwords.sql"
+	//EncryptedSuffix is added to the names of encrypted files
+	EncryptedSuffix = ".enc"
+)
+
 //TsInfo holds information about the Timescale installation
 type TsInfo struct {
-	TsInfoVersion int //TODO: How to do versioning here? Should this happen?
-	TsVersion     string
-	TsSchema      string
+	TsInfoVersion     int //TODO: How to do versioning here? Should this happen?
+	TsVersion         string
+	TsSchema          string
+	ParentDumpDir     string            `json:",omitempty"` // for incremental dumps, the parent dump, relative to this dump's directory
+	Chunks            []ChunkInfo       `json:",omitempty"`
+	Repository        string            `json:",omitempty"` // the repository the data files were stored in, if any
+	StoredFiles       []StoredFile      `json:",omitempty"`
+	TimeRange         *TimeRange        `json:",omitempty"` // set if only chunks in a time range were dumped
+	Selective         bool              `json:",omitempty"` // set if only the hypertables listed were dumped
+	Hypertables       []HypertableInfo  `json:",omitempty"`
+	Snapshot          *SnapshotInfo     `json:",omitempty"` // the point in time everything in the dump describes, apart from IndexSizes
+	Database          *DatabaseInfo     `json:",omitempty"`
+	RolesMethod       string            `json:",omitempty"` // how roles.sql was dumped, if it was
+	RolePasswordsFile string            `json:",omitempty"` // the file role passwords were dumped into, if they were
+	Fingerprints      []DataFingerprint `json:",omitempty"` // the data of every table and chunk, if recorded
+	IndexSizes        map[string]int64  `json:",omitempty"` // bytes, by the qualified name of the TOC entry of each index and constraint, not as of the snapshot
+}
+
+//DataFingerprint records the data of a regular table, or a chunk, at the time
+//of the dump, by number of rows and a hash aggregate of them, see pkg/verify
+type DataFingerprint struct {
+	Table      string // sanitized and schema qualified
+	Hypertable string `json:",omitempty"` // for chunks, chunks are identified by their hypertable and dimension slices
+	Slices     string `json:",omitempty"`
+	Rows       int64
+	Hash       string
+}
+
+//SnapshotInfo records the snapshot a dump was taken in
+type SnapshotInfo struct {
+	ID   string
+	LSN  string // the WAL position at the time of the snapshot, on a standby the last replayed one
+	Time time.Time
+}
+
+//HypertableInfo describes a hypertable well enough to recreate it, and its
+//data, in a database that has other hypertables already
+type HypertableInfo struct {
+	ID                int64
+	Schema            string
+	Table             string
+	Dimensions        []DimensionInfo
+	Tablespaces       []string            `json:",omitempty"`
+	CompressSegmentBy string              `json:",omitempty"`
+	CompressOrderBy   string              `json:",omitempty"`
+	Compressed        bool                `json:",omitempty"` // whether compression is enabled
+	CompressedRanges  []SliceRange        `json:",omitempty"` // time ranges of chunks that were compressed
+	DataFile          string              `json:",omitempty"` // for selective dumps, the file holding the data, relative to the dump directory
+	ContinuousAggs    []ContinuousAggInfo `json:",omitempty"`
+	Columns           []string            `json:",omitempty"` // sanitized names of the columns holding data, leaving out generated ones
+	Policies          []PolicyInfo        `json:",omitempty"`
+	ForeignKeys       []string            // names of the foreign keys of the parent table, null in dumps that don't record them
+}
+
+//QualifiedName returns the sanitized schema qualified name of the hypertable
+func (h HypertableInfo) QualifiedName() string {
+	return pgx.Identifier{h.Schema, h.Table}.Sanitize()
+}
+
+//SelectList returns the columns to copy the data of the hypertable out of, all
+//of them if the dump doesn't record its columns
+func (h HypertableInfo) SelectList() string {
+	if len(h.Columns) == 0 {
+		return "*"
+	}
+	return strings.Join(h.Columns, ", ")
+}
+
+//ColumnList returns the columns to copy the data of the hypertable into, in
+//parentheses, or nothing if the dump doesn't record its columns
+func (h HypertableInfo) ColumnList() string {
+	if len(h.Columns) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(h.Columns, ", ") + ")"
+}
+
+//PolicyInfo describes a policy of a hypertable or continuous aggregate in a
+//form that doesn't depend on the TimescaleDB version. After and the offsets are
+//JSON, a string holding an interval, a number for integer time or null.
+type PolicyInfo struct {
+	Type             string          // retention, compression, reorder or refresh
+	After            json.RawMessage `json:",omitempty"` // retention and compression: chunks older than this
+	IndexName        string          `json:",omitempty"` // reorder
+	StartOffset      json.RawMessage `json:",omitempty"` // refresh
+	EndOffset        json.RawMessage `json:",omitempty"` // refresh
+	ScheduleInterval string          `json:",omitempty"`
+}
+
+//DimensionInfo describes a dimension of a hypertable, the first open
+//dimension is the time dimension
+type DimensionInfo struct {
+	ColumnName       string
+	Open             bool
+	IntervalLength   int64  `json:",omitempty"` // open dimensions only, in TimescaleDB's internal time units
+	NumSlices        int    `json:",omitempty"` // closed dimensions only
+	PartitioningFunc string `json:",omitempty"` // closed dimensions only, schema qualified
+}
+
+//SliceRange is a range in TimescaleDB's internal time representation
+type SliceRange struct {
+	Start int64
+	End   int64
+}
+
+//ContinuousAggInfo describes a continuous aggregate on a hypertable
+type ContinuousAggInfo struct {
+	Schema           string
+	Name             string
+	Definition       string // the SELECT the continuous aggregate was created with
+	MaterializedOnly bool
+	MaterializedRows *int64       `json:",omitempty"` // rows in its materialization at the time of the dump, if counted
+	Policies         []PolicyInfo `json:",omitempty"`
+}
+
+//QualifiedName returns the sanitized schema qualified name of the continuous aggregate
+func (c ContinuousAggInfo) QualifiedName() string {
+	return pgx.Identifier{c.Schema, c.Name}.Sanitize()
+}
+
+//StringList is a flag.Value collecting the values of a flag that can be given multiple times
+type StringList []string
+
+func (s *StringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+//Set appends a value to the list
+func (s *StringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+//Mapping is a flag.Value collecting old=new pairs from a flag that can be
+//given multiple times
+type Mapping map[string]string
+
+func (m *Mapping) String() string {
+	var pairs []string
+	for old, to := range *m {
+		pairs = append(pairs, old+"="+to)
+	}
+	return strings.Join(pairs, ",")
+}
+
+//Set adds a pair to the mapping, the new value may be empty
+func (m *Mapping) Set(value string) error {
+	i := strings.IndexByte(value, '=')
+	if i <= 0 {
+		return fmt.Errorf("invalid mapping %q, use old=new", value)
+	}
+	if *m == nil {
+		*m = make(Mapping)
+	}
+	old := value[:i]
+	if _, ok := (*m)[old]; ok {
+		return fmt.Errorf("%s is mapped more than once", old)
+	}
+	(*m)[old] = value[i+1:]
+	return nil
+}
+
+//TimeRange records the time range a partial dump was restricted to and the
+//chunks that were left out of it, the catalog rows of those chunks are still in
+//the dump and have to be removed when restoring.
+type TimeRange struct {
+	Since            time.Time // zero if unbounded
+	Until            time.Time // zero if unbounded
+	ExcludedChunkIDs []int64
+}
+
+//StoredFile records a data file of the pgdump directory that was moved into a repository
+type StoredFile struct {
+	File  string // name of the file in the pgdump directory
+	Hash  string // SHA-256 of the file content, which is also its name in the repository
+	Size  int64
+	Table string `json:",omitempty"` // the table whose data the file contains, if known
+}
+
+//ChunkInfo holds the fingerprint of a chunk at dump time, used to decide
+//whether an incremental dump needs to dump the chunk's data again
+type ChunkInfo struct {
+	ID                int64
+	HypertableID      int64
+	Schema            string
+	Table             string
+	CompressedChunkID int64  `json:",omitempty"`
+	Rows              int64  `json:",omitempty"` // the fingerprint of the chunk's data, see pkg/verify, compressed chunks have that of their chunk
+	Hash              string `json:",omitempty"`
+	Dumped            bool   // whether the chunk's data is contained in this dump or must be taken from a parent
+}
+
+//QualifiedName returns the sanitized schema qualified name of the chunk table
+func (c ChunkInfo) QualifiedName() string {
+	return pgx.Identifier{c.Schema, c.Table}.Sanitize()
+}
+
+//SameData reports whether two fingerprints describe the same, unchanged chunk
+//data, chunks without a fingerprint never do
+func (c ChunkInfo) SameData(other ChunkInfo) bool {
+	return c.Hash != "" &&
+		c.ID == other.ID &&
+		c.Schema == other.Schema &&
+		c.Table == other.Table &&
+		c.CompressedChunkID == other.CompressedChunkID &&
+		c.Rows == other.Rows &&
+		c.Hash == other.Hash
 }
 
 //RegisterCommonConfigFlags registers user input flags common to both dump and restore (incl defaults) in the config struct
@@ -49,6 +324,7 @@ func RegisterCommonConfigFlags(cf *Config) *Config {
 	flag.StringVar(&cf.DbURI, "db-URI", "", "the PostgreSQL URI in postgresql://[user[:password]@][netloc][:port][,...][/dbname][?param1=value1&...] format")
 	flag.StringVar(&cf.DumpDir, "dump-dir", "", "the directory to place the dump in or to restore from")
 	flag.IntVar(&cf.Jobs, "jobs", 4, "specifies whether parallel jobs will be used, defaults to 4, set to 0 to disable parallelism")
+	flag.StringVar(&cf.Repository, "repository", "", "a directory in which data files are stored once by their content and shared between dumps, on restore defaults to the repository recorded in the dump")
 	return cf
 }
 
@@ -60,11 +336,96 @@ func CleanConfig(cf *Config) (*Config, error) {
 	}
 
 	cf.DumpDir = dd
-	cf.PgDumpDir = filepath.Join(cf.DumpDir, "pgdump")
-	cf.TsInfoFileName = filepath.Join(cf.DumpDir, "timescaleVersionInfo.json")
+	cf.PgDumpDir = filepath.Join(cf.DumpDir, PgDumpDirName)
+	cf.TsInfoFileName = filepath.Join(cf.DumpDir, TsInfoFileName)
+	if cf.Repository != "" {
+		cf.Repository, err = filepath.Abs(cf.Repository)
+		if err != nil {
+			return cf, err
+		}
+	}
+	for _, t := range []string{cf.DumpSince, cf.DumpUntil, cf.RestoreAnalyzeSince} {
+		if t != "" {
+			_, err = ParseTime(t)
+			if err != nil {
+				return cf, err
+			}
+		}
+	}
+	if cf.DumpRolesMethod != "" && cf.DumpRolesMethod != RolesPgDumpall && cf.DumpRolesMethod != RolesNative {
+		return cf, fmt.Errorf("unknown method of dumping roles %q, use %s or %s", cf.DumpRolesMethod, RolesPgDumpall, RolesNative)
+	}
+	if cf.RestoreRefreshCaggs != "" && cf.RestoreRefreshCaggs != RefreshFull && cf.RestoreRefreshCaggs != RefreshPolicy {
+		return cf, fmt.Errorf("unknown window to refresh continuous aggregates over %q, use %s or %s", cf.RestoreRefreshCaggs, RefreshFull, RefreshPolicy)
+	}
+	if cf.RestoreVerify != "" && cf.RestoreVerify != VerifyWarn && cf.RestoreVerify != VerifyFail {
+		return cf, fmt.Errorf("unknown action on mismatched fingerprints %q, use %s or %s", cf.RestoreVerify, VerifyWarn, VerifyFail)
+	}
+	if cf.RestoreRecentDays < 0 {
+		return cf, errors.New("the number of recent days to restore first can't be negative")
+	}
+	if cf.RestoreRecentHook != "" && cf.RestoreRecentDays == 0 {
+		return cf, errors.New("the recent data hook needs the number of recent days to restore first")
+	}
+	if cf.RestoreRecentDays > 0 {
+		cf.RestoreRecentFirst = true
+	}
+	if cf.DumpRolePasswords && !cf.DumpRoles {
+		return cf, errors.New("role passwords can only be dumped along with the roles")
+	}
+	if cf.RolePasswordsKeyFile != "" {
+		cf.RolePasswordsKeyFile, err = filepath.Abs(cf.RolePasswordsKeyFile)
+		if err != nil {
+			return cf, err
+		}
+	}
+	if cf.DumpIncrementalFrom != "" {
+		cf.DumpIncrementalFrom, err = filepath.Abs(cf.DumpIncrementalFrom)
+		if err != nil {
+			return cf, err
+		}
+	}
 	return cf, err
 }
 
+//ParseTime parses a user supplied timestamp, either in RFC 3339 format or as
+//a date or date and time without time zone, which are taken to be UTC.
+func ParseTime(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02"} {
+		t, err := time.Parse(layout, value)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q, use RFC 3339 format, for example 2020-10-04T14:21:08Z", value)
+}
+
+// the TimescaleDB internal time is microseconds since the PostgreSQL epoch
+var pgEpoch = time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+
+//ToInternalTime converts a time to TimescaleDB's internal time representation
+//of timestamp, timestamptz and date dimensions
+func ToInternalTime(t time.Time) int64 {
+	return (t.Unix()-pgEpoch.Unix())*1000000 + int64(t.Nanosecond()/1000)
+}
+
+//ReadTsInfo reads the Timescale info written by a dump from the file at fileName
+func ReadTsInfo(fileName string) (TsInfo, error) {
+	var tsInfo TsInfo
+	file, err := os.Open(fileName)
+	if err != nil {
+		return tsInfo, fmt.Errorf("failed to open version file: %w", err)
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+
+	err = decoder.Decode(&tsInfo)
+	if err != nil {
+		return tsInfo, fmt.Errorf("failed to decode tsInfo JSON: %w", err)
+	}
+	return tsInfo, err
+}
+
 //GetDBConn returns a pgx Conn from a dbURI
 func GetDBConn(dbContext context.Context, dbURI string) (*pgx.Conn, error) {
 	config, err := pgx.ParseConfig(dbURI)
@@ -78,6 +439,78 @@ func GetDBConn(dbContext context.Context, dbURI string) (*pgx.Conn, error) {
 	return conn, err
 }
 
+//WithDatabase returns dbURI changed to connect to the database dbName instead,
+//it may be a URI or a key/value connection string
+func WithDatabase(dbURI string, dbName string) (string, error) {
+	if strings.HasPrefix(dbURI, "postgres://") || strings.HasPrefix(dbURI, "postgresql://") {
+		u, err := url.Parse(dbURI)
+		if err != nil {
+			return dbURI, fmt.Errorf("invalid connection string: %w", err)
+		}
+		u.Path = "/" + dbName
+		u.RawPath = ""
+		return u.String(), nil
+	}
+	// later settings override earlier ones
+	quoted := strings.ReplaceAll(strings.ReplaceAll(dbName, `\`, `\\`), "'", `\'`)
+	return fmt.Sprintf("%s dbname='%s'", dbURI, quoted), nil
+}
+
+//ParseQualifiedName splits a table name given by a user, which may be schema
+//qualified and quoted, into its parts following the rules PostgreSQL uses for
+//identifiers: unquoted parts are folded to lower case. schema is empty if the
+//name is not qualified.
+func ParseQualifiedName(name string) (schema string, table string, err error) {
+	var parts []string
+	for i := 0; ; {
+		var part strings.Builder
+		if i < len(name) && name[i] == '"' {
+			i++
+			for {
+				if i >= len(name) {
+					return "", "", fmt.Errorf("invalid name %s: unterminated quoted identifier", name)
+				}
+				if name[i] == '"' {
+					if i+1 < len(name) && name[i+1] == '"' {
+						part.WriteByte('"')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				part.WriteByte(name[i])
+				i++
+			}
+		} else {
+			end := strings.IndexByte(name[i:], '.')
+			if end < 0 {
+				end = len(name) - i
+			}
+			part.WriteString(strings.ToLower(name[i : i+end]))
+			i += end
+		}
+		if part.Len() == 0 {
+			return "", "", fmt.Errorf("invalid name %s: empty identifier", name)
+		}
+		parts = append(parts, part.String())
+		if i == len(name) {
+			break
+		}
+		if name[i] != '.' {
+			return "", "", fmt.Errorf("invalid name %s: unexpected character after quoted identifier", name)
+		}
+		i++
+	}
+	if len(parts) > 2 {
+		return "", "", fmt.Errorf("invalid name %s: too many dotted parts", name)
+	}
+	if len(parts) == 1 {
+		return "", parts[0], nil
+	}
+	return parts[0], parts[1], nil
+}
+
 //CreateTimescaleAtVer takes in a dbURI, a Timescale version and schema and
 // cleans out any version of the extension that exists, then creates the version
 // we want in the correct schema etc.
@@ -0,0 +1,405 @@
+// This file and its contents are licensed under the Timescale License
+// Please see the included NOTICE for copyright information and
+// LICENSE for a copy of the license.
+package verify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/timescale/timescaledb-backup/pkg/util"
+)
+
+// ts-verify compares the data of a database restored by ts-restore with the
+// database it was dumped from. Regular tables are compared as a whole and
+// hypertables chunk by chunk, so that mismatches can be traced to the chunks
+// they are in. Chunks are matched by their hypertable and dimension slices
+// rather than by name, which other ways of copying hypertables don't keep.
+//
+// Tables and chunks are compared by fingerprint: the number of rows and a hash
+// aggregate of them, the sum of the first 64 bits of the MD5 of each row's text
+// representation, which doesn't depend on the order rows are read in. The text
+// representation depends on some settings, which are set to the same values
+// on both sides, and on the PostgreSQL version for floating point values, so
+// comparing databases on different major versions may report tables with
+// floating point columns as mismatched. Compressed chunks are read
+// decompressed.
+
+// schemas whose tables belong to PostgreSQL or TimescaleDB, chunks are found
+// through the catalog
+var internalSchemas = []string{"pg_catalog", "information_schema", "_timescaledb_catalog", "_timescaledb_config",
+	"_timescaledb_internal", "_timescaledb_cache", "_timescaledb_functions", "timescaledb_information", "timescaledb_experimental"}
+
+// settings the text representation of rows depends on
+const fingerprintSettingsSQL = `SET TimeZone TO 'UTC'; SET DateStyle TO 'ISO, YMD'; SET IntervalStyle TO 'postgres';
+	SET extra_float_digits TO 3; SET bytea_output TO 'hex'`
+
+const fingerprintSQL = `SELECT count(*), coalesce(sum(('x' || substr(md5(t::text), 1, 16))::bit(64)::bigint::numeric), 0)::text FROM %s t`
+
+// regular tables that are not hypertables, chunks or part of an extension
+const tablesSQL = `SELECT format('%I.%I', n.nspname, c.relname) FROM pg_class c
+	INNER JOIN pg_namespace n ON n.oid = c.relnamespace
+	WHERE c.relkind = 'r' AND NOT n.nspname = ANY($1) AND n.nspname !~ '^pg_toast' AND n.nspname !~ '^pg_temp'
+	AND NOT EXISTS (SELECT 1 FROM pg_depend d WHERE d.classid = 'pg_class'::regclass AND d.objid = c.oid AND d.deptype = 'e')
+	AND NOT EXISTS (SELECT 1 FROM _timescaledb_catalog.hypertable h WHERE h.schema_name = n.nspname AND h.table_name = c.relname)
+	AND NOT EXISTS (SELECT 1 FROM _timescaledb_catalog.chunk k WHERE k.schema_name = n.nspname AND k.table_name = c.relname)
+	ORDER BY 1`
+
+// the chunks of all hypertables, apart from the internal hypertables holding
+// compressed data, with their dimension slices
+const chunksSQL = `SELECT format('%I.%I', h.schema_name, h.table_name), format('%I.%I', c.schema_name, c.table_name),
+	string_agg(format('%s [%s, %s)', d.column_name, s.range_start, s.range_end), ', ' ORDER BY d.column_name)
+	FROM _timescaledb_catalog.chunk c
+	INNER JOIN _timescaledb_catalog.hypertable h ON h.id = c.hypertable_id
+	INNER JOIN _timescaledb_catalog.chunk_constraint cc ON cc.chunk_id = c.id
+	INNER JOIN _timescaledb_catalog.dimension_slice s ON s.id = cc.dimension_slice_id
+	INNER JOIN _timescaledb_catalog.dimension d ON d.id = s.dimension_id
+	WHERE NOT coalesce((to_jsonb(h)->>'compressed')::bool, false)
+	AND coalesce((to_jsonb(h)->>'compression_state')::int, 0) <> 2
+	AND NOT coalesce((to_jsonb(c)->>'dropped')::bool, false)
+	GROUP BY h.schema_name, h.table_name, c.id, c.schema_name, c.table_name
+	ORDER BY 1, c.id`
+
+//Fingerprint identifies the data of a table, see above
+type Fingerprint struct {
+	Rows int64
+	Hash string
+}
+
+//Connect connects to the database at dbURI to take fingerprints
+func Connect(ctx context.Context, dbURI string) (*pgx.Conn, error) {
+	conn, err := util.GetDBConn(ctx, dbURI)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Exec(ctx, fingerprintSettingsSQL)
+	if err != nil {
+		conn.Close(ctx)
+		return nil, err
+	}
+	return conn, nil
+}
+
+//TableFingerprint takes the fingerprint of a table, given by its sanitized
+//name, on a connection opened with Connect
+func TableFingerprint(conn *pgx.Conn, table string) (Fingerprint, error) {
+	f := Fingerprint{}
+	err := conn.QueryRow(context.Background(), fmt.Sprintf(fingerprintSQL, table)).Scan(&f.Rows, &f.Hash)
+	return f, err
+}
+
+//Table is a regular table, or a chunk of a hypertable, to take the
+//fingerprint of
+type Table struct {
+	Name       string // sanitized and schema qualified
+	Hypertable string // for chunks
+	Slices     string // for chunks, their dimension slices
+}
+
+//Key identifies the table across databases, chunks by their hypertable and
+//dimension slices
+func (t Table) Key() string {
+	if t.Hypertable == "" {
+		return "table " + t.Name
+	}
+	return strings.Join([]string{"chunk", t.Hypertable, t.Slices}, " ")
+}
+
+//ListTables lists the regular tables and chunks of the database conn is
+//connected to, see above
+func ListTables(conn *pgx.Conn) ([]Table, error) {
+	ctx := context.Background()
+	var names []string
+	err := conn.QueryRow(ctx, "SELECT coalesce(array_agg(t), '{}') FROM ("+tablesSQL+") s(t)", internalSchemas).Scan(&names)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	var tables []Table
+	for _, name := range names {
+		tables = append(tables, Table{Name: name})
+	}
+	rows, err := conn.Query(ctx, chunksSQL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chunks: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		t := Table{}
+		err = rows.Scan(&t.Hypertable, &t.Name, &t.Slices)
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	return tables, rows.Err()
+}
+
+//Fingerprints takes the fingerprints of tables, given by their sanitized
+//names, up to jobs at a time on connections opened with connect, and returns
+//them by name
+func Fingerprints(tables []string, jobs int, verbose bool, connect func() (*pgx.Conn, error)) (map[string]Fingerprint, error) {
+	if jobs < 1 {
+		jobs = 1
+	}
+	todo := make(chan string)
+	fingerprints := make(map[string]Fingerprint, len(tables))
+	var mu sync.Mutex
+	var errs []error
+	var wg sync.WaitGroup
+	for i := 0; i < jobs && i < len(tables); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := connect()
+			if err == nil {
+				defer conn.Close(context.Background())
+			}
+			// tables keep being taken after an error, so as not to block
+			for table := range todo {
+				if err != nil {
+					continue
+				}
+				if verbose {
+					fmt.Printf("%sTaking fingerprint of %s\n", time.Now().Format("2006/01/02 15:04:05 "), table)
+				}
+				var f Fingerprint
+				f, err = TableFingerprint(conn, table)
+				if err != nil {
+					err = fmt.Errorf("failed to take fingerprint of %s: %w", table, err)
+					continue
+				}
+				mu.Lock()
+				fingerprints[table] = f
+				mu.Unlock()
+			}
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, table := range tables {
+		todo <- table
+	}
+	close(todo)
+	wg.Wait()
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return fingerprints, nil
+}
+
+//Compare describes how the fingerprint of a table differs from the one it
+//should have, or returns "" if it doesn't
+func Compare(expected Fingerprint, actual Fingerprint) string {
+	switch {
+	case expected.Rows != actual.Rows:
+		return fmt.Sprintf("expected %d rows, found %d", expected.Rows, actual.Rows)
+	case expected.Hash != actual.Hash:
+		return fmt.Sprintf("both have %d rows, but their contents differ", expected.Rows)
+	}
+	return ""
+}
+
+//check compares a table, or a chunk, in both databases, the table is empty
+//for a database it is missing from
+type check struct {
+	hypertable string // for chunks
+	slices     string // for chunks, identifies them across databases
+	source     string
+	target     string
+}
+
+func (c check) String() string {
+	if c.hypertable == "" {
+		return "table " + c.source
+	}
+	name := c.source
+	if name == "" {
+		name = c.target
+	}
+	return fmt.Sprintf("hypertable %s chunk %s (%s)", c.hypertable, name, c.slices)
+}
+
+//DoVerify compares the data of the databases at cf.VerifySourceURI and
+//cf.VerifyTargetURI, using up to cf.Jobs connections to each in parallel, and
+//returns an error if they differ
+func DoVerify(cf *util.Config) error {
+	if cf.VerifySourceURI == "" || cf.VerifyTargetURI == "" {
+		return errors.New("both the source and the target database have to be given")
+	}
+	checks, err := planChecks(cf)
+	if err != nil {
+		return err
+	}
+	jobs := cf.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+	todo := make(chan check)
+	var mu sync.Mutex
+	var errs []error
+	mismatches, tables, chunks := 0, 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < jobs && i < len(checks); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := runChecks(cf, todo, func(c check, mismatch string) {
+				mu.Lock()
+				defer mu.Unlock()
+				if c.hypertable == "" {
+					tables++
+				} else {
+					chunks++
+				}
+				if mismatch != "" {
+					mismatches++
+					fmt.Printf("%sMISMATCH: %s: %s\n", time.Now().Format("2006/01/02 15:04:05 "), c, mismatch)
+				}
+			})
+			if err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, c := range checks {
+		todo <- c
+	}
+	close(todo)
+	wg.Wait()
+	if len(errs) > 0 {
+		return errs[0]
+	}
+	fmt.Printf("%sCompared %d tables and %d chunks, %d mismatches\n", time.Now().Format("2006/01/02 15:04:05 "), tables, chunks, mismatches)
+	if mismatches > 0 {
+		return fmt.Errorf("the databases differ in %d tables or chunks", mismatches)
+	}
+	return nil
+}
+
+//runChecks takes the checks from todo and reports their outcome until there
+//are none left, it keeps taking them after an error so as not to block
+func runChecks(cf *util.Config, todo <-chan check, report func(check, string)) error {
+	ctx := context.Background()
+	source, err := Connect(ctx, cf.VerifySourceURI)
+	if err != nil {
+		for range todo {
+		}
+		return err
+	}
+	defer source.Close(ctx)
+	target, err := Connect(ctx, cf.VerifyTargetURI)
+	if err != nil {
+		for range todo {
+		}
+		return err
+	}
+	defer target.Close(ctx)
+	for c := range todo {
+		if err != nil {
+			continue
+		}
+		if cf.Verbose {
+			fmt.Printf("%sComparing %s\n", time.Now().Format("2006/01/02 15:04:05 "), c)
+		}
+		var mismatch string
+		mismatch, err = runCheck(source, target, c)
+		if err != nil {
+			err = fmt.Errorf("failed to compare %s: %w", c, err)
+			continue
+		}
+		report(c, mismatch)
+	}
+	return err
+}
+
+//runCheck compares the fingerprints of a table, or chunk, and describes how
+//they differ, tables and chunks missing on one side only differ if the other
+//side has rows
+func runCheck(source *pgx.Conn, target *pgx.Conn, c check) (string, error) {
+	var s, t Fingerprint
+	var err error
+	if c.source != "" {
+		s, err = TableFingerprint(source, c.source)
+		if err != nil {
+			return "", err
+		}
+	}
+	if c.target != "" {
+		t, err = TableFingerprint(target, c.target)
+		if err != nil {
+			return "", err
+		}
+	}
+	switch {
+	case c.target == "" && s.Rows > 0:
+		return fmt.Sprintf("missing from the target, the source has %d rows", s.Rows), nil
+	case c.source == "" && t.Rows > 0:
+		return fmt.Sprintf("missing from the source, the target has %d rows", t.Rows), nil
+	case c.source == "" || c.target == "":
+		return "", nil
+	}
+	return Compare(s, t), nil
+}
+
+//planChecks lists the tables and chunks of both databases and matches them
+func planChecks(cf *util.Config) ([]check, error) {
+	ctx := context.Background()
+	source, err := util.GetDBConn(ctx, cf.VerifySourceURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the source database: %w", err)
+	}
+	defer source.Close(ctx)
+	target, err := util.GetDBConn(ctx, cf.VerifyTargetURI)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to the target database: %w", err)
+	}
+	defer target.Close(ctx)
+
+	byKey := make(map[string]*check)
+	var keys []string
+	add := func(key string, c check, isSource bool, name string) {
+		existing, ok := byKey[key]
+		if !ok {
+			existing = &c
+			byKey[key] = existing
+			keys = append(keys, key)
+		}
+		if isSource {
+			existing.source = name
+		} else {
+			existing.target = name
+		}
+	}
+	for _, side := range []struct {
+		conn     *pgx.Conn
+		isSource bool
+	}{{source, true}, {target, false}} {
+		tables, err := ListTables(side.conn)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range tables {
+			add(t.Key(), check{hypertable: t.Hypertable, slices: t.Slices}, side.isSource, t.Name)
+		}
+	}
+	sort.Strings(keys)
+	checks := make([]check, 0, len(keys))
+	for _, key := range keys {
+		checks = append(checks, *byKey[key])
+	}
+	if cf.Verbose {
+		fmt.Printf("%sComparing %d tables and chunks\n", time.Now().Format("2006/01/02 15:04:05 "), len(checks))
+	}
+	return checks, nil
+}